@@ -0,0 +1,188 @@
+package pious
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Condition is a jmp condition. The values index disCondition.
+type Condition uint16
+
+const (
+	CondAlways Condition = iota
+	CondNotX
+	CondXDec
+	CondNotY
+	CondYDec
+	CondXNotEqualY
+	CondPin
+	CondNotOSRE
+)
+
+// String returns the assembly syntax of a jmp condition.
+func (c Condition) String() string {
+	if int(c) < len(disCondition) {
+		return disCondition[c]
+	}
+	return fmt.Sprintf("Condition(%d)", uint16(c))
+}
+
+// Destination is an out or set destination. The values index
+// disDestinations.
+type Destination uint16
+
+const (
+	DestPins Destination = iota
+	DestX
+	DestY
+	DestNull
+	DestPindirs
+	DestPC
+	DestISR
+	DestExec
+)
+
+// String returns the assembly syntax of an out or set destination.
+func (d Destination) String() string {
+	if int(d) < len(disDestinations) {
+		return disDestinations[d]
+	}
+	return fmt.Sprintf("Destination(%d)", uint16(d))
+}
+
+// MDest is a mov destination. The values index disMDestinations.
+type MDest uint16
+
+const (
+	MDestPins MDest = iota
+	MDestX
+	MDestY
+	MDestPindirs
+	MDestExec
+	MDestPC
+	MDestISR
+	MDestOSR
+)
+
+// String returns the assembly syntax of a mov destination.
+func (d MDest) String() string {
+	if int(d) < len(disMDestinations) {
+		return disMDestinations[d]
+	}
+	return fmt.Sprintf("MDest(%d)", uint16(d))
+}
+
+// MSource is a mov source. The values index disMSources.
+type MSource uint16
+
+const (
+	MSrcPins   MSource = 0
+	MSrcX      MSource = 1
+	MSrcY      MSource = 2
+	MSrcNull   MSource = 3
+	MSrcStatus MSource = 5
+	MSrcISR    MSource = 6
+	MSrcOSR    MSource = 7
+)
+
+// String returns the assembly syntax of a mov source.
+func (s MSource) String() string {
+	if int(s) < len(disMSources) && disMSources[s] != "" {
+		return disMSources[s]
+	}
+	return fmt.Sprintf("MSource(%d)", uint16(s))
+}
+
+// EncodeSideSet returns the side-set field bits of an instruction
+// that sets the side-set pins to value, for the side-set settings of
+// s. The result is ORed with an instruction code. For an optional
+// side-set, this includes the bit that marks the side-set value as
+// present.
+func EncodeSideSet(value uint16, s Settings) (uint16, error) {
+	if s.SideSet == 0 {
+		return 0, errors.New("no side-set bits configured")
+	}
+	if limit := uint16(1) << s.SideSet; value >= limit {
+		return 0, fmt.Errorf("too large for side-set %d bits needed", s.SideSet)
+	}
+	if s.SideSetOpt {
+		return 0b1000000000000 | value<<(8+4-s.SideSet), nil
+	}
+	return value << (8 + 5 - s.SideSet), nil
+}
+
+// DecodeSideSet extracts the side-set value of instr, for the
+// side-set settings of s. The present value is false when s has no
+// side-set bits, or when an optional side-set value is omitted. An
+// error is returned for an omitted optional side-set value with
+// non-zero side-set bits.
+func DecodeSideSet(instr uint16, s Settings) (value uint16, present bool, err error) {
+	if s.SideSet == 0 {
+		return 0, false, nil
+	}
+	if s.SideSetOpt {
+		value = (instr & 0b0111100000000) >> (8 + 4 - s.SideSet)
+		present = instr&0b1000000000000 != 0
+		if !present && value != 0 {
+			err = fmt.Errorf("side-set bits %d without opt bit: %w", value, ErrBad)
+		}
+		return
+	}
+	return (instr & 0b1111100000000) >> (8 + 5 - s.SideSet), true, nil
+}
+
+// JMP builds a jmp instruction to the target offset when cond is
+// true.
+func JMP(cond Condition, target uint16) (uint16, error) {
+	if int(cond) >= len(disCondition) {
+		return 0, fmt.Errorf("invalid jmp condition %d: %w", cond, ErrBad)
+	}
+	if target > 31 {
+		return 0, fmt.Errorf("jmp target %d out of range: %w", target, ErrBad)
+	}
+	return instructions[idxJMP].bits | uint16(cond)<<5 | target, nil
+}
+
+// OUT builds an out instruction that shifts count (1..32) bits from
+// the OSR to dest. The exec destination requires a count of 16.
+func OUT(dest Destination, count uint16) (uint16, error) {
+	if int(dest) >= len(disDestinations) {
+		return 0, fmt.Errorf("invalid out destination %d: %w", dest, ErrBad)
+	}
+	if count == 0 || count > 32 {
+		return 0, fmt.Errorf("out bit count %d out of range: %w", count, ErrBad)
+	}
+	if dest == DestExec && count != 16 {
+		return 0, fmt.Errorf("out exec requires a bit count of 16, not %d: %w", count, ErrBad)
+	}
+	return instructions[idxOUT].bits | uint16(dest)<<5 | count&0b11111, nil
+}
+
+// SET builds a set instruction writing data (0..31) to dest. Only
+// the pins, x, y and pindirs destinations are valid.
+func SET(dest Destination, data uint16) (uint16, error) {
+	switch dest {
+	case DestPins, DestX, DestY, DestPindirs:
+	default:
+		return 0, fmt.Errorf("invalid set destination %v: %w", dest, ErrBad)
+	}
+	if data > 31 {
+		return 0, fmt.Errorf("set data %d out of range: %w", data, ErrBad)
+	}
+	return instructions[idxSET].bits | uint16(dest)<<5 | data, nil
+}
+
+// MOV builds a mov instruction that copies src to dest, applying op
+// to the value.
+func MOV(dest MDest, op MovOp, src MSource) (uint16, error) {
+	if int(dest) >= len(disMDestinations) {
+		return 0, fmt.Errorf("invalid mov destination %d: %w", dest, ErrBad)
+	}
+	if op > MovReverse {
+		return 0, fmt.Errorf("invalid mov operation %d: %w", op, ErrBad)
+	}
+	if int(src) >= len(disMSources) || disMSources[src] == "" {
+		return 0, fmt.Errorf("invalid mov source %d: %w", src, ErrBad)
+	}
+	return instructions[idxMOV2].bits | uint16(dest)<<5 | uint16(op)<<3 | uint16(src), nil
+}
@@ -0,0 +1,385 @@
+package pious
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DecodedInstruction holds the fields of a decoded PIO instruction.
+// Fields that do not apply to the instruction are left as zero
+// values.
+type DecodedInstruction struct {
+	// Mnemonic is the instruction token, such as "jmp".
+	Mnemonic string
+
+	// Operands holds the operands as formatted by Disassemble.
+	Operands string
+
+	// Condition is the jmp condition, empty for always.
+	Condition string
+
+	// Destination is the out, set or mov destination.
+	Destination string
+
+	// Source is the in or mov source, or the wait source.
+	Source string
+
+	// Polarity is the value a wait instruction waits for.
+	Polarity uint16
+
+	// Op is the operation a mov applies to its source.
+	Op MovOp
+
+	// Immediate is the numerical operand: the jmp target, the
+	// bit count of in or out, the set data, or the wait or irq
+	// index. Label is the name of the jmp target, if known.
+	Immediate uint16
+	Label     string
+
+	// IndexMode is the index mode of an irq or wait irq
+	// instruction: "absolute", "prev", "rel" or "next".
+	IndexMode string
+
+	// IfFull and IfEmpty are the conditions of push and pull,
+	// and Block indicates that they stall on a full or empty
+	// FIFO.
+	IfFull  bool
+	IfEmpty bool
+	Block   bool
+
+	// Clear and Wait are the modifiers of an irq instruction.
+	// An irq with both bits set clears the flag.
+	Clear bool
+	Wait  bool
+
+	// Delay is the instruction delay in cycles.
+	Delay uint16
+
+	// SideSet is the side-set value. HasSideSet indicates that
+	// the instruction has a side-set value.
+	SideSet    uint16
+	HasSideSet bool
+
+	// Flags holds the operand flags of the instruction type.
+	Flags Flags
+}
+
+// DisassembleStruct decodes a PIO instruction into its fields. The
+// optional p supplies the side-set settings and labels used to
+// decode the instruction. Disassemble formats these fields as text.
+func DisassembleStruct(instr uint16, p *Program) (DecodedInstruction, error) {
+	d, _, err := decodeStruct(instr, p)
+	return d, err
+}
+
+// decodeStruct decodes a PIO instruction, as DisassembleStruct. On
+// error, it also returns the text Disassemble reports for the
+// instruction.
+func decodeStruct(instr uint16, p *Program) (d DecodedInstruction, bad string, err error) {
+	cmd := decode(instr)
+	if cmd < 0 {
+		return d, fmt.Sprintf("unknown <%04x>", instr), ErrBad
+	}
+	dec := instructions[cmd]
+	d.Mnemonic, d.Flags = dec.token, dec.flags
+
+	field := (instr >> 5) & 0b111
+	switch cmd {
+	case idxJMP:
+		d.Condition = disCondition[field]
+		d.Immediate = instr & 0b11111
+		if p != nil {
+			if sym, ok := p.Targets[d.Immediate]; ok {
+				d.Label = sym[0]
+			}
+		}
+	case idxWAIT:
+		d.Polarity = field >> 2
+		d.Source = disBitSource[field&0b11]
+		d.Immediate = instr & 0b11111
+		switch field & 0b11 {
+		case 0b10:
+			d.Immediate = instr & 0b111
+			d.IndexMode = irqModes[(instr>>3)&0b11]
+		case 0b11:
+			if d.Immediate&0b11100 != 0 {
+				return d, fmt.Sprintf("unknown <%04x>", instr), ErrBad
+			}
+		}
+	case idxIN:
+		d.Source = disISources[field]
+		if d.Source == "" {
+			return d, fmt.Sprintf("unknown <%04x>", instr), ErrBad
+		}
+		d.Immediate = bitCount(instr)
+	case idxOUT:
+		d.Destination = disDestinations[field]
+		d.Immediate = bitCount(instr)
+		if field == 7 && d.Immediate != 16 {
+			// out exec is only assembled with a 16 bit count.
+			return d, fmt.Sprintf("invalid <%04x>", instr), ErrBad
+		}
+	case idxNOP:
+		// nop is encoded as mov y, y.
+		d.Destination, d.Source = "y", "y"
+	case idxPUSH:
+		d.IfFull, d.Block = instr&(1<<6) != 0, instr&(1<<5) != 0
+	case idxPULL:
+		d.IfEmpty, d.Block = instr&(1<<6) != 0, instr&(1<<5) != 0
+	case idxMOV1:
+		fifo := "rxfifo[y]"
+		if instr&(1<<3) != 0 {
+			fifo = fmt.Sprintf("rxfifo[%d]", instr&0b11)
+		} else if instr&0b111 != 0 {
+			return d, fmt.Sprintf("invalid <%04x>", instr), ErrBad
+		}
+		if instr&(1<<7) != 0 {
+			d.Destination, d.Source = "osr", fifo
+		} else {
+			d.Destination, d.Source = fifo, "isr"
+		}
+	case idxMOV2:
+		d.Destination = disMDestinations[field]
+		d.Op = MovOp((instr >> 3) & 0b11)
+		if d.Op > MovReverse || instr&0b111 == 0b100 {
+			return d, fmt.Sprintf("invalid <%04x>", instr), ErrBad
+		}
+		d.Source = disMSources[instr&0b111]
+	case idxIRQ:
+		d.Clear, d.Wait = instr&(1<<6) != 0, instr&(1<<5) != 0
+		d.Immediate = instr & 0b111
+		d.IndexMode = irqModes[(instr>>3)&0b11]
+	case idxSET:
+		if field == 0b011 || field >= 0b101 {
+			return d, "invalid destination", ErrBad
+		}
+		d.Destination = disDestinations[field]
+		d.Immediate = instr & 0b11111
+	}
+
+	var s Settings
+	if p != nil {
+		s = p.Attr
+	}
+	if _, _, err := DecodeSideSet(instr, s); err != nil {
+		return d, fmt.Sprintf("invalid opt side-set <%04x>", instr), err
+	}
+	d.SideSet, d.HasSideSet, d.Delay = sideDelay(instr, s)
+	d.Operands = d.operands()
+	return d, "", nil
+}
+
+// operands formats the operands of a decoded instruction.
+func (d DecodedInstruction) operands() string {
+	switch {
+	case d.Flags&flagCondition != 0:
+		target := d.Label
+		if target == "" {
+			target = fmt.Sprint(d.Immediate)
+		}
+		if d.Condition != "" {
+			return fmt.Sprint(d.Condition, " ", target)
+		}
+		return target
+	case d.Flags&flagPolSource != 0:
+		switch d.Source {
+		case "irq":
+			return fmt.Sprint(d.Polarity, " irq ", irqIndex(d.IndexMode, "", d.Immediate))
+		case "jmppin":
+			if d.Immediate != 0 {
+				return fmt.Sprint(d.Polarity, " jmppin + ", d.Immediate)
+			}
+			return fmt.Sprint(d.Polarity, " jmppin")
+		}
+		return fmt.Sprint(d.Polarity, " ", d.Source, " ", d.Immediate)
+	case d.Flags&flagBlk != 0:
+		block := "noblock"
+		if d.Block {
+			block = "block"
+		}
+		switch {
+		case d.IfFull:
+			return "iffull " + block
+		case d.IfEmpty:
+			return "ifempty " + block
+		}
+		return block
+	case d.Flags&flagClrWaitIdxModeIndex != 0:
+		modifier := ""
+		if d.Clear {
+			modifier = "clear "
+		} else if d.Wait {
+			modifier = "wait "
+		}
+		return irqIndex(d.IndexMode, modifier, d.Immediate)
+	case d.Flags&flagISource != 0:
+		return fmt.Sprint(d.Source, ", ", d.Immediate)
+	case d.Flags&flagDestination != 0:
+		return fmt.Sprint(d.Destination, ", ", d.Immediate)
+	case d.Flags&(flagMDestination|flagFromXIdxlIndex) != 0:
+		return fmt.Sprint(d.Destination, ", ", d.Op, d.Source)
+	}
+	return ""
+}
+
+// irqIndex formats the index of an irq or wait irq instruction in
+// its index mode. The modifier, such as "clear ", precedes the
+// index.
+func irqIndex(mode, modifier string, index uint16) string {
+	switch mode {
+	case "prev", "next":
+		return fmt.Sprint(mode, " ", modifier, index)
+	case "rel":
+		return fmt.Sprint(modifier, index, " rel")
+	}
+	return fmt.Sprint(modifier, index)
+}
+
+// bitCount decodes the bit count of an in or out instruction, where
+// 0 encodes 32.
+func bitCount(instr uint16) uint16 {
+	if n := instr & 0b11111; n != 0 {
+		return n
+	}
+	return 32
+}
+
+// irqModes names the index modes of the irq and wait irq
+// instructions.
+var irqModes = []string{"absolute", "prev", "rel", "next"}
+
+// movOpNames names the operations of the mov instruction.
+var movOpNames = []string{"none", "invert", "bit-reverse", "reserved"}
+
+// ExplainInstruction returns a breakdown of the bit fields of a PIO
+// instruction, one line per field, such as "bits 15-13: 011 (out)".
+// The optional p supplies the side-set settings and labels used to
+// interpret the instruction. The bit groups of an unrecognized
+// instruction are still listed.
+func ExplainInstruction(instr uint16, p *Program) string {
+	var lines []string
+	field := func(hi, lo uint, format string, args ...interface{}) {
+		v := (instr >> lo) & (uint16(1)<<(hi-lo+1) - 1)
+		bits := fmt.Sprintf("bits %d-%d: %0*b", hi, lo, int(hi-lo+1), v)
+		if hi == lo {
+			bits = fmt.Sprintf("bit %d: %b", hi, v)
+		}
+		lines = append(lines, fmt.Sprintf("%s (%s)", bits, fmt.Sprintf(format, args...)))
+	}
+
+	cmd := decode(instr)
+	token := "unknown"
+	if cmd >= 0 {
+		token = instructions[cmd].token
+	}
+	field(15, 13, "%s", token)
+
+	var s Settings
+	if p != nil {
+		s = p.Attr
+	}
+	side, present, _ := DecodeSideSet(instr, s)
+	hi := uint(12)
+	if s.SideSetOpt {
+		field(hi, hi, "side-set enable")
+		hi--
+	}
+	if n := uint(s.SideSet); n != 0 {
+		if present {
+			field(hi, hi-n+1, "side-set %d", side)
+		} else {
+			field(hi, hi-n+1, "side-set, unused")
+		}
+		hi -= n
+	}
+	if hi >= 8 {
+		_, _, delay := sideDelay(instr, s)
+		field(hi, 8, "delay %d", delay)
+	}
+
+	if cmd < 0 {
+		field(7, 0, "unknown operands")
+		return strings.Join(lines, "\n")
+	}
+	dec := instructions[cmd]
+	index := instr & 0b11111
+	switch {
+	case dec.flags&flagCondition != 0:
+		cond := disCondition[(instr>>5)&0b111]
+		if cond == "" {
+			cond = "always"
+		}
+		field(7, 5, "condition %s", cond)
+		if p != nil && len(p.Targets[index]) != 0 {
+			field(4, 0, "address %d, %s", index, p.Targets[index][0])
+		} else {
+			field(4, 0, "address %d", index)
+		}
+	case dec.flags&flagPolSource != 0:
+		field(7, 7, "polarity %d", instr>>7&1)
+		src := (instr >> 5) & 0b11
+		field(6, 5, "source %s", disBitSource[src])
+		if src == 0b10 {
+			field(4, 3, "index mode %s", irqModes[(instr>>3)&0b11])
+			field(2, 0, "index %d", instr&0b111)
+		} else {
+			field(4, 0, "index %d", index)
+		}
+	case dec.flags&flagISource != 0:
+		if src := disISources[(instr>>5)&0b111]; src != "" {
+			field(7, 5, "source %s", src)
+		} else {
+			field(7, 5, "reserved source")
+		}
+		field(4, 0, "bit count %d", bitCount(instr))
+	case dec.flags&flagDestination != 0:
+		field(7, 5, "destination %s", disDestinations[(instr>>5)&0b111])
+		if cmd == idxOUT {
+			field(4, 0, "bit count %d", bitCount(instr))
+		} else {
+			field(4, 0, "data %d", index)
+		}
+	case dec.flags&(flagIfF|flagIfE) != 0:
+		field(7, 7, "%s", dec.token)
+		if dec.flags&flagIfF != 0 {
+			field(6, 6, "iffull")
+		} else {
+			field(6, 6, "ifempty")
+		}
+		field(5, 5, "block")
+		field(4, 0, "reserved")
+	case dec.flags&flagFromXIdxlIndex != 0:
+		if instr&(1<<7) != 0 {
+			field(7, 7, "from rxfifo to osr")
+		} else {
+			field(7, 7, "to rxfifo from isr")
+		}
+		field(6, 4, "mov rxfifo")
+		if instr&(1<<3) != 0 {
+			field(3, 3, "indexed by immediate")
+			field(2, 2, "reserved")
+			field(1, 0, "index %d", instr&0b11)
+		} else {
+			field(3, 3, "indexed by y")
+			field(2, 0, "reserved")
+		}
+	case dec.flags&flagMDestination != 0:
+		field(7, 5, "destination %s", disMDestinations[(instr>>5)&0b111])
+		field(4, 3, "operation %s", movOpNames[(instr>>3)&0b11])
+		if src := disMSources[instr&0b111]; src != "" {
+			field(2, 0, "source %s", src)
+		} else {
+			field(2, 0, "reserved source")
+		}
+	case dec.flags&flagClrWaitIdxModeIndex != 0:
+		field(7, 7, "reserved")
+		field(6, 6, "clear")
+		field(5, 5, "wait")
+		field(4, 3, "index mode %s", irqModes[(instr>>3)&0b11])
+		field(2, 0, "index %d", instr&0b111)
+	default:
+		// nop is encoded as mov y, y.
+		field(7, 0, "mov y, y")
+	}
+	return strings.Join(lines, "\n")
+}
@@ -2,6 +2,9 @@ package pious
 
 import (
 	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
 )
 
 type Flags uint
@@ -50,7 +53,7 @@ var instructions = []Instruction{
 	{token: "wait", mask: 0xe000, bits: 0x2000, flags: flagPolSource | flagWIndex},
 	{token: "in", mask: 0xe000, bits: 0x4000, flags: flagISource | flagBitCount},
 	{token: "out", mask: 0xe000, bits: 0x6000, flags: flagDestination | flagBitCount},
-	{token: "nop", mask: 0xe0ff, bits: 0x8042, flags: 0},
+	{token: "nop", mask: 0xe0ff, bits: 0xa042, flags: 0},
 	{token: "push", mask: 0xe09f, bits: 0x8000, flags: flagIfF | flagBlk},
 	{token: "mov", mask: 0xe074, bits: 0x8010, flags: flagFromXIdxlIndex},
 	{token: "pull", mask: 0xe09f, bits: 0x8080, flags: flagIfE | flagBlk},
@@ -119,6 +122,9 @@ var disMSources = []string{
 	"osr",
 }
 
+// disBitSource holds the wait sources. A gpio index is an absolute
+// GPIO number, but a pin index is relative to the input pin base of
+// the state machine, and a jmppin offset is relative to its jmp pin.
 var disBitSource = []string{
 	"gpio",
 	"pin",
@@ -126,9 +132,227 @@ var disBitSource = []string{
 	"jmppin",
 }
 
+// decoders holds, for each 3-bit opcode (bits 15-13), the indices of
+// the instructions entries with that opcode, in table order. An
+// instruction decodes as the first of these entries to match it.
+var decoders [8][]int
+
+// mnemonics maps an instruction token to the indices of its
+// instructions entries. The "mov" token has two entries and the
+// assembler tries them in table order: the rxfifo form (idxMOV1)
+// before the general form (idxMOV2).
+var mnemonics = make(map[string][]int)
+
+// Reverse lookups for the disassembly tables.
+var (
+	conditionIndex    = indexOf(disCondition)
+	destinationIndex  = indexOf(disDestinations)
+	mDestinationIndex = indexOf(disMDestinations)
+	iSourceIndex      = indexOf(disISources)
+	mSourceIndex      = indexOf(disMSources)
+	bitSourceIndex    = indexOf(disBitSource)
+)
+
+// indexOf builds a reverse lookup for a table of tokens. Unused ("")
+// table entries are omitted.
+func indexOf(table []string) map[string]int {
+	index := make(map[string]int)
+	for i, token := range table {
+		if token != "" {
+			index[token] = i
+		}
+	}
+	return index
+}
+
+func init() {
+	for i, dec := range instructions {
+		op := dec.bits >> 13
+		decoders[op] = append(decoders[op], i)
+		mnemonics[dec.token] = append(mnemonics[dec.token], i)
+	}
+}
+
+// decode returns the index of the instructions entry for instr, or
+// -1 if instr is not recognized.
+func decode(instr uint16) int {
+	for _, i := range decoders[instr>>13] {
+		if dec := instructions[i]; dec.mask&instr == dec.bits {
+			return i
+		}
+	}
+	return -1
+}
+
 var (
 	ErrBad   = errors.New("invalid instruction")
 	ErrEmpty = errors.New("empty instruction")
+
+	// ErrDirective is returned by Assemble for a line that holds
+	// a directive or a label declaration instead of an
+	// instruction.
+	ErrDirective = errors.New("not an instruction")
+
+	// ErrNonASCII indicates a character outside the ASCII range
+	// in the code of a line, such as a non-breaking space or a
+	// smart quote copied from a PDF. Comments may contain such
+	// characters.
+	ErrNonASCII = errors.New("non-ASCII character")
+
+	// ErrStrict indicates code that is accepted by default, but
+	// is rejected with the StrictSyntax option because the
+	// official pioasm tool does not accept it.
+	ErrStrict = errors.New("not pioasm syntax")
+
+	// ErrTarget indicates code that the Target chip of a program
+	// does not support.
+	ErrTarget = errors.New("unsupported by target")
+)
+
+// ParseError holds the location details of a failure to parse some
+// PIO source. Use errors.As() to extract one from an error returned
+// by NewProgram.
+type ParseError struct {
+	// File names the source of the failing line. It is empty
+	// unless the source was read with NewProgramFromReader or
+	// ParseReader.
+	File string
+
+	// Line is the source line number, counting from 1. It is 0
+	// when the line is not known, as is the case for errors
+	// returned by Assemble.
+	Line int
+
+	// Column is the byte offset, counting from 1, of the token
+	// that failed to parse. It is 0 when no specific token is
+	// known to be at fault.
+	Column int
+
+	// RawLine holds the unprocessed text of the failing line.
+	RawLine string
+
+	// Err is the underlying error.
+	Err error
+}
+
+// Error formats a ParseError. An unknown Line is omitted, leaving
+// any Column as "column N".
+func (e *ParseError) Error() string {
+	var pos []string
+	if e.File != "" {
+		pos = append(pos, e.File)
+	}
+	switch {
+	case e.Line != 0 && e.Column != 0:
+		pos = append(pos, fmt.Sprint("line ", e.Line, ":", e.Column))
+	case e.Line != 0:
+		pos = append(pos, fmt.Sprint("line ", e.Line))
+	case e.Column != 0:
+		pos = append(pos, fmt.Sprint("column ", e.Column))
+	}
+	pos = append(pos, fmt.Sprint(e.Err), fmt.Sprintf("%q", e.RawLine))
+	return strings.Join(pos, ": ")
+}
+
+// Unwrap exposes the underlying error of a ParseError.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// MovOp is the operation a mov instruction applies to its source
+// value. It is encoded in bits 4-3 of the instruction.
+type MovOp uint16
+
+const (
+	// MovNone passes the source value through unchanged.
+	MovNone MovOp = iota
+
+	// MovInvert bitwise inverts the source value. Its syntax is
+	// a "!" prefix to the source.
+	MovInvert
+
+	// MovReverse bit reverses the source value. Its syntax is a
+	// "::" prefix to the source.
+	MovReverse
+)
+
+// String returns the source prefix syntax of a mov operation.
+func (op MovOp) String() string {
+	switch op {
+	case MovInvert:
+		return "!"
+	case MovReverse:
+		return "::"
+	}
+	return ""
+}
+
+// Apply applies the mov operation to a 32-bit value.
+func (op MovOp) Apply(v uint32) uint32 {
+	switch op {
+	case MovInvert:
+		return ^v
+	case MovReverse:
+		return bits.Reverse32(v)
+	}
+	return v
+}
+
+// MovStatus selects the condition that the "status" source of a mov
+// instruction reflects. The status value is all-ones when the
+// condition is true, and all-zeros otherwise.
+type MovStatus uint16
+
+const (
+	// StatusTxLess is true when the TX FIFO level is less than N.
+	StatusTxLess MovStatus = iota
+
+	// StatusRxLess is true when the RX FIFO level is less than N.
+	StatusRxLess
+
+	// StatusIRQ is true when PIO irq flag N is set. This is only
+	// supported on the RP2350.
+	StatusIRQ
+)
+
+// FifoMode selects how the TX and RX FIFOs of a state machine are
+// joined, as configured by the .fifo directive.
+type FifoMode uint16
+
+const (
+	// FifoTxRx keeps separate TX and RX FIFOs. This is the
+	// default.
+	FifoTxRx FifoMode = iota
+
+	// FifoTx joins the FIFOs into a double depth TX FIFO.
+	FifoTx
+
+	// FifoRx joins the FIFOs into a double depth RX FIFO.
+	FifoRx
+
+	// FifoTxPut, FifoTxGet and FifoPutGet repurpose the RX FIFO
+	// as storage registers for the rxfifo forms of mov. These
+	// are only supported on the RP2350.
+	FifoTxPut
+	FifoTxGet
+	FifoPutGet
+)
+
+// disFifoModes holds the .fifo directive syntax of each FifoMode.
+var disFifoModes = []string{"txrx", "tx", "rx", "txput", "txget", "putget"}
+
+// Target selects the chip that a program is assembled for.
+type Target uint16
+
+const (
+	// TargetRP2350 accepts the full RP2350 instruction set, as
+	// permitted by the PioVersion of a program. This is the
+	// default.
+	TargetRP2350 Target = iota
+
+	// TargetRP2040 rejects the instructions that were added by
+	// the RP2350.
+	TargetRP2040
 )
 
 // Settings holds all of the details to configure the code in a Program.
@@ -136,13 +360,30 @@ type Settings struct {
 	// Name names the PIO program
 	Name string
 
+	// PioVersion is the PIO hardware version the program targets:
+	// 0 for the RP2040 and 1 for the RP2350.
+	PioVersion uint16
+
+	// Target is the chip the program is assembled for. With
+	// TargetRP2040, Assemble rejects RP2350 only instructions
+	// whatever the PioVersion.
+	Target Target
+
 	// Origin identifies the starting PC of the PIO program.
 	Origin uint16
 
 	// Wrap indicates where to wrap the PC value, and WrapTarget
-	// is the value it is wrapped to.
+	// is the value it is wrapped to. A Wrap value of one past the
+	// last instruction means the program has no .wrap directive,
+	// and wraps after its last instruction. See SetWrap.
 	Wrap, WrapTarget uint16
 
+	// Length holds the number of instructions in a sub-program.
+	// This is only filled in for the Modules of a combined
+	// Program, where sub-programs are stored contiguously in
+	// Modules order.
+	Length uint16
+
 	// SideSet indicates how many delay bits of the code syntax
 	// are reserved for side-set pin value setting.
 	SideSet uint16
@@ -204,6 +445,39 @@ type Settings struct {
 	// ISR to the rxfifo. The default value (0) is interpreted
 	// as 32-bits.
 	InThreshold uint16
+
+	// FifoMode selects how the state machine FIFOs are joined.
+	FifoMode FifoMode
+
+	// ClockDiv is the intended state machine clock divider, as
+	// set by the pious specific .clock_div directive. The value 0
+	// leaves the divider unconfigured.
+	ClockDiv float64
+
+	// JmpPin is the GPIO tested by the jmp pin condition, as set
+	// by the pious specific .jmp_pin directive. HasJmpPin
+	// indicates that the directive was used.
+	JmpPin    uint16
+	HasJmpPin bool
+
+	// MovStatusSel and MovStatusN configure the condition that
+	// the status source of the mov instruction reflects. The
+	// default is a TX FIFO level less than 0, which is never
+	// true.
+	MovStatusSel MovStatus
+	MovStatusN   uint16
+
+	// LangOpts holds the .lang_opt directive values. These are
+	// indexed by language and then option name. They are not
+	// needed to assemble the program, but are retained for code
+	// generation.
+	LangOpts map[string]map[string]string
+
+	// CodeBlocks holds the lines of the "% lang {" ... "%}" code
+	// blocks of the program source, indexed by language. The
+	// "c-sdk" blocks are copied into the output of MakeCHeader,
+	// and the "go" blocks into that of MakePackage.
+	CodeBlocks map[string][]string
 }
 
 // Program holds a binary representation of a PIO program.
@@ -216,6 +490,15 @@ type Program struct {
 	// Labels holds the jump label to offset mapping.
 	Labels map[string]uint16
 
+	// Public holds the names of Labels declared public. Code
+	// generators export the offsets of these labels.
+	Public map[string]bool
+
+	// Defines holds the named constants declared with the .define
+	// directive. These can be used in place of numerical operand
+	// values.
+	Defines map[string]uint16
+
 	// Targets holds the reverse of the jump table, with values
 	// sorted lexicographically.
 	Targets map[uint16][]string
@@ -228,4 +511,32 @@ type Program struct {
 	// code sequence. This is typically filled in by the
 	// (*Program).Cat() method.
 	Modules []Settings
+
+	// Comments holds the source comment lines that precede each
+	// instruction offset, with blank lines held as empty
+	// strings. Those following the last instruction are held at
+	// offset len(Code). InlineComments holds the comment trailing
+	// each instruction on its source line. These are only filled
+	// in when requested with NewProgramOptions.
+	Comments       map[uint16][]string
+	InlineComments map[uint16]string
+
+	// lines holds the source line number of each instruction, and
+	// sideSetLine that of the .side_set directive. These are only
+	// known for programs compiled from source.
+	lines       []int
+	sideSetLine int
+
+	// base is the instruction memory offset the program was moved
+	// to by Relocate.
+	base uint16
+
+	// pc is the offset of the instruction being assembled. It
+	// resolves relative jmp targets.
+	pc uint16
+
+	// pending holds the source of each instruction added with
+	// Append that refers to a label not yet defined. Finalize
+	// assembles these.
+	pending map[uint16]string
 }
@@ -0,0 +1,78 @@
+package pious
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Diff compares two programs and returns one human readable line per
+// difference found, or nil if they are equivalent. Differences in
+// the Attr settings are reported first, then the instructions,
+// aligned by offset and described by their disassembly, and lastly
+// the labels. Lines for instructions and labels only present in a
+// are prefixed with "-", those only present in b with "+", and those
+// that changed with "~".
+func Diff(a, b *Program) []string {
+	var lines []string
+	sa, sb := reflect.ValueOf(a.Attr), reflect.ValueOf(b.Attr)
+	for i := 0; i < sa.NumField(); i++ {
+		va, vb := fmt.Sprint(sa.Field(i).Interface()), fmt.Sprint(sb.Field(i).Interface())
+		if va != vb {
+			lines = append(lines, fmt.Sprintf("~%s: %s -> %s", sa.Type().Field(i).Name, va, vb))
+		}
+	}
+
+	text := func(p *Program, i int) string {
+		s, err := Disassemble(p.Code[i], p.moduleAt(uint16(i)))
+		if err != nil {
+			s = fmt.Sprintf("word 0x%04x", p.Code[i])
+		}
+		return strings.Join(strings.Fields(s), " ")
+	}
+	for i := 0; i < len(a.Code) || i < len(b.Code); i++ {
+		switch {
+		case i >= len(b.Code):
+			lines = append(lines, fmt.Sprintf("-%02x: %s", i, text(a, i)))
+		case i >= len(a.Code):
+			lines = append(lines, fmt.Sprintf("+%02x: %s", i, text(b, i)))
+		case a.Code[i] != b.Code[i]:
+			lines = append(lines, fmt.Sprintf("~%02x: %s -> %s", i, text(a, i), text(b, i)))
+		default:
+			// The same encoding can disassemble
+			// differently with different side-set
+			// settings. Labels are ignored here, so a
+			// renamed label is only reported once.
+			ta, _ := Disassemble(a.Code[i], &Program{Attr: a.moduleAt(uint16(i)).Attr})
+			tb, _ := Disassemble(b.Code[i], &Program{Attr: b.moduleAt(uint16(i)).Attr})
+			if ta != tb {
+				lines = append(lines, fmt.Sprintf("~%02x: %s -> %s", i, text(a, i), text(b, i)))
+			}
+		}
+	}
+
+	var names []string
+	for name := range a.Labels {
+		names = append(names, name)
+	}
+	for name := range b.Labels {
+		if _, ok := a.Labels[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		oa, inA := a.Labels[name]
+		ob, inB := b.Labels[name]
+		switch {
+		case !inB:
+			lines = append(lines, fmt.Sprintf("-label %s: %d", name, oa))
+		case !inA:
+			lines = append(lines, fmt.Sprintf("+label %s: %d", name, ob))
+		case oa != ob:
+			lines = append(lines, fmt.Sprintf("~label %s: %d -> %d", name, oa, ob))
+		}
+	}
+	return lines
+}
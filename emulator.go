@@ -0,0 +1,472 @@
+package pious
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// FIFODepth is the number of entries in each of the TX and RX FIFOs
+// of an (unjoined) state machine.
+const FIFODepth = 4
+
+// WaitState indicates whether or not an Emulator Step() advanced
+// the execution of the program.
+type WaitState int
+
+const (
+	// Running indicates that an instruction was executed.
+	Running WaitState = iota
+
+	// Delayed indicates a cycle was consumed by the delay of a
+	// previously executed instruction.
+	Delayed
+
+	// Waiting indicates that a wait instruction condition was
+	// not satisfied.
+	Waiting
+
+	// StalledPull indicates an out or pull instruction is waiting
+	// for data in the TX FIFO.
+	StalledPull
+
+	// StalledPush indicates an in or push instruction is waiting
+	// for space in the RX FIFO.
+	StalledPush
+
+	// StalledIRQ indicates an irq wait instruction is waiting for
+	// its flag to be cleared.
+	StalledIRQ
+)
+
+// ErrUnsupported indicates an instruction the Emulator cannot execute.
+var ErrUnsupported = errors.New("unsupported by emulator")
+
+// Registers holds the internal register state of an emulated state
+// machine.
+type Registers struct {
+	// PC is the offset of the next instruction in the Code.
+	PC uint16
+
+	// X and Y are the scratch registers.
+	X, Y uint32
+
+	// ISR and OSR are the input and output shift registers.
+	ISR, OSR uint32
+
+	// ISRCount and OSRCount are the shift counters of the ISR and
+	// OSR respectively.
+	ISRCount, OSRCount uint16
+}
+
+// Emulator executes the code of a Program one cycle at a time. It
+// approximates the behavior of a single RP2350 state machine.
+type Emulator struct {
+	Registers
+
+	// Attr holds the settings that configure the state machine.
+	Attr Settings
+
+	// Code holds the instructions being executed.
+	Code []uint16
+
+	// InBase, OutBase, SetBase and SideSetBase are the GPIO bases
+	// of the respective pin groups. JmpPin is the GPIO tested by
+	// the jmp pin condition.
+	InBase, OutBase, SetBase, SideSetBase, JmpPin uint
+
+	// Pins and PinDirs hold the output values and directions
+	// driven by the state machine.
+	Pins, PinDirs uint32
+
+	// TxFIFO holds words written by the processor. RxFIFO holds
+	// words pushed by the state machine.
+	TxFIFO, RxFIFO []uint32
+
+	// IRQ holds the 8 PIO block irq flags.
+	IRQ uint8
+
+	// delay is the number of remaining delay cycles.
+	delay uint16
+
+	// irqWait is true while an "irq wait" is pending.
+	irqWait bool
+}
+
+// NewEmulator prepares an Emulator for the program p. Execution
+// starts at the p.Attr.Origin offset with an empty OSR. For a
+// combined program, the Emulator uses the settings of the module
+// holding that offset.
+func NewEmulator(p *Program) *Emulator {
+	attr := p.Attr
+	var start uint16
+	for j, m := range p.Modules {
+		if end := start + m.Length; p.Attr.Origin >= start && p.Attr.Origin < end {
+			attr = m
+			attr.Wrap = p.lastWraps()[j]
+			break
+		}
+		start += m.Length
+	}
+	e := &Emulator{
+		Attr: attr,
+		Code: p.Code,
+	}
+	e.PC = p.Attr.Origin
+	e.OSRCount = 32
+	return e
+}
+
+// Snapshot returns a copy of the current register state.
+func (e *Emulator) Snapshot() Registers {
+	return e.Registers
+}
+
+// Put writes a word into the TX FIFO. It returns false if the FIFO is
+// full.
+func (e *Emulator) Put(v uint32) bool {
+	if len(e.TxFIFO) >= FIFODepth {
+		return false
+	}
+	e.TxFIFO = append(e.TxFIFO, v)
+	return true
+}
+
+// Get reads a word from the RX FIFO. It returns false if the FIFO is
+// empty.
+func (e *Emulator) Get() (uint32, bool) {
+	if len(e.RxFIFO) == 0 {
+		return 0, false
+	}
+	v := e.RxFIFO[0]
+	e.RxFIFO = e.RxFIFO[1:]
+	return v, true
+}
+
+// threshold converts a configured threshold to a bit count.
+func threshold(n uint16) uint16 {
+	if n == 0 {
+		return 32
+	}
+	return n
+}
+
+// writePins sets n bits of *pins, starting at GPIO base, from data.
+func writePins(pins *uint32, base uint, n uint16, data uint32) {
+	for i := uint(0); i < uint(n); i++ {
+		bit := uint32(1) << ((base + i) % 32)
+		if data&(1<<i) != 0 {
+			*pins |= bit
+		} else {
+			*pins &^= bit
+		}
+	}
+}
+
+// sideDelay decodes the side-set and delay fields of instr.
+func sideDelay(instr uint16, s Settings) (side uint16, hasSide bool, delay uint16) {
+	side, hasSide, _ = DecodeSideSet(instr, s)
+	width := 5 - s.SideSet
+	if s.SideSetOpt {
+		width--
+	}
+	delay = (instr >> 8) & (uint16(1)<<width - 1)
+	return
+}
+
+// advance moves the PC to the next instruction, honoring the wrap
+// settings.
+func (e *Emulator) advance() {
+	if e.PC == e.Attr.Wrap || int(e.PC)+1 >= len(e.Code) {
+		e.PC = e.Attr.WrapTarget
+		return
+	}
+	e.PC++
+}
+
+// Step executes a single cycle of the state machine. The gpio value
+// holds the current input state of all 32 GPIOs.
+func (e *Emulator) Step(gpio uint32) (WaitState, error) {
+	if e.delay != 0 {
+		e.delay--
+		return Delayed, nil
+	}
+	if int(e.PC) >= len(e.Code) {
+		return Running, fmt.Errorf("pc=%d beyond code length %d", e.PC, len(e.Code))
+	}
+	instr := e.Code[e.PC]
+	side, hasSide, delay := sideDelay(instr, e.Attr)
+	if hasSide {
+		if e.Attr.SideSetPindirs {
+			writePins(&e.PinDirs, e.SideSetBase, e.Attr.SideSet, uint32(side))
+		} else {
+			writePins(&e.Pins, e.SideSetBase, e.Attr.SideSet, uint32(side))
+		}
+	}
+	state, jumped, err := e.execute(instr, gpio)
+	if err != nil || state != Running {
+		return state, err
+	}
+	if !jumped {
+		e.advance()
+	}
+	e.delay = delay
+	return Running, nil
+}
+
+// execute performs the operation of instr. It returns true if the
+// PC was explicitly set by the instruction.
+func (e *Emulator) execute(instr uint16, gpio uint32) (WaitState, bool, error) {
+	switch decode(instr) {
+	case idxJMP:
+		x, y := e.X, e.Y
+		var ok bool
+		switch (instr >> 5) & 0b111 {
+		case 0b000:
+			ok = true
+		case 0b001:
+			ok = x == 0
+		case 0b010:
+			ok = x != 0
+			e.X--
+		case 0b011:
+			ok = y == 0
+		case 0b100:
+			ok = y != 0
+			e.Y--
+		case 0b101:
+			ok = x != y
+		case 0b110:
+			ok = gpio&(1<<(e.JmpPin%32)) != 0
+		case 0b111:
+			ok = e.OSRCount < threshold(e.Attr.OutThreshold)
+		}
+		if ok {
+			e.PC = instr & 0b11111
+		}
+		return Running, ok, nil
+	case idxWAIT:
+		pol := (instr>>7)&1 != 0
+		index := uint(instr & 0b11111)
+		var level bool
+		switch (instr >> 5) & 0b11 {
+		case 0b00:
+			level = gpio&(1<<index) != 0
+		case 0b01:
+			level = gpio&(1<<((e.InBase+index)%32)) != 0
+		case 0b10:
+			flag := uint8(1) << (index & 0b111)
+			level = e.IRQ&flag != 0
+			if pol && level {
+				e.IRQ &^= flag
+			}
+		case 0b11:
+			level = gpio&(1<<((e.JmpPin+index)%32)) != 0
+		}
+		if level != pol {
+			return Waiting, false, nil
+		}
+		return Running, false, nil
+	case idxIN:
+		n := threshold(instr & 0b11111)
+		var data uint32
+		switch (instr >> 5) & 0b111 {
+		case 0b000:
+			data = bits.RotateLeft32(gpio, -int(e.InBase))
+		case 0b001:
+			data = e.X
+		case 0b010:
+			data = e.Y
+		case 0b011:
+		case 0b110:
+			data = e.ISR
+		case 0b111:
+			data = e.OSR
+		default:
+			return Running, false, ErrBad
+		}
+		if n < 32 {
+			data &= uint32(1)<<n - 1
+		}
+		push := e.Attr.InAuto && e.ISRCount+n >= threshold(e.Attr.InThreshold)
+		if push && len(e.RxFIFO) >= FIFODepth {
+			return StalledPush, false, nil
+		}
+		if n == 32 {
+			e.ISR = data
+		} else if e.Attr.InLeft {
+			e.ISR = e.ISR<<n | data
+		} else {
+			e.ISR = e.ISR>>n | data<<(32-n)
+		}
+		e.ISRCount += n
+		if e.ISRCount > 32 {
+			e.ISRCount = 32
+		}
+		if push {
+			e.RxFIFO = append(e.RxFIFO, e.ISR)
+			e.ISR, e.ISRCount = 0, 0
+		}
+		return Running, false, nil
+	case idxOUT:
+		if e.Attr.OutAuto && e.OSRCount >= threshold(e.Attr.OutThreshold) {
+			if len(e.TxFIFO) == 0 {
+				return StalledPull, false, nil
+			}
+			e.OSR, e.TxFIFO = e.TxFIFO[0], e.TxFIFO[1:]
+			e.OSRCount = 0
+		}
+		n := threshold(instr & 0b11111)
+		var data uint32
+		if n == 32 {
+			data, e.OSR = e.OSR, 0
+		} else if e.Attr.OutLeft {
+			data = e.OSR >> (32 - n)
+			e.OSR <<= n
+		} else {
+			data = e.OSR & (uint32(1)<<n - 1)
+			e.OSR >>= n
+		}
+		e.OSRCount += n
+		if e.OSRCount > 32 {
+			e.OSRCount = 32
+		}
+		switch (instr >> 5) & 0b111 {
+		case 0b000:
+			writePins(&e.Pins, e.OutBase, n, data)
+		case 0b001:
+			e.X = data
+		case 0b010:
+			e.Y = data
+		case 0b011:
+		case 0b100:
+			writePins(&e.PinDirs, e.OutBase, n, data)
+		case 0b101:
+			e.PC = uint16(data & 0b11111)
+			return Running, true, nil
+		case 0b110:
+			e.ISR, e.ISRCount = data, n
+		case 0b111:
+			return e.execute(uint16(data), gpio)
+		}
+		return Running, false, nil
+	case idxNOP:
+		return Running, false, nil
+	case idxPUSH:
+		if instr&0b1000000 != 0 && e.ISRCount < threshold(e.Attr.InThreshold) {
+			return Running, false, nil
+		}
+		if len(e.RxFIFO) >= FIFODepth {
+			if instr&0b100000 != 0 {
+				return StalledPush, false, nil
+			}
+		} else {
+			e.RxFIFO = append(e.RxFIFO, e.ISR)
+		}
+		e.ISR, e.ISRCount = 0, 0
+		return Running, false, nil
+	case idxPULL:
+		if instr&0b1000000 != 0 && e.OSRCount < threshold(e.Attr.OutThreshold) {
+			return Running, false, nil
+		}
+		if len(e.TxFIFO) == 0 {
+			if instr&0b100000 != 0 {
+				return StalledPull, false, nil
+			}
+			e.OSR = e.X
+		} else {
+			e.OSR, e.TxFIFO = e.TxFIFO[0], e.TxFIFO[1:]
+		}
+		e.OSRCount = 0
+		return Running, false, nil
+	case idxMOV2:
+		var data uint32
+		switch instr & 0b111 {
+		case 0b000:
+			data = bits.RotateLeft32(gpio, -int(e.InBase))
+		case 0b001:
+			data = e.X
+		case 0b010:
+			data = e.Y
+		case 0b011:
+		case 0b101:
+			n := int(e.Attr.MovStatusN)
+			var status bool
+			switch e.Attr.MovStatusSel {
+			case StatusTxLess:
+				status = len(e.TxFIFO) < n
+			case StatusRxLess:
+				status = len(e.RxFIFO) < n
+			case StatusIRQ:
+				status = e.IRQ&(1<<(n&0b111)) != 0
+			}
+			if status {
+				data = 0xffffffff
+			}
+		case 0b110:
+			data = e.ISR
+		case 0b111:
+			data = e.OSR
+		default:
+			return Running, false, ErrBad
+		}
+		data = MovOp((instr >> 3) & 0b11).Apply(data)
+		switch (instr >> 5) & 0b111 {
+		case 0b000:
+			writePins(&e.Pins, e.OutBase, e.Attr.Out, data)
+		case 0b001:
+			e.X = data
+		case 0b010:
+			e.Y = data
+		case 0b011:
+			writePins(&e.PinDirs, e.OutBase, e.Attr.Out, data)
+		case 0b100:
+			return e.execute(uint16(data), gpio)
+		case 0b101:
+			e.PC = uint16(data & 0b11111)
+			return Running, true, nil
+		case 0b110:
+			e.ISR, e.ISRCount = data, 0
+		case 0b111:
+			e.OSR, e.OSRCount = data, 0
+		}
+		return Running, false, nil
+	case idxIRQ:
+		flag := uint8(1) << (instr & 0b111)
+		if instr&0b1000000 != 0 {
+			e.IRQ &^= flag
+			return Running, false, nil
+		}
+		if e.irqWait {
+			if e.IRQ&flag != 0 {
+				return StalledIRQ, false, nil
+			}
+			e.irqWait = false
+			return Running, false, nil
+		}
+		e.IRQ |= flag
+		if instr&0b100000 != 0 {
+			e.irqWait = true
+			return StalledIRQ, false, nil
+		}
+		return Running, false, nil
+	case idxSET:
+		data := uint32(instr & 0b11111)
+		switch (instr >> 5) & 0b111 {
+		case 0b000:
+			writePins(&e.Pins, e.SetBase, e.Attr.Set, data)
+		case 0b001:
+			e.X = data
+		case 0b010:
+			e.Y = data
+		case 0b100:
+			writePins(&e.PinDirs, e.SetBase, e.Attr.Set, data)
+		default:
+			return Running, false, ErrBad
+		}
+		return Running, false, nil
+	case idxMOV1:
+		return Running, false, fmt.Errorf("rxfifo indexed mov <%04x>: %w", instr, ErrUnsupported)
+	}
+	return Running, false, fmt.Errorf("unknown <%04x>: %w", instr, ErrBad)
+}
@@ -0,0 +1,56 @@
+package pious
+
+import "testing"
+
+func TestEmulatorClock(t *testing.T) {
+	p, err := NewProgram(".program clock\n.set 1\n\tset\tpindirs, 1\n.wrap_target\n\tset\tpins, 0 [1]\n\tset\tpins, 1 [1]\n.wrap\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	e := NewEmulator(p)
+	e.SetBase = 6
+	var trace []uint32
+	for i := 0; i < 9; i++ {
+		if _, err := e.Step(0); err != nil {
+			t.Fatalf("step %d failed: %v", i, err)
+		}
+		trace = append(trace, e.Pins>>6)
+	}
+	want := []uint32{0, 0, 0, 1, 1, 0, 0, 1, 1}
+	for i := range want {
+		if trace[i] != want[i] {
+			t.Fatalf("got=%v want=%v", trace, want)
+		}
+	}
+	if e.PinDirs != 1<<6 {
+		t.Errorf("got pindirs=%08x", e.PinDirs)
+	}
+}
+
+func TestEmulatorFIFO(t *testing.T) {
+	p, err := NewProgram(`.program copy
+.out 8 right auto 16
+.in 8 left auto 16
+	out	x, 8
+	in	x, 8
+`)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	e := NewEmulator(p)
+	if state, err := e.Step(0); err != nil || state != StalledPull {
+		t.Fatalf("expected pull stall, got %v: %v", state, err)
+	}
+	e.Put(0x1234)
+	for i := 0; i < 4; i++ {
+		if state, err := e.Step(0); err != nil || state != Running {
+			t.Fatalf("step %d: got %v: %v", i, state, err)
+		}
+	}
+	if v, ok := e.Get(); !ok || v != 0x3412 {
+		t.Errorf("got %08x (%v), want 00003412", v, ok)
+	}
+	if r := e.Snapshot(); r.X != 0x12 || r.ISRCount != 0 || r.OSRCount != 16 {
+		t.Errorf("unexpected registers: %#v", r)
+	}
+}
@@ -1,19 +1,78 @@
 package pious
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+// MakePackageOptions holds optional settings for MakePackage.
+type MakePackageOptions struct {
+	// Package names the generated Go package. By default the
+	// program name is used.
+	Package string
+
+	// WrapConsts requests that constants be generated for the
+	// wrap and wrap target offsets of each module.
+	WrapConsts bool
+
+	// Prefix is prepended to the names of the generated
+	// constants, types and functions, so that several generated
+	// programs can share a package. Methods are not prefixed.
+	Prefix string
+
+	// GoGenerate, if not empty, is included in the generated
+	// source as the command of a //go:generate comment.
+	GoGenerate string
+
+	// ByteOrder, if not nil, requests an additional CodeBytes
+	// variable holding the program code as raw bytes in this
+	// byte order, for transports that need them. Assign does not
+	// use CodeBytes.
+	ByteOrder binary.ByteOrder
+}
+
 // MakePackage generates the source code for a tinygo compatible
-// API to some PIO program encoded in the form of a *Program.
-func (p *Program) MakePackage(comment string) []string {
-	lines := strings.Split(fmt.Sprint(`// Package `, p.Attr.Name, ` was autogenerated by the zappem.net/pub/io/pious package.
+// API to some PIO program encoded in the form of a *Program. The
+// generated package defines an Engine type and an Assign function
+// to load the program code into a PIO block. For each module of the
+// program, an Engine method named Configure<Module> is generated to
+// claim and configure a StateMachine to run that module. These
+// names carry any opts.Prefix. A nil opts value selects the default
+// options.
+//
+// The program code is emitted as a []uint16 literal of instruction
+// values, which is what the AddProgram method of the tinygo pio.PIO
+// expects, so its byte order is left to the compiler.
+func (p *Program) MakePackage(comment string, opts *MakePackageOptions) []string {
+	if opts == nil {
+		opts = &MakePackageOptions{}
+	}
+	pkg := opts.Package
+	if pkg == "" {
+		pkg = p.Attr.Name
+	}
+	exported := func(name string) string {
+		if opts.Prefix == "" {
+			return name
+		}
+		return camelCase("_" + opts.Prefix + "_" + name)
+	}
+	engine, sm, assign, codeBytes := exported("Engine"), exported("StateMachine"), exported("Assign"), exported("CodeBytes")
+	var generate string
+	if opts.GoGenerate != "" {
+		generate = fmt.Sprint("\n//go:generate ", opts.GoGenerate, "\n")
+	}
+	lines := strings.Split(fmt.Sprint(`// Package `, pkg, ` was autogenerated by the zappem.net/pub/io/pious package.
 //
 // `, comment, `
 
-package `, p.Attr.Name, `
-
+package `, pkg, `
+`, generate, `
 import (
 	"machine"
 	"sync"
@@ -21,60 +80,105 @@ import (
 	pio "github.com/tinygo-org/pio/rp2-pio"
 )
 
-// Engine is a wrapper type to enable `, p.Attr.Name, ` methods for a
+// `, engine, ` is a wrapper type to enable `, p.Attr.Name, ` methods for a
 // pio.PIO.
-type Engine struct {
+type `, engine, ` struct {
 	block  *pio.PIO
 	offset uint8
 	mu     sync.Mutex
 }
 
-// StateMachine is a wrapper type to enable `, p.Attr.Name, ` methods
+// `, sm, ` is a wrapper type to enable `, p.Attr.Name, ` methods
 // for a pio.StateMachine.
-type StateMachine struct {
+type `, sm, ` struct {
 	Origin uint8
 	SM     *pio.StateMachine
 	Cfg    pio.StateMachineConfig
 }
 
-// Start initializes a StateMachine with a configured
+// Start initializes a `, sm, ` with a configured
 // PIO sequence. Use s.Activate(true|false) to enable it.
-func (s *StateMachine) Start() {
+func (s *`, sm, `) Start() {
 	s.SM.Init(s.Origin, s.Cfg)
 }
 
-// Activate can be used to pause or resume a StateMachine.
-func (s *StateMachine) Activate(run bool) {
+// Activate can be used to pause or resume a `, sm, `.
+func (s *`, sm, `) Activate(run bool) {
 	s.SM.SetEnabled(run)
 }
 
-// Assign loads the package program code into the block PIO.
-func Assign(block *pio.PIO) (*Engine, error) {
+// `, assign, ` loads the package program code into the block PIO.
+func `, assign, `(block *pio.PIO) (*`, engine, `, error) {
 	offset, err := block.AddProgram([]uint16{`), "\n")
 	for _, code := range p.Code {
 		lines = append(lines, fmt.Sprintf("\t\t0x%04x,", code))
 	}
-	lines = append(lines, strings.Split(`	}, -1)
+	origin := -1
+	if p.base != 0 {
+		origin = int(p.base)
+	}
+	lines = append(lines, strings.Split(fmt.Sprint(`	}, `, origin, `)
 	if err != nil {
 		return nil, err
 	}
-	return &Engine{
+	return &`, engine, `{
 		block:  block,
 		offset: offset,
 	}, nil
 }
-`, "\n")...)
-	mods := p.Modules
-	if mods == nil {
-		mods = []Settings{p.Attr}
+`), "\n")...)
+	if opts.ByteOrder != nil {
+		lines = append(lines,
+			fmt.Sprintf("// %s holds the program code as raw bytes in %v byte", codeBytes, opts.ByteOrder),
+			fmt.Sprintf("// order. %s does not use these: AddProgram loads []uint16", assign),
+			"// instruction values.",
+			fmt.Sprint("var ", codeBytes, " = []byte{"))
+		var b [2]byte
+		for _, code := range p.Code {
+			opts.ByteOrder.PutUint16(b[:], code)
+			lines = append(lines, fmt.Sprintf("\t0x%02x, 0x%02x, // 0x%04x", b[0], b[1], code))
+		}
+		lines = append(lines, "}", "")
+	}
+	mods, names := p.modules(), p.moduleNames()
+	wraps := p.lastWraps()
+	if opts.WrapConsts {
+		lines = append(lines, "// Offsets of the wrap and wrap target of each module.")
+		for j, m := range mods {
+			base := names[j]
+			if opts.Prefix != "" {
+				base = opts.Prefix + "_" + base
+			}
+			lines = append(lines,
+				fmt.Sprint("const ", camelCase("_"+base+"_wrap_target"), " = ", m.WrapTarget),
+				fmt.Sprint("const ", camelCase("_"+base+"_wrap"), " = ", wraps[j]))
+		}
+		lines = append(lines, "")
+	}
+	if labels := p.publicLabels(); len(labels) != 0 {
+		lines = append(lines, "// Offsets of the public labels.")
+		for _, label := range labels {
+			base := p.Attr.Name
+			if opts.Prefix != "" {
+				base = opts.Prefix + "_" + base
+			}
+			lines = append(lines, fmt.Sprint("const ", camelCase("_"+base+"_offset_"+label), " = ", p.Labels[label]))
+		}
+		lines = append(lines, "")
 	}
-	for _, m := range mods {
-		fn := camelCase("Configure_" + m.Name)
+	var start uint16
+	for j, m := range mods {
+		out, set := p.pinWriters(start, m.Length)
+		start += m.Length
+		// The out pin group is only configured when .out
+		// gives it a size.
+		outGroup := m.Out != 0 && (m.OutPins || len(out) != 0)
+		fn := camelCase("Configure_" + names[j])
 		var args []string
 		if m.InPins {
 			args = append(args, "inBase")
 		}
-		if m.OutPins {
+		if outGroup {
 			args = append(args, "outBase")
 		}
 		if m.SideSet != 0 {
@@ -86,22 +190,25 @@ func Assign(block *pio.PIO) (*Engine, error) {
 		lines = append(lines, strings.Split(fmt.Sprint(`// `, fn, ` sets up a `, m.Name, ` module. It operates with
 // an in bit-size of `, m.In, `; an out bit-size of `, m.Out, `;
 // a side-set bit-size of `, m.SideSet, `; and a set bit-size of `, m.Set, `.
-func (e *Engine) `, fn, `(`, strings.Join(args, ", "), ` machine.Pin) (*StateMachine, error) {
+func (e *`, engine, `) `, fn, `(`, strings.Join(args, ", "), ` machine.Pin) (*`, sm, `, error) {
 	sm, err := e.block.ClaimStateMachine()
 	if err != nil {
 		return nil, err
 	}
 	cfg := pio.DefaultStateMachineConfig()
-	cfg.SetWrap(e.offset+`, m.WrapTarget, `, e.offset+`, m.Wrap, `)
+	cfg.SetWrap(e.offset+`, m.WrapTarget, `, e.offset+`, wraps[j], `)
 	var pin machine.Pin`), "\n")...)
 
 		if m.Set != 0 {
+			if len(set) != 0 {
+				lines = append(lines, fmt.Sprint(`	// The set pin group is written by: `, strings.Join(set, ", "), `.`))
+			}
 			lines = append(lines, fmt.Sprint(`	pin = setBase
 	for i := 0; i < `, m.Set, `; i++ {
 		pin.Configure(machine.PinConfig{Mode: e.block.PinMode()})
 		pin++
 	}
-	sm.SetPindirsConsecutive(setBase, `, m.Set, `, true)
+	sm.SetPindirsConsecutive(setBase, `, m.Set, `, `, drivesPins(set), `)
 	cfg.SetSetPins(setBase, `, m.Set, `)`))
 		}
 
@@ -116,13 +223,16 @@ func (e *Engine) `, fn, `(`, strings.Join(args, ", "), ` machine.Pin) (*StateMac
 	cfg.SetSidesetParams(`, m.SideSet, `, `, m.SideSetOpt, `, `, m.SideSetPindirs, `)`))
 		}
 
-		if m.OutPins {
+		if outGroup {
+			if len(out) != 0 {
+				lines = append(lines, fmt.Sprint(`	// The out pin group is written by: `, strings.Join(out, ", "), `.`))
+			}
 			lines = append(lines, fmt.Sprint(`	pin = outBase
 	for i := 0; i < `, m.Out, `; i++ {
 		pin.Configure(machine.PinConfig{Mode: e.block.PinMode()})
 		pin++
 	}
-	sm.SetPindirsConsecutive(outBase, `, m.Out, `, true)
+	sm.SetPindirsConsecutive(outBase, `, m.Out, `, `, m.OutPins || drivesPins(out), `)
 	cfg.SetOutPins(outBase, `, m.Out, `)`))
 		}
 		if m.Out != 0 {
@@ -141,14 +251,681 @@ func (e *Engine) `, fn, `(`, strings.Join(args, ", "), ` machine.Pin) (*StateMac
 		if m.In != 0 {
 			lines = append(lines, fmt.Sprint(`	cfg.SetInShift(`, !m.InLeft, `, `, m.InAuto, `, `, m.InThreshold, `)`))
 		}
+		if m.HasJmpPin {
+			lines = append(lines, fmt.Sprint(`	cfg.SetJmpPin(`, m.JmpPin, `)`))
+		}
+		if m.ClockDiv != 0 {
+			whole := uint32(m.ClockDiv)
+			frac := uint8((m.ClockDiv - float64(whole)) * 256)
+			lines = append(lines, fmt.Sprint(`	cfg.SetClkDivIntFrac(`, uint16(whole), `, `, frac, `)`))
+		}
+		switch m.FifoMode {
+		case FifoTx:
+			lines = append(lines, `	cfg.SetFIFOJoin(pio.FifoJoinTx)`)
+		case FifoRx:
+			lines = append(lines, `	cfg.SetFIFOJoin(pio.FifoJoinRx)`)
+		case FifoTxPut, FifoTxGet, FifoPutGet:
+			// SetFIFOJoin has no RP2350 modes, so set the
+			// FJOIN_RX_GET and FJOIN_RX_PUT bits directly.
+			lines = append(lines, fmt.Sprint(`	cfg.ShiftCtrl |= `, fifoShiftCtrl(m.FifoMode), ` // .fifo `, disFifoModes[m.FifoMode]))
+		}
 
-		lines = append(lines, strings.Split(fmt.Sprint(`	return &StateMachine{
+		lines = append(lines, strings.Split(fmt.Sprint(`	return &`, sm, `{
 		Origin: e.offset + `, m.Origin, `,
 		SM:     &sm,
 		Cfg:    cfg,
 	}, nil
 }
 `), "\n")...)
+		if block := m.CodeBlocks["go"]; len(block) != 0 {
+			lines = append(append(lines, block...), "")
+		}
 	}
 	return lines
 }
+
+// drivesPins indicates that the program writes pin values with one
+// of the pin writer instruction forms returned by pinWriters, and
+// not only pin directions. When it only writes pindirs, the pins of
+// a group start as inputs and the program controls their direction.
+func drivesPins(forms []string) bool {
+	if len(forms) == 0 {
+		return true
+	}
+	for _, form := range forms {
+		if strings.HasSuffix(form, " pins") {
+			return true
+		}
+	}
+	return false
+}
+
+// publicLabels returns the sorted names of the public labels of p.
+func (p *Program) publicLabels() []string {
+	var labels []string
+	for label := range p.Public {
+		if _, ok := p.Labels[label]; ok {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// MakeCHeader generates the source code for a pico-sdk compatible C
+// header file for some PIO program encoded in the form of a
+// *Program. The layout follows that of the pioasm `-o c-sdk` output.
+// A program moved with Relocate is given its LoadOffset as the origin.
+// The wrap defines and config function of each module of a combined
+// program are named with the module index, such as blink0_wrap.
+func (p *Program) MakeCHeader(comment string) []string {
+	name := p.Attr.Name
+	banner := strings.Repeat("-", len(name))
+	lines := strings.Split(fmt.Sprint(`// -------------------------------------------------- //
+// This file is autogenerated by pious; do not edit!  //
+// -------------------------------------------------- //
+//
+// `, comment, `
+
+#pragma once
+
+#if !PICO_NO_HARDWARE
+#include "hardware/pio.h"
+#endif
+
+// `, banner, ` //
+// `, name, ` //
+// `, banner, ` //
+`), "\n")
+	mods, names := p.modules(), p.moduleNames()
+	wraps := p.lastWraps()
+	for j, m := range mods {
+		lines = append(lines,
+			fmt.Sprintf("#define %s_wrap_target %d", names[j], m.WrapTarget),
+			fmt.Sprintf("#define %s_wrap %d", names[j], wraps[j]))
+	}
+	lines = append(lines, fmt.Sprintf("#define %s_pio_version %d", name, p.Attr.PioVersion))
+	for _, label := range p.publicLabels() {
+		lines = append(lines, fmt.Sprintf("#define %s_offset_%s %du", name, label, p.Labels[label]))
+	}
+	lines = append(lines, "", fmt.Sprintf("static const uint16_t %s_program_instructions[] = {", name))
+	for i, code := range p.Code {
+		for _, m := range mods {
+			if uint16(i) == m.WrapTarget {
+				lines = append(lines, "            //     .wrap_target")
+			}
+		}
+		text, err := Disassemble(code, p.moduleAt(uint16(i)))
+		if err != nil {
+			text = "?"
+		}
+		lines = append(lines, fmt.Sprintf("    0x%04x, // %2d: %s", code, i, strings.ReplaceAll(text, "\t", " ")))
+		for _, wrap := range wraps {
+			if uint16(i) == wrap {
+				lines = append(lines, "            //     .wrap")
+			}
+		}
+	}
+	// A relocated program must be loaded at its offset.
+	origin := -1
+	if p.base != 0 {
+		origin = int(p.base)
+	}
+	lines = append(lines, strings.Split(fmt.Sprint(`};
+
+#if !PICO_NO_HARDWARE
+static const struct pio_program `, name, `_program = {
+    .instructions = `, name, `_program_instructions,
+    .length = `, len(p.Code), `,
+    .origin = `, origin, `,
+    .pio_version = `, name, `_pio_version,
+};
+`), "\n")...)
+	var start uint16
+	for j, m := range mods {
+		out, set := p.pinWriters(start, m.Length)
+		start += m.Length
+		lines = append(lines,
+			fmt.Sprintf("static inline pio_sm_config %s_program_get_default_config(uint offset) {", names[j]),
+			"    pio_sm_config c = pio_get_default_sm_config();",
+			fmt.Sprintf("    sm_config_set_wrap(&c, offset + %s_wrap_target, offset + %s_wrap);", names[j], names[j]))
+		if len(out) != 0 {
+			lines = append(lines, fmt.Sprintf("    // use sm_config_set_out_pins() for: %s", strings.Join(out, ", ")))
+		}
+		if len(set) != 0 {
+			lines = append(lines, fmt.Sprintf("    // use sm_config_set_set_pins() for: %s", strings.Join(set, ", ")))
+		}
+		if m.SideSet != 0 {
+			bits := m.SideSet
+			if m.SideSetOpt {
+				bits++
+			}
+			lines = append(lines, fmt.Sprintf("    sm_config_set_sideset(&c, %d, %v, %v);", bits, m.SideSetOpt, m.SideSetPindirs))
+		}
+		if m.Out != 0 {
+			lines = append(lines, fmt.Sprintf("    sm_config_set_out_shift(&c, %v, %v, %d);", !m.OutLeft, m.OutAuto, m.OutThreshold))
+		}
+		if m.In != 0 {
+			lines = append(lines, fmt.Sprintf("    sm_config_set_in_shift(&c, %v, %v, %d);", !m.InLeft, m.InAuto, m.InThreshold))
+		}
+		if m.HasJmpPin {
+			lines = append(lines, fmt.Sprintf("    sm_config_set_jmp_pin(&c, %d);", m.JmpPin))
+		}
+		if m.ClockDiv != 0 {
+			lines = append(lines, fmt.Sprintf("    sm_config_set_clkdiv(&c, %s);", strconv.FormatFloat(m.ClockDiv, 'g', -1, 64)))
+		}
+		if m.FifoMode != FifoTxRx {
+			join := strings.ToUpper(disFifoModes[m.FifoMode])
+			lines = append(lines, fmt.Sprintf("    sm_config_set_fifo_join(&c, PIO_FIFO_JOIN_%s);", join))
+		}
+		if m.MovStatusSel != StatusTxLess || m.MovStatusN != 0 {
+			sel := fmt.Sprint("(enum pio_mov_status_type) ", uint16(m.MovStatusSel))
+			if names := []string{"STATUS_TX_LESSTHAN", "STATUS_RX_LESSTHAN", "STATUS_IRQ_SET"}; int(m.MovStatusSel) < len(names) {
+				sel = names[m.MovStatusSel]
+			}
+			lines = append(lines, fmt.Sprintf("    sm_config_set_mov_status(&c, %s, %d);", sel, m.MovStatusN))
+		}
+		lines = append(lines, "    return c;", "}", "")
+		if block := m.CodeBlocks["c-sdk"]; len(block) != 0 {
+			lines = append(append(lines, block...), "")
+		}
+	}
+	lines = append(lines, "#endif", "")
+	return lines
+}
+
+// Patterns for the lines of a C header generated by MakeCHeader or
+// by pioasm.
+var (
+	cDefineRE      = regexp.MustCompile(`^#define\s+(\w+)\s+(\d+)u?\s*$`)
+	cInstructionRE = regexp.MustCompile(`^static const uint16_t (\w+)_program_instructions\[\] = \{`)
+	cWordRE        = regexp.MustCompile(`^\s*0x([0-9a-fA-F]{1,4}),`)
+	cConfigRE      = regexp.MustCompile(`^static inline pio_sm_config (\w+)_program_get_default_config\(`)
+	cSetRE         = regexp.MustCompile(`^\s*sm_config_set_(\w+)\(&c, (.*)\);`)
+)
+
+// ParseCHeader reconstructs a Program from the source of a C header
+// generated by MakeCHeader or by the pioasm c-sdk output format. The
+// instruction words, wrap offsets, public labels and the state
+// machine configuration of the first program of the header are
+// recovered, and the words are disassembled to reconstruct the
+// remaining Settings, as NewProgram would for the equivalent source.
+// A header does not record private labels or the pin counts of the
+// .out and .in directives, so these are not recovered.
+func ParseCHeader(src string) (*Program, error) {
+	var name, config string
+	defines := make(map[string]uint16)
+	var code []uint16
+	s := Settings{}
+	var hasOut, hasIn bool
+	inArray := false
+	for i, line := range strings.Split(src, "\n") {
+		if inArray {
+			if m := cWordRE.FindStringSubmatch(line); m != nil {
+				w, _ := strconv.ParseUint(m[1], 16, 16)
+				code = append(code, uint16(w))
+			} else if strings.HasPrefix(strings.TrimSpace(line), "};") {
+				inArray = false
+			}
+			continue
+		}
+		if m := cDefineRE.FindStringSubmatch(line); m != nil {
+			v, err := strconv.ParseUint(m[2], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad value for %s: %v", i+1, m[1], err)
+			}
+			defines[m[1]] = uint16(v)
+			continue
+		}
+		if m := cInstructionRE.FindStringSubmatch(line); m != nil {
+			if name != "" {
+				// Only the first program is parsed.
+				continue
+			}
+			name, inArray = m[1], true
+			continue
+		}
+		if m := cConfigRE.FindStringSubmatch(line); m != nil {
+			config = m[1]
+			continue
+		}
+		m := cSetRE.FindStringSubmatch(line)
+		if m == nil || config == "" || config != name {
+			continue
+		}
+		args := strings.Split(m[2], ", ")
+		bad := func() error {
+			return fmt.Errorf("line %d: unsupported sm_config_set_%s arguments: %s", i+1, m[1], m[2])
+		}
+		switch m[1] {
+		case "sideset":
+			n, err := strconv.ParseUint(args[0], 10, 16)
+			if len(args) != 3 || err != nil {
+				return nil, bad()
+			}
+			s.SideSetOpt = args[1] == "true"
+			s.SideSetPindirs = args[2] == "true"
+			s.SideSet = uint16(n)
+			if s.SideSetOpt {
+				s.SideSet--
+			}
+		case "out_shift", "in_shift":
+			n, err := strconv.ParseUint(args[len(args)-1], 10, 16)
+			if len(args) != 3 || err != nil || n > 32 {
+				return nil, bad()
+			}
+			left, auto, threshold := args[0] == "false", args[1] == "true", uint16(n%32)
+			if m[1] == "out_shift" {
+				hasOut = true
+				s.OutLeft, s.OutAuto, s.OutThreshold = left, auto, threshold
+			} else {
+				hasIn = true
+				s.InLeft, s.InAuto, s.InThreshold = left, auto, threshold
+			}
+		case "jmp_pin":
+			n, err := strconv.ParseUint(args[0], 10, 16)
+			if len(args) != 1 || err != nil {
+				return nil, bad()
+			}
+			s.JmpPin, s.HasJmpPin = uint16(n), true
+		case "clkdiv":
+			f, err := strconv.ParseFloat(args[0], 64)
+			if len(args) != 1 || err != nil {
+				return nil, bad()
+			}
+			s.ClockDiv = f
+		case "fifo_join":
+			mode := strings.ToLower(strings.TrimPrefix(args[0], "PIO_FIFO_JOIN_"))
+			if mode == "none" {
+				mode = "txrx"
+			}
+			n, ok := indexOf(disFifoModes)[mode]
+			if !ok {
+				return nil, bad()
+			}
+			s.FifoMode = FifoMode(n)
+		case "mov_status":
+			sel := map[string]MovStatus{"STATUS_TX_LESSTHAN": StatusTxLess, "STATUS_RX_LESSTHAN": StatusRxLess, "STATUS_IRQ_SET": StatusIRQ}
+			st, ok := sel[args[0]]
+			n, err := strconv.ParseUint(args[len(args)-1], 10, 16)
+			if len(args) != 2 || !ok || err != nil {
+				return nil, bad()
+			}
+			s.MovStatusSel, s.MovStatusN = st, uint16(n)
+		}
+	}
+	if name == "" {
+		return nil, errors.New("no _program_instructions array found")
+	}
+	if len(code) == 0 || len(code) > 32 {
+		return nil, fmt.Errorf("program %q has %d instructions", name, len(code))
+	}
+
+	s.Name = name
+	s.PioVersion = defines[name+"_pio_version"]
+	s.Wrap = uint16(len(code))
+	if wrap, ok := defines[name+"_wrap"]; ok {
+		s.Wrap = wrap
+	}
+	s.WrapTarget = defines[name+"_wrap_target"]
+	p := &Program{
+		Attr:    s,
+		Labels:  make(map[string]uint16),
+		Public:  make(map[string]bool),
+		Defines: make(map[string]uint16),
+		Code:    code,
+	}
+	prefix := name + "_offset_"
+	for define, offset := range defines {
+		if label := strings.TrimPrefix(define, prefix); label != define {
+			p.Labels[label] = offset
+			p.Public[label] = true
+		}
+	}
+	p.buildTargets()
+	if err := p.SetWrap(s.WrapTarget, s.Wrap); err != nil {
+		return nil, fmt.Errorf("program %q: %v", name, err)
+	}
+	// Assembling the disassembly of each word recovers the
+	// settings that NewProgram infers from the instructions.
+	for i, w := range code {
+		text, err := Disassemble(w, p)
+		if err == nil {
+			p.pc = uint16(i)
+			var instr uint16
+			if instr, err = Assemble(text, p); err == nil && instr != w {
+				err = fmt.Errorf("reassembled as 0x%04x", instr)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("program %q instruction %d (0x%04x): %v", name, i, w, err)
+		}
+		if v := PioVersion(w); v > p.Attr.PioVersion {
+			p.Attr.PioVersion = v
+		}
+	}
+	if hasOut && p.Attr.Out == 0 {
+		p.Attr.Out = 32
+	}
+	if hasIn && p.Attr.In == 0 {
+		p.Attr.In = 32
+	}
+	return p, nil
+}
+
+// MakeRust generates the source code for a Rust module that builds
+// some PIO program, encoded in the form of a *Program, as a
+// pio::Program of the rp-rs pio crate. Constants are generated for
+// the wrap values of each module, numbered by module index for a
+// combined program, and for the public labels, and a function named
+// <name>_program, in snake_case, returns the program. The wrap and
+// side-set of the returned pio::Program are those of the first
+// module.
+func (p *Program) MakeRust(comment string) []string {
+	name := snakeCase(p.Attr.Name)
+	lines := strings.Split(fmt.Sprint(`// -------------------------------------------------- //
+// This file is autogenerated by pious; do not edit!  //
+// -------------------------------------------------- //
+//
+// `, comment, `
+`), "\n")
+	mods, names := p.modules(), p.moduleNames()
+	wraps := p.lastWraps()
+	for j, m := range mods {
+		prefix := strings.ToUpper(snakeCase(names[j]))
+		lines = append(lines,
+			fmt.Sprintf("pub const %s_WRAP_TARGET: u8 = %d;", prefix, m.WrapTarget),
+			fmt.Sprintf("pub const %s_WRAP: u8 = %d;", prefix, wraps[j]))
+	}
+	prefix := strings.ToUpper(name)
+	lines = append(lines, fmt.Sprintf("pub const %s_PIO_VERSION: u8 = %d;", prefix, p.Attr.PioVersion))
+	for _, label := range p.publicLabels() {
+		lines = append(lines, fmt.Sprintf("pub const %s_OFFSET_%s: u8 = %d;", prefix, strings.ToUpper(label), p.Labels[label]))
+	}
+	lines = append(lines, "",
+		fmt.Sprintf("/// Returns the %s PIO program.", p.Attr.Name),
+		fmt.Sprintf("pub fn %s_program() -> pio::Program<{ pio::RP2040_MAX_PROGRAM_SIZE }> {", name),
+		"    pio::Program {",
+		"        code: [")
+	for i, code := range p.Code {
+		for _, m := range mods {
+			if uint16(i) == m.WrapTarget {
+				lines = append(lines, "            //     .wrap_target")
+			}
+		}
+		text, err := Disassemble(code, p.moduleAt(uint16(i)))
+		if err != nil {
+			text = "?"
+		}
+		lines = append(lines, fmt.Sprintf("            0x%04x, // %2d: %s", code, i, strings.ReplaceAll(text, "\t", " ")))
+		for _, wrap := range wraps {
+			if uint16(i) == wrap {
+				lines = append(lines, "            //     .wrap")
+			}
+		}
+	}
+	origin := "        origin: None,"
+	if p.base != 0 {
+		origin = fmt.Sprintf("        origin: Some(%d),", p.base)
+	}
+	lines = append(lines,
+		"        ]",
+		"        .iter()",
+		"        .copied()",
+		"        .collect(),",
+		origin,
+		"        wrap: pio::Wrap {",
+		fmt.Sprintf("            source: %d,", wraps[0]),
+		fmt.Sprintf("            target: %d,", mods[0].WrapTarget),
+		"        },",
+		fmt.Sprintf("        side_set: pio::SideSet::new(%v, %d, %v),", mods[0].SideSetOpt, mods[0].SideSet, mods[0].SideSetPindirs),
+		fmt.Sprintf("        version: pio::PioVersion::V%d,", p.Attr.PioVersion),
+		"    }",
+		"}",
+		"")
+	return lines
+}
+
+// fifoShiftCtrl returns the SHIFTCTRL register bits, FJOIN_RX_GET
+// (bit 14) and FJOIN_RX_PUT (bit 15), that select an RP2350 FIFO
+// mode.
+func fifoShiftCtrl(mode FifoMode) string {
+	switch mode {
+	case FifoTxPut:
+		return "1 << 15"
+	case FifoTxGet:
+		return "1 << 14"
+	}
+	return "1<<15 | 1<<14"
+}
+
+// pyConditions translates jmp conditions into their MicroPython
+// spelling.
+var pyConditions = map[string]string{
+	"!x":    "not_x",
+	"x--":   "x_dec",
+	"!y":    "not_y",
+	"y--":   "y_dec",
+	"x!=y":  "x_not_y",
+	"pin":   "pin",
+	"!osre": "not_osre",
+}
+
+// pyInstruction translates a single instruction into the MicroPython
+// rp2.asm_pio syntax. The label function names jmp targets. Those
+// instructions that have no MicroPython spelling return an error.
+func pyInstruction(code uint16, q *Program, label func(uint16) (string, bool)) (string, error) {
+	text, err := Disassemble(code, q)
+	if err != nil {
+		return "", err
+	}
+	f := splitFields(text)
+	if f[2] != "" && q.Attr.SideSetOpt {
+		return "", ErrUnsupported
+	}
+	args := strings.Fields(strings.ReplaceAll(f[1], ",", " "))
+	mnemonic := f[0]
+	switch mnemonic {
+	case "jmp":
+		var cond []string
+		if c := (code >> 5) & 0b111; c != 0 {
+			cond = append(cond, pyConditions[disCondition[c]])
+		}
+		name, ok := label(code & 0b11111)
+		if !ok {
+			return "", ErrUnsupported
+		}
+		args = append(cond, fmt.Sprintf("%q", name))
+	case "wait":
+		switch {
+		case len(args) == 4 && args[3] == "rel":
+			args = []string{args[0], args[1], fmt.Sprint("rel(", args[2], ")")}
+		case len(args) != 3 || args[1] == "jmppin":
+			return "", ErrUnsupported
+		}
+	case "in":
+		mnemonic = "in_"
+	case "mov":
+		if len(args) != 2 || strings.HasPrefix(args[0], "rxfifo") || strings.HasPrefix(args[1], "rxfifo") {
+			return "", ErrUnsupported
+		}
+		if src := args[1]; strings.HasPrefix(src, "!") {
+			args[1] = fmt.Sprint("invert(", src[1:], ")")
+		} else if strings.HasPrefix(src, "::") {
+			args[1] = fmt.Sprint("reverse(", src[2:], ")")
+		}
+	case "irq":
+		var mode []string
+		switch args[0] {
+		case "prev", "next":
+			return "", ErrUnsupported
+		case "clear":
+			mode, args = []string{"clear"}, args[1:]
+		case "wait":
+			mode, args = []string{"block"}, args[1:]
+		}
+		if len(args) == 2 {
+			args = []string{fmt.Sprint("rel(", args[0], ")")}
+		}
+		args = append(mode, args...)
+	}
+	py := fmt.Sprint(mnemonic, "(", strings.Join(args, ", "), ")")
+	if f[2] != "" {
+		py += fmt.Sprint(" .side(", strings.TrimPrefix(f[2], "side "), ")")
+	}
+	if f[3] != "" {
+		py += " " + f[3]
+	}
+	return py, nil
+}
+
+// MakeMicroPython generates a MicroPython rp2.asm_pio decorated
+// function for each module of the program. Instructions that
+// MicroPython cannot express, such as the RP2350 extensions and
+// optional side-set values, are emitted as raw word() values with
+// their pious spelling in a comment. Likewise, the RP2350 .fifo
+// modes are set as raw bits of the shiftctrl entry of the assembled
+// program.
+func (p *Program) MakeMicroPython() []string {
+	lines := []string{"import rp2"}
+	var start uint16
+	fns := p.moduleNames()
+	for j, m := range p.modules() {
+		fn := fns[j]
+		end := start + m.Length
+		q := p.moduleAt(start)
+		names := make(map[uint16][]string)
+		label := func(addr uint16) (string, bool) {
+			if addr < start || addr >= end {
+				return "", false
+			}
+			if sym, ok := p.Targets[addr]; ok {
+				return sym[0], true
+			}
+			name := fmt.Sprint("L", addr-start)
+			names[addr] = []string{name}
+			return name, true
+		}
+		var body []string
+		for i := start; i < end; i++ {
+			py, err := pyInstruction(p.Code[i], q, label)
+			if err != nil {
+				text, _ := Disassemble(p.Code[i], q)
+				py = fmt.Sprintf("word(0x%04x)  # %s", p.Code[i], strings.ReplaceAll(text, "\t", " "))
+			}
+			body = append(body, py)
+		}
+
+		var opts []string
+		pins := func(kw string, n uint16) {
+			init := strings.TrimSuffix(strings.Repeat("rp2.PIO.OUT_LOW, ", int(n)), " ")
+			opts = append(opts, fmt.Sprint(kw, "=(", init, ")"))
+		}
+		if m.Set != 0 {
+			pins("set_init", m.Set)
+		}
+		if m.OutPins && m.Out != 0 {
+			pins("out_init", m.Out)
+		}
+		if m.SideSet != 0 {
+			pins("sideset_init", m.SideSet)
+			if m.SideSetPindirs {
+				opts = append(opts, "side_pindir=True")
+			}
+		}
+		shift := func(kw string, left bool) {
+			dir := "rp2.PIO.SHIFT_RIGHT"
+			if left {
+				dir = "rp2.PIO.SHIFT_LEFT"
+			}
+			opts = append(opts, fmt.Sprint(kw, "=", dir))
+		}
+		if m.Out != 0 {
+			shift("out_shiftdir", m.OutLeft)
+			if m.OutAuto {
+				opts = append(opts, "autopull=True", fmt.Sprint("pull_thresh=", threshold(m.OutThreshold)))
+			}
+		}
+		if m.In != 0 {
+			shift("in_shiftdir", m.InLeft)
+			if m.InAuto {
+				opts = append(opts, "autopush=True", fmt.Sprint("push_thresh=", threshold(m.InThreshold)))
+			}
+		}
+
+		var fifo []string
+		switch m.FifoMode {
+		case FifoTx:
+			opts = append(opts, "fifo_join=rp2.PIO.JOIN_TX")
+		case FifoRx:
+			opts = append(opts, "fifo_join=rp2.PIO.JOIN_RX")
+		case FifoTxPut, FifoTxGet, FifoPutGet:
+			// fifo_join has no RP2350 modes, so set the
+			// FJOIN_RX_GET and FJOIN_RX_PUT bits of the
+			// shiftctrl entry of the assembled program.
+			fifo = append(fifo, fmt.Sprint(fn, "[4] |= ", fifoShiftCtrl(m.FifoMode), "  # .fifo ", disFifoModes[m.FifoMode]))
+		}
+
+		lines = append(lines, "", "", fmt.Sprint("@rp2.asm_pio(", strings.Join(opts, ", "), ")"), fmt.Sprint("def ", fn, "():"))
+		for i := start; i < end; i++ {
+			if i == m.WrapTarget {
+				lines = append(lines, "    wrap_target()")
+			}
+			syms := p.Targets[i]
+			if syms == nil {
+				syms = names[i]
+			}
+			for _, sym := range syms {
+				lines = append(lines, fmt.Sprintf("    label(%q)", sym))
+			}
+			lines = append(lines, "    "+body[i-start])
+			if i == m.Wrap {
+				lines = append(lines, "    wrap()")
+			}
+		}
+		lines = append(lines, fifo...)
+		start = end
+	}
+	return append(lines, "")
+}
+
+// DOT generates a Graphviz digraph of the control flow of a
+// program. Each instruction is a node labeled with its offset, any
+// label names, and its disassembly. Edges show fall-through and jmp
+// targets, and dashed edges show wrapping.
+func (p *Program) DOT() string {
+	lines := []string{
+		fmt.Sprintf("digraph %q {", p.Attr.Name),
+		"  node [shape=box, fontname=monospace];",
+	}
+	ins := instructions[idxJMP]
+	for i, code := range p.Code {
+		pc := uint16(i)
+		text, err := Disassemble(code, p.moduleAt(pc))
+		if err != nil {
+			text = fmt.Sprintf("unknown <%04x>", code)
+		}
+		label := fmt.Sprintf("%d: %s", i, strings.Join(strings.Fields(text), " "))
+		if syms := p.Targets[pc]; syms != nil {
+			label = strings.Join(syms, ":\n") + ":\n" + label
+		}
+		lines = append(lines, fmt.Sprintf("  n%d [label=%q];", i, label))
+	}
+	for i, code := range p.Code {
+		pc := uint16(i)
+		next := true
+		if code&ins.mask == ins.bits {
+			lines = append(lines, fmt.Sprintf("  n%d -> n%d [label=\"jmp\"];", i, code&0b11111))
+			next = code&0b11100000 != 0
+		}
+		if !next {
+			continue
+		}
+		if wrap, target := p.wrapAt(pc); pc == wrap {
+			lines = append(lines, fmt.Sprintf("  n%d -> n%d [style=dashed, label=\"wrap\"];", i, target))
+		} else if i+1 < len(p.Code) {
+			lines = append(lines, fmt.Sprintf("  n%d -> n%d;", i, i+1))
+		}
+	}
+	return strings.Join(append(lines, "}", ""), "\n")
+}
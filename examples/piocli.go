@@ -2,40 +2,92 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 
 	"zappem.net/pub/io/pious"
 )
 
 var (
-	debug  = flag.Bool("debug", false, "use to output debugging info")
-	name   = flag.String("name", "", "name output program")
-	src    = flag.String("src", "", "comma separated path(s) to .pio source file(s)")
-	tinygo = flag.Bool("tinygo", false, "output program as a tinygo compatible package of name --name")
+	cHeader = flag.Bool("c", false, "output program as a pico-sdk compatible C header")
+	debug   = flag.Bool("debug", false, "use to output debugging info")
+	dis     = flag.String("dis", "", "comma separated hex words, or a file of hex words, to disassemble")
+	name    = flag.String("name", "", "name output program")
+	pSrc    = flag.String("p", "", "path to a .pio file supplying the --dis settings (side-set width)")
+	pkg     = flag.String("package", "", "name of the --tinygo package (default --name)")
+	rust    = flag.Bool("rust", false, "output program as a Rust module for the pio crate")
+	src     = flag.String("src", "", "comma separated path(s) to .pio source file(s)")
+	tinygo  = flag.Bool("tinygo", false, "output program as a tinygo compatible package of name --name")
 )
 
+// disassemble prints the listing of the hex words of *dis, decoded
+// with the settings of the first program of the optional *pSrc file.
+func disassemble() {
+	text := *dis
+	if data, err := os.ReadFile(text); err == nil {
+		text = string(data)
+	}
+	var buf bytes.Buffer
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\r' || r == '\n'
+	}) {
+		v, err := strconv.ParseUint(strings.TrimPrefix(word, "0x"), 16, 16)
+		if err != nil {
+			log.Fatalf("%s bad hex word %q: %v", os.Args[0], word, err)
+		}
+		binary.Write(&buf, binary.LittleEndian, uint16(v))
+	}
+	var p *pious.Program
+	if *pSrc != "" {
+		r, err := os.Open(*pSrc)
+		if err != nil {
+			log.Fatalf("%s failed to read %q: %v", os.Args[0], *pSrc, err)
+		}
+		ps, err := pious.ParseReader(*pSrc, r)
+		r.Close()
+		if err != nil {
+			log.Fatalf("%s failed to assemble: %v", os.Args[0], err)
+		}
+		if len(ps) == 0 {
+			log.Fatalf("%s no .program in %q", os.Args[0], *pSrc)
+		}
+		p = &pious.Program{Attr: ps[0].Attr}
+	}
+	if err := pious.DisassembleStreamPC(&buf, os.Stdout, p); err != nil {
+		log.Fatalf("%s failed to disassemble: %v", os.Args[0], err)
+	}
+}
+
 func main() {
 	flag.Parse()
 
+	if *dis != "" {
+		disassemble()
+		return
+	}
+
 	if *src == "" {
 		log.Fatalf("%s --src=<program.pio>[,...] required argument", os.Args[0])
 	}
 
 	var ps []*pious.Program
 	for _, f := range strings.Split(*src, ",") {
-		text, err := os.ReadFile(f)
+		r, err := os.Open(f)
 		if err != nil {
 			log.Fatalf("%s failed to read %q: %v", os.Args[0], f, err)
 		}
-		p, err := pious.NewProgram(string(text))
+		progs, err := pious.ParseReader(f, r)
+		r.Close()
 		if err != nil {
-			log.Fatalf("%s failed to assemble %q: %v", os.Args[0], *src, err)
+			log.Fatalf("%s failed to assemble: %v", os.Args[0], err)
 		}
-		ps = append(ps, p)
+		ps = append(ps, progs...)
 	}
 
 	var p *pious.Program
@@ -59,12 +111,20 @@ func main() {
 	if *debug {
 		log.Printf("compiled: %#v", p)
 	}
+	for _, err := range p.Validate() {
+		log.Printf("warning: %v", err)
+	}
 	if *tinygo {
-		fmt.Print(strings.Join(p.MakePackage(fmt.Sprint("From sources: ", *src)), "\n"))
+		opts := &pious.MakePackageOptions{
+			Package:    *pkg,
+			WrapConsts: true,
+		}
+		fmt.Print(strings.Join(p.MakePackage(fmt.Sprint("From sources: ", *src), opts), "\n"))
+	} else if *cHeader {
+		fmt.Print(strings.Join(p.MakeCHeader(fmt.Sprint("From sources: ", *src)), "\n"))
+	} else if *rust {
+		fmt.Print(strings.Join(p.MakeRust(fmt.Sprint("From sources: ", *src)), "\n"))
 	} else {
-		// TODO when using pious.Cat() with different .side_set values
-		// the disassembler fails to reproduce the code. Need to warn
-		// about this.
 		for _, line := range p.Disassemble() {
 			fmt.Printf("%s\n", line)
 		}
@@ -0,0 +1,182 @@
+package pious
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrExpression indicates a malformed or out of range numerical
+// expression.
+var ErrExpression = errors.New("bad expression")
+
+// exprLimit bounds the magnitude of the intermediate values of an
+// expression.
+const exprLimit = 1 << 32
+
+// evalExpr evaluates a parenthesized numerical expression, such as
+// "(BASE + 1)" or "(1 << 3)". The operators are, in order of
+// increasing precedence, the shifts << and >>, then + and -, then *
+// and /, and lastly unary -. Integer literals are as for parseConst,
+// and symbols are looked up in the first of the consts to contain
+// them. An undefined symbol returns ErrRedo, so a forward label can
+// be resolved later.
+func evalExpr(expr string, consts ...map[string]uint16) (int64, error) {
+	e := &exprParser{text: expr, consts: consts}
+	v, err := e.primary()
+	if err != nil {
+		return 0, err
+	}
+	if e.skip(); e.pos != len(e.text) {
+		return 0, fmt.Errorf("%w: unexpected %q in %q", ErrExpression, e.text[e.pos:], expr)
+	}
+	return v, nil
+}
+
+// exprParser holds the state of a recursive descent parse of an
+// expression.
+type exprParser struct {
+	text   string
+	pos    int
+	consts []map[string]uint16
+}
+
+// skip advances past any whitespace.
+func (e *exprParser) skip() {
+	for e.pos < len(e.text) && strings.IndexByte(" \t", e.text[e.pos]) >= 0 {
+		e.pos++
+	}
+}
+
+// accept consumes op, if it is next.
+func (e *exprParser) accept(op string) bool {
+	e.skip()
+	if strings.HasPrefix(e.text[e.pos:], op) {
+		e.pos += len(op)
+		return true
+	}
+	return false
+}
+
+// checked reports an intermediate value too large in magnitude.
+func (e *exprParser) checked(v int64) (int64, error) {
+	if v >= exprLimit || v <= -exprLimit {
+		return 0, fmt.Errorf("%w: %q overflows", ErrExpression, e.text)
+	}
+	return v, nil
+}
+
+// shift parses the << and >> operators.
+func (e *exprParser) shift() (int64, error) {
+	v, err := e.sum()
+	for err == nil {
+		left := e.accept("<<")
+		if !left && !e.accept(">>") {
+			break
+		}
+		var n int64
+		if n, err = e.sum(); err != nil {
+			break
+		}
+		if n < 0 || n > 31 {
+			return 0, fmt.Errorf("%w: shift by %d in %q", ErrExpression, n, e.text)
+		}
+		if left {
+			v, err = e.checked(v << uint(n))
+		} else {
+			v >>= uint(n)
+		}
+	}
+	return v, err
+}
+
+// sum parses the + and - operators.
+func (e *exprParser) sum() (int64, error) {
+	v, err := e.product()
+	for err == nil {
+		plus := e.accept("+")
+		if !plus && !e.accept("-") {
+			break
+		}
+		var n int64
+		if n, err = e.product(); err != nil {
+			break
+		}
+		if plus {
+			v, err = e.checked(v + n)
+		} else {
+			v, err = e.checked(v - n)
+		}
+	}
+	return v, err
+}
+
+// product parses the * and / operators.
+func (e *exprParser) product() (int64, error) {
+	v, err := e.unary()
+	for err == nil {
+		times := e.accept("*")
+		if !times && !e.accept("/") {
+			break
+		}
+		var n int64
+		if n, err = e.unary(); err != nil {
+			break
+		}
+		if times {
+			v, err = e.checked(v * n)
+		} else if n == 0 {
+			return 0, fmt.Errorf("%w: division by zero in %q", ErrExpression, e.text)
+		} else {
+			v /= n
+		}
+	}
+	return v, err
+}
+
+// unary parses a negated operand.
+func (e *exprParser) unary() (int64, error) {
+	if e.accept("-") {
+		v, err := e.unary()
+		return -v, err
+	}
+	return e.primary()
+}
+
+// primary parses a parenthesized expression, a number or a symbol.
+func (e *exprParser) primary() (int64, error) {
+	if e.accept("(") {
+		v, err := e.shift()
+		if err != nil {
+			return 0, err
+		}
+		if !e.accept(")") {
+			return 0, fmt.Errorf("%w: missing ')' in %q", ErrExpression, e.text)
+		}
+		return v, nil
+	}
+	e.skip()
+	start := e.pos
+	for e.pos < len(e.text) && strings.IndexByte(" \t()+-*/<>", e.text[e.pos]) < 0 {
+		e.pos++
+	}
+	token := e.text[start:e.pos]
+	if token == "" {
+		return 0, fmt.Errorf("%w: missing operand in %q", ErrExpression, e.text)
+	}
+	for _, c := range e.consts {
+		if n, ok := c[token]; ok {
+			return int64(n), nil
+		}
+	}
+	base := 10
+	if strings.HasPrefix(token, "0x") || strings.HasPrefix(token, "0b") {
+		base = 0
+	}
+	n, err := strconv.ParseInt(token, base, 64)
+	if err != nil {
+		return 0, ErrRedo
+	}
+	return e.checked(n)
+}
@@ -0,0 +1,73 @@
+package pious
+
+// Features summarizes the state machine features that a program
+// relies on. Counts are numbers of instructions.
+type Features struct {
+	// SideSet counts the instructions with a side-set value.
+	SideSet int
+
+	// AutoPull and AutoPush indicate the OSR is refilled from the
+	// TX FIFO, or the ISR is emptied to the RX FIFO, automatically.
+	AutoPull, AutoPush bool
+
+	// JmpPin counts the jmp pin and wait jmppin instructions,
+	// which read the configured jmp pin.
+	JmpPin int
+
+	// IRQ counts the irq and wait irq instructions.
+	IRQ int
+
+	// Exec counts the out exec and mov exec instructions.
+	Exec int
+
+	// DirectFIFO counts the mov instructions that access the RX
+	// FIFO storage registers directly. These need a .fifo mode
+	// with put or get access.
+	DirectFIFO int
+}
+
+// Features scans the Code and settings of p to summarize the state
+// machine features it uses. For a combined program, the features of
+// all of the modules are aggregated.
+func (p *Program) Features() Features {
+	var f Features
+	var start uint16
+	for _, m := range p.modules() {
+		f.AutoPull = f.AutoPull || m.OutAuto
+		f.AutoPush = f.AutoPush || m.InAuto
+		for i := start; i < start+m.Length; i++ {
+			code := p.Code[i]
+			if _, present, _ := DecodeSideSet(code, m); present {
+				f.SideSet++
+			}
+			field := (code >> 5) & 0b111
+			switch decode(code) {
+			case idxJMP:
+				if field == 6 {
+					f.JmpPin++
+				}
+			case idxWAIT:
+				switch field & 0b11 {
+				case 0b10:
+					f.IRQ++
+				case 0b11:
+					f.JmpPin++
+				}
+			case idxIRQ:
+				f.IRQ++
+			case idxOUT:
+				if field == 7 {
+					f.Exec++
+				}
+			case idxMOV1:
+				f.DirectFIFO++
+			case idxMOV2:
+				if field == 4 {
+					f.Exec++
+				}
+			}
+		}
+		start += m.Length
+	}
+	return f
+}
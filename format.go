@@ -0,0 +1,168 @@
+package pious
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DisassembleOptions holds the formatting choices for
+// (*Program).DisassembleWith.
+type DisassembleOptions struct {
+	// Indent is the prefix of each instruction line.
+	Indent string
+
+	// Align pads the mnemonic and operand columns of all of the
+	// instructions to a common width.
+	Align bool
+
+	// Upper renders instruction mnemonics in upper case.
+	Upper bool
+
+	// Hex renders numerical operands in hexadecimal. Side-set
+	// values and delays remain decimal.
+	Hex bool
+
+	// Annotate prefixes each instruction line with the (hex)
+	// offset and code of the instruction, as in "03: 0x6040  ".
+	// The offset includes any Relocate shift of the program.
+	// Directive and label lines are not prefixed.
+	Annotate bool
+
+	// SideSetNotes appends a "; no side-set (opt bit clear)"
+	// comment to each instruction of a program with an optional
+	// side-set that omits its side-set value, so a reader can see
+	// that no side-set value is applied.
+	SideSetNotes bool
+
+	// IRQNames lists .define names of the program to show in
+	// place of the matching irq numbers of irq and wait irq
+	// instructions, as in "irq set DONE". By default, irq numbers
+	// are shown.
+	IRQNames []string
+
+	// pc and words are the offset and the code, as loaded, of a
+	// module of a combined program, for Annotate.
+	pc    uint16
+	words []uint16
+}
+
+// splitFields splits the output of Disassemble into its mnemonic,
+// operands, side-set and delay fields.
+func splitFields(text string) (f [4]string) {
+	f[0], text, _ = strings.Cut(text, "\t")
+	if n := strings.LastIndex(text, " ["); n >= 0 && strings.HasSuffix(text, "]") {
+		text, f[3] = text[:n], text[n+1:]
+	}
+	f[1], f[2], _ = strings.Cut(text, "\tside ")
+	if f[2] != "" {
+		f[2] = "side " + f[2]
+	}
+	return
+}
+
+var numberRE = regexp.MustCompile(`\b[0-9]+\b`)
+
+// format renders the instruction fields of a listing according to
+// opts. The default formatting matches the output of Disassemble.
+func (opts *DisassembleOptions) format(fields [][4]string) []string {
+	var widths [2]int
+	for i := range fields {
+		f := &fields[i]
+		if opts.Upper && !strings.HasPrefix(f[0], ".") {
+			f[0] = strings.ToUpper(f[0])
+		}
+		if opts.Hex {
+			f[1] = numberRE.ReplaceAllStringFunc(f[1], func(n string) string {
+				v, _ := strconv.Atoi(n)
+				return fmt.Sprintf("0x%x", v)
+			})
+		}
+		for j := range widths {
+			if len(f[j]) > widths[j] {
+				widths[j] = len(f[j])
+			}
+		}
+	}
+	lines := make([]string, len(fields))
+	for i, f := range fields {
+		if opts.Align {
+			text := fmt.Sprintf("%-*s %-*s %s %s", widths[0], f[0], widths[1], f[1], f[2], f[3])
+			lines[i] = opts.Indent + strings.TrimRight(text, " ")
+			continue
+		}
+		text := f[0] + "\t" + f[1]
+		if f[2] != "" {
+			text += "\t" + f[2]
+		}
+		if f[3] != "" {
+			text += " " + f[3]
+		}
+		lines[i] = opts.Indent + text
+	}
+	return lines
+}
+
+// Normalize rewrites a line of source in the canonical spelling of
+// a (*Program).Disassemble listing, by assembling and then
+// disassembling its instruction. The optional p supplies the
+// settings, labels and defines used to interpret the line. A leading
+// label and a trailing comment are retained. Directive, label and
+// blank lines are returned unchanged.
+func Normalize(line string, p *Program) (string, error) {
+	prefix, text := "", line
+	if label, public, rest, _, ok := leadingLabel(line); ok {
+		prefix, text = label+":", rest
+		if public {
+			prefix = "public " + prefix
+		}
+	}
+	instr, err := Assemble(text, p)
+	if err == ErrDirective || err == ErrEmpty {
+		return line, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var q *Program
+	if p != nil {
+		q = &Program{Attr: p.Attr, Labels: p.Labels}
+		q.buildTargets()
+	}
+	dis, err := Disassemble(instr, q)
+	if err != nil {
+		return "", err
+	}
+	out := prefix + strings.TrimRight((&DisassembleOptions{Indent: "\t"}).format([][4]string{splitFields(dis)})[0], "\t")
+	if comment := commentRE.FindString(line); comment != "" {
+		out += "\t" + comment
+	}
+	return out, nil
+}
+
+// irqSymbol replaces the irq number in the operands of an irq or a
+// wait irq instruction, instr, with its name in names, if any.
+func irqSymbol(instr uint16, operands string, names map[uint16]string) string {
+	switch decode(instr) {
+	case idxIRQ:
+	case idxWAIT:
+		if (instr>>5)&0b11 != 0b10 {
+			return operands
+		}
+	default:
+		return operands
+	}
+	name, ok := names[instr&0b111]
+	if !ok {
+		return operands
+	}
+	tokens := strings.Split(operands, " ")
+	for j := len(tokens) - 1; j >= 0; j-- {
+		if _, err := strconv.Atoi(tokens[j]); err == nil {
+			tokens[j] = name
+			break
+		}
+	}
+	return strings.Join(tokens, " ")
+}
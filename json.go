@@ -0,0 +1,58 @@
+package pious
+
+import "encoding/json"
+
+// programJSON is the serialized form of a Program. Targets is
+// omitted because it is derived from Labels.
+type programJSON struct {
+	Attr    Settings
+	Labels  map[string]uint16
+	Public  map[string]bool   `json:",omitempty"`
+	Defines map[string]uint16 `json:",omitempty"`
+	Code    []uint16
+	Modules []Settings `json:",omitempty"`
+
+	Comments       map[uint16][]string `json:",omitempty"`
+	InlineComments map[uint16]string   `json:",omitempty"`
+}
+
+// MarshalJSON serializes a Program. The instruction Code is encoded
+// as an array of numbers.
+func (p *Program) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&programJSON{
+		Attr:    p.Attr,
+		Labels:  p.Labels,
+		Public:  p.Public,
+		Defines: p.Defines,
+		Code:    p.Code,
+		Modules: p.Modules,
+
+		Comments:       p.Comments,
+		InlineComments: p.InlineComments,
+	})
+}
+
+// UnmarshalJSON reconstructs a Program serialized by MarshalJSON.
+// The Targets of the program are rebuilt from its Labels.
+func (p *Program) UnmarshalJSON(data []byte) error {
+	var v programJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*p = Program{
+		Attr:    v.Attr,
+		Labels:  v.Labels,
+		Public:  v.Public,
+		Defines: v.Defines,
+		Code:    v.Code,
+		Modules: v.Modules,
+
+		Comments:       v.Comments,
+		InlineComments: v.InlineComments,
+	}
+	if p.Labels == nil {
+		p.Labels = make(map[string]uint16)
+	}
+	p.buildTargets()
+	return nil
+}
@@ -0,0 +1,88 @@
+package pious
+
+import "sort"
+
+// PinConfig summarizes the GPIO pin groups used by a program. The
+// counts match the pin configuration that MakePackage generates.
+type PinConfig struct {
+	// SetCount is the number of pins written by set pins.
+	SetCount uint16
+
+	// OutCount is the number of pins in the out pin group. It is
+	// 0 when the program never writes to the out pins or their
+	// pindirs.
+	OutCount uint16
+
+	// InCount is the number of pins read by in pins. It is 0 when
+	// the program never inputs from pins.
+	InCount uint16
+
+	// SideSetCount is the number of side-set pins, not counting
+	// the opt bit.
+	SideSetCount uint16
+
+	// SideSetPindirs indicates that side-set drives pin directions
+	// instead of pin values.
+	SideSetPindirs bool
+
+	// Total is the sum of the above counts. This is the number of
+	// GPIOs needed when the pin groups do not overlap.
+	Total uint16
+}
+
+// PinConfig returns the pin groups used by the program, as derived
+// from its Attr settings.
+func (p *Program) PinConfig() PinConfig {
+	s := p.Attr
+	c := PinConfig{
+		SetCount:       s.Set,
+		SideSetCount:   s.SideSet,
+		SideSetPindirs: s.SideSetPindirs,
+	}
+	if out, _ := p.pinWriters(0, uint16(len(p.Code))); s.OutPins || len(out) != 0 {
+		c.OutCount = s.Out
+	}
+	if s.InPins {
+		c.InCount = s.In
+	}
+	c.Total = c.SetCount + c.OutCount + c.InCount + c.SideSetCount
+	return c
+}
+
+// pinWriters returns the instruction forms in the n instructions of
+// p starting at offset start that write to the out and set pin
+// groups. Both pins and pindirs destinations use these pin groups.
+func (p *Program) pinWriters(start, n uint16) (out, set []string) {
+	seen := make(map[string]bool)
+	for i := start; i < start+n && int(i) < len(p.Code); i++ {
+		code := p.Code[i]
+		dest := (code >> 5) & 0b111
+		var form string
+		switch decode(code) {
+		case idxOUT:
+			if dest == 0 || dest == 4 {
+				form = "out " + disDestinations[dest]
+			}
+		case idxMOV2:
+			if dest == 0 || dest == 3 {
+				form = "mov " + disMDestinations[dest]
+			}
+		case idxSET:
+			if dest == 0 || dest == 4 {
+				form = "set " + disDestinations[dest]
+			}
+		}
+		if form == "" || seen[form] {
+			continue
+		}
+		seen[form] = true
+		if form[0] == 's' {
+			set = append(set, form)
+		} else {
+			out = append(out, form)
+		}
+	}
+	sort.Strings(out)
+	sort.Strings(set)
+	return
+}
@@ -8,272 +8,489 @@ package pious
 import (
 	"errors"
 	"fmt"
+	"io"
+	"math/bits"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // Disassemble disassembles a PIO instruction.
 func Disassemble(instr uint16, p *Program) (string, error) {
-	var dec Instruction
-	var cmd int
-	var decoded []string
-	for cmd, dec = range instructions {
-		if dec.mask&instr == dec.bits {
-			decoded = append(decoded, fmt.Sprint(dec.token, "\t"))
-			break
-		}
-	}
-	if len(decoded) == 0 {
-		return fmt.Sprintf("unknown <%04x>", instr), ErrBad
-	}
-
-	if dec.flags&flagCondition != 0 {
-		offset := 0b111 & (instr >> 5)
-		if offset != 0 {
-			decoded = append(decoded, disCondition[offset]+" ")
-		}
-	}
-	if dec.flags&flagAddress != 0 {
-		addr := uint16(instr & 0b11111)
-		noSym := true
-		if p != nil {
-			if sym, ok := p.Targets[addr]; ok {
-				decoded = append(decoded, sym[0])
-				noSym = false
-			}
-		}
-		if noSym {
-			decoded = append(decoded, fmt.Sprint(addr))
-		}
-	}
-	if dec.flags&flagPolSource != 0 {
-		poll := (instr >> 5) & 0b111
-		index := instr & 0b11111
-		src := poll & 0b11
-		decoded = append(decoded, fmt.Sprint(poll>>2, " "), fmt.Sprint(disBitSource[src], " "))
-		switch src {
-		case 0b00, 0b01:
-			decoded = append(decoded, fmt.Sprint(index))
-		case 0b10:
-			idxmode := index >> 3
-			index = index & 0b111
-			switch idxmode {
-			case 0b00:
-				decoded = append(decoded, fmt.Sprint(index))
-			case 0b01:
-				decoded = append(decoded, fmt.Sprint("prev ", index))
-			case 0b10:
-				decoded = append(decoded, fmt.Sprint(index, " rel"))
-			case 0b11:
-				decoded = append(decoded, fmt.Sprint("next ", index))
-			}
-		case 0b11:
-			if index&0b11100 != 0 {
-				return fmt.Sprintf("unknown <%04x>", instr), ErrBad
-			}
-			decoded = append(decoded, fmt.Sprint("+ ", index))
-		}
-	} else if dec.flags&flagWIndex != 0 {
-		// without flagPolSource?
-		return fmt.Sprintf("unknown <%04x>", instr), ErrBad
+	d, bad, err := decodeStruct(instr, p)
+	if err != nil {
+		return bad, err
 	}
-	if dec.flags&flagISource != 0 {
-		src := (instr >> 5) & 0b111
-		tok := disISources[src]
-		if tok == "" {
-			return fmt.Sprintf("unknown <%04x>", instr), ErrBad
-		}
-		decoded = append(decoded, tok+" ")
+	text := fmt.Sprint(d.Mnemonic, "\t", d.Operands)
+	if d.HasSideSet {
+		text = fmt.Sprintf("%s\tside %d", text, d.SideSet)
+	}
+	if d.Delay != 0 {
+		text = fmt.Sprintf("%s [%d]", text, d.Delay)
 	}
+	return text, nil
+}
+
+// PioVersion returns the minimum PIO version that supports the
+// instruction, instr. Version 0 is the RP2040 PIO, and version 1 is
+// the RP2350 PIO which adds the indexed rxfifo forms of mov, the
+// jmppin source of wait, mov to pindirs and the prev/next irq index
+// modes.
+func PioVersion(instr uint16) uint16 {
+	if rp2350Feature(instr) != "" {
+		return 1
+	}
+	return 0
+}
 
-	if dec.flags&flagIfF != 0 {
-		if instr&(1<<6) != 0 {
-			decoded = append(decoded, "iffull ")
+// rp2350Feature describes the RP2350 addition that instr uses, or
+// returns "" for an instruction that the RP2040 supports.
+func rp2350Feature(instr uint16) string {
+	switch decode(instr) {
+	case idxMOV1:
+		return "direct rxfifo access"
+	case idxWAIT:
+		if (instr>>5)&0b11 == 0b11 {
+			return "the jmppin wait source"
+		}
+		if (instr>>5)&0b11 == 0b10 && instr&0b01000 != 0 {
+			return "the prev and next irq index modes"
+		}
+	case idxMOV2:
+		if (instr>>5)&0b111 == 0b011 {
+			return "mov to pindirs"
+		}
+	case idxIRQ:
+		if instr&0b01000 != 0 {
+			return "the prev and next irq index modes"
 		}
 	}
-	if dec.flags&flagIfE != 0 {
-		if instr&(1<<6) != 0 {
-			decoded = append(decoded, "ifempty ")
+	return ""
+}
+
+// ErrRedo supports lazy symbol definitions (forward jumps).
+var ErrRedo = errors.New("redo later")
+
+// ErrDelay indicates an instruction delay too large for the delay
+// bits left over after the side-set bits are reserved.
+var ErrDelay = errors.New("delay too large")
+
+// ErrNegative indicates a negative numerical operand.
+var ErrNegative = errors.New("operand must be non-negative")
+
+// parseConst returns a positive integer less than or equal to 32,
+// either indirectly via the first of the consts lookups to contain
+// it, or because the supplied token is an integer. Integers may be
+// decimal, or hexadecimal or binary with a 0x or 0b prefix. A token
+// in parentheses is evaluated as an expression with evalExpr.
+func parseConst(token string, consts ...map[string]uint16) (uint16, error) {
+	if strings.HasPrefix(token, "(") {
+		n, err := evalExpr(token, consts...)
+		if err != nil {
+			return 0, err
 		}
+		if n < 0 {
+			return 0, fmt.Errorf("%w, got %d", ErrNegative, n)
+		}
+		if n > 32 {
+			return 0, fmt.Errorf("%s = %d exceeds 32: %w", token, n, ErrBad)
+		}
+		return uint16(n), nil
 	}
-	if dec.flags&flagBlk != 0 {
-		if instr&(1<<5) != 0 {
-			decoded = append(decoded, "block")
-		} else {
-			decoded = append(decoded, "noblock")
+	for _, c := range consts {
+		if n, ok := c[token]; ok {
+			if n > 32 {
+				return 0, ErrBad
+			}
+			return n, nil
 		}
 	}
+	base := 10
+	if strings.HasPrefix(token, "0x") || strings.HasPrefix(token, "0b") {
+		base = 0
+	}
+	n, err := strconv.ParseInt(token, base, 32)
+	if err != nil {
+		return 0, ErrRedo
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%w, got %d", ErrNegative, n)
+	}
+	if n > 32 {
+		return 0, ErrBad
+	}
+	return uint16(n), err
+}
+
+// tokenizer matches token separators. Comments start with //, ; or
+// # and extend to the end of the line. No PIO operand contains
+// these characters.
+var tokenizer = regexp.MustCompile("([, \r\t]+|//.*|;.*|#.*)")
 
-	if dec.flags&flagDestination != 0 {
-		dest := (instr >> 5) & 0b111
-		if cmd == idxSET && (dest == 0b011 || dest >= 0b101) {
-			return "invalid destination", ErrBad
+// codeBlockRE matches the first line of a "% lang {" block of code
+// for a target language, such as "% c-sdk {". The block ends with a
+// "%}" line.
+var codeBlockRE = regexp.MustCompile(`^\s*%\s*([\w-]+)\s*\{\s*$`)
+
+// commentRE matches the comment, if any, of a line of source.
+var commentRE = regexp.MustCompile("//.*|;.*|#.*")
+
+// tokenize splits a line of source into its non-empty tokens. It also
+// returns the column (byte offset counting from 1) at which each
+// token starts. A parenthesized expression is a single token, even
+// when it contains spaces.
+func tokenize(line string) (tokens []string, cols []int) {
+	start := 0
+	for _, sep := range tokenizer.FindAllStringIndex(line, -1) {
+		// Separators within an unclosed parenthesis are part
+		// of the token, but comments are not.
+		if group := line[start:sep[0]]; strings.Count(group, "(") > strings.Count(group, ")") && !commentRE.MatchString(line[sep[0]:sep[1]]) {
+			continue
+		}
+		if sep[0] > start {
+			tokens = append(tokens, line[start:sep[0]])
+			cols = append(cols, start+1)
 		}
-		decoded = append(decoded, fmt.Sprintf("%s, ", disDestinations[dest]))
+		start = sep[1]
 	}
-	if dec.flags&flagMDestination != 0 {
-		dest := (instr >> 5) & 0b111
-		decoded = append(decoded, fmt.Sprintf("%s, ", disMDestinations[dest]))
+	if start < len(line) {
+		tokens = append(tokens, line[start:])
+		cols = append(cols, start+1)
 	}
-	if dec.flags&flagBitCount != 0 {
-		bc := instr & 0b11111
-		if bc == 0 {
-			bc = 32
-		}
-		decoded = append(decoded, fmt.Sprint(bc))
+	return
+}
+
+// leadingLabel splits a "name:" or "public name:" label declaration
+// from the start of a line that continues with an instruction. The
+// returned code is the line with the label replaced by spaces, so
+// the columns of the instruction tokens are unchanged. The col value
+// is the 1-based column of the label.
+func leadingLabel(line string) (label string, public bool, code string, col int, ok bool) {
+	tokens, cols := tokenize(line)
+	k := 0
+	if len(tokens) > 2 && tokens[0] == "public" {
+		k = 1
 	}
-	if dec.flags&flagOp != 0 {
-		op := (instr >> 3) & 0b11
-		switch op {
-		case 0b11:
-			return fmt.Sprintf("invalid <%04x>", instr), ErrBad
-		case 0b10:
-			decoded = append(decoded, "::")
-		case 0b01:
-			decoded = append(decoded, "!")
-		}
+	if len(tokens) < k+2 || !strings.HasSuffix(tokens[k], ":") || (strings.HasPrefix(tokens[k+1], ".") && tokens[k+1] != ".word") {
+		return
+	}
+	end := cols[k] - 1 + len(tokens[k])
+	return strings.TrimSuffix(tokens[k], ":"), k == 1, strings.Repeat(" ", end) + line[end:], cols[k], true
+}
+
+// defineLabel records a label at offset addr of p.
+func (p *Program) defineLabel(label string, public bool, addr uint16) error {
+	if label == "" {
+		return errors.New("missing label")
+	}
+	if value, hit := p.Labels[label]; hit {
+		return fmt.Errorf("duplicate label %q of value %d", label, value)
 	}
-	if dec.flags&flagMSource != 0 {
-		src := instr & 0b111
-		if src == 0b100 {
-			return fmt.Sprintf("invalid <%04x>", instr), ErrBad
+	p.Labels[label] = addr
+	if public {
+		if p.Public == nil {
+			p.Public = make(map[string]bool)
 		}
-		decoded = append(decoded, fmt.Sprintf("%s", disMSources[src]))
+		p.Public[label] = true
 	}
-	if dec.flags&flagData != 0 {
-		decoded = append(decoded, fmt.Sprint(instr&0b11111))
+	return nil
+}
+
+// parseErrorf generates a *ParseError for a failure parsing line
+// index i of some source. The col value is the 1-based column of
+// the offending token, or 0 if unknown.
+func parseErrorf(i int, line string, col int, format string, args ...interface{}) error {
+	return &ParseError{
+		Line:    i + 1,
+		Column:  col,
+		RawLine: line,
+		Err:     fmt.Errorf(format, args...),
 	}
-	if dec.flags&flagFromXIdxlIndex != 0 {
-		if instr&(1<<7) != 0 {
-			// from rxfifo
-			if instr&(1<<3) != 0 {
-				decoded = append(decoded, fmt.Sprintf("osr, rxfifo[%d]", instr&0b11))
-			} else {
-				if instr&0b111 != 0 {
-					return fmt.Sprintf("invalid <%04x>", instr), ErrBad
-				}
-				decoded = append(decoded, "osr, rxfifo[y]")
-			}
-		} else {
-			// to rxfifo
-			if instr&(1<<3) != 0 {
-				decoded = append(decoded, fmt.Sprintf("rxfifo[%d], isr", instr&0b11))
-			} else {
-				if instr&0b111 != 0 {
-					return fmt.Sprintf("invalid <%04x>", instr), ErrBad
-				}
-				decoded = append(decoded, "rxfifo[y], isr")
-			}
+}
+
+// parseWord parses the value of a .word directive, a raw 16-bit
+// instruction encoding.
+func parseWord(token string) (uint16, error) {
+	v, err := strconv.ParseUint(token, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad .word value %q (0 to 0xffff)", token)
+	}
+	return uint16(v), nil
+}
+
+// lineError converts an error returned by Assemble for line index i
+// of some source into a *ParseError.
+func lineError(i int, line string, err error) *ParseError {
+	pe := &ParseError{
+		Line:    i + 1,
+		RawLine: line,
+		Err:     err,
+	}
+	if asmErr, ok := err.(*ParseError); ok {
+		pe.Column = asmErr.Column
+		pe.Err = asmErr.Err
+	} else if err == ErrRedo {
+		pe.Err = fmt.Errorf("unresolved symbol: %w", err)
+	}
+	return pe
+}
+
+// AssembleLines assembles a block of newline separated instructions.
+// Blank lines, comments and directives are skipped, but labels
+// declared on their own line can be jumped to from anywhere in the
+// block. The settings and defines of p, which may be nil, are used
+// but p is not modified. Errors are reported as a *ParseError.
+func AssembleLines(code string, p *Program) ([]uint16, error) {
+	q := &Program{
+		Labels: make(map[string]uint16),
+	}
+	if p != nil {
+		q.Attr = p.Attr
+		q.Defines = p.Defines
+		for label, addr := range p.Labels {
+			q.Labels[label] = addr
 		}
 	}
-	if dec.flags&flagClrWaitIdxModeIndex != 0 {
-		but := ""
-		if clr := instr & (1 << 6); clr != 0 {
-			but = "clear "
-		} else if wait := instr & (1 << 5); wait != 0 {
-			but = "wait "
+	raw := strings.Split(code, "\n")
+	lines := append([]string(nil), raw...)
+	var todo []int
+	for i, line := range lines {
+		tokens, _ := tokenize(line)
+		if len(tokens) == 0 || (strings.HasPrefix(tokens[0], ".") && tokens[0] != ".word") {
+			continue
+		}
+		if len(tokens) == 2 && tokens[0] == "public" {
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 1 && strings.HasSuffix(tokens[0], ":") {
+			q.Labels[strings.TrimSuffix(tokens[0], ":")] = uint16(len(todo))
+			continue
 		}
-		idxmode := (instr >> 3) & 0b11
-		index := instr & 0b111
-		switch idxmode {
-		case 0b00:
-			decoded = append(decoded, fmt.Sprint(but, index))
-		case 0b01:
-			decoded = append(decoded, fmt.Sprint("prev ", but, index))
-		case 0b10:
-			decoded = append(decoded, fmt.Sprint(but, index, " rel"))
-		case 0b11:
-			decoded = append(decoded, fmt.Sprint("next ", but, index))
+		if label, _, rest, _, ok := leadingLabel(line); ok {
+			q.Labels[label] = uint16(len(todo))
+			lines[i] = rest
 		}
+		todo = append(todo, i)
 	}
-
-	sideMask := uint16(0b11111)
-	if p != nil && p.Attr.SideSet != 0 {
-		if p.Attr.SideSetOpt {
-			side := (instr & 0b0111100000000) >> (8 + 4 - p.Attr.SideSet)
-			if (instr & 0b1000000000000) != 0 {
-				decoded = append(decoded, fmt.Sprintf("\tside %d", side))
-			} else if side != 0 {
-				return fmt.Sprintf("invalid opt side-set <%04x>", instr), ErrBad
+	var words []uint16
+	for _, i := range todo {
+		q.pc = uint16(len(words))
+		instr, err := Assemble(lines[i], q)
+		if tokens, cols := tokenize(lines[i]); err == ErrDirective && len(tokens) == 2 && tokens[0] == ".word" {
+			if instr, err = parseWord(tokens[1]); err != nil {
+				return nil, parseErrorf(i, raw[i], cols[1], "%w", err)
 			}
-			sideMask = sideMask >> 1
-		} else {
-			side := (instr & 0b1111100000000) >> (8 + 5 - p.Attr.SideSet)
-			decoded = append(decoded, fmt.Sprintf("\tside %d", side))
 		}
-		sideMask = sideMask >> p.Attr.SideSet
-	}
-	if delay := (instr >> 8) & sideMask; delay != 0 {
-		decoded = append(decoded, fmt.Sprintf(" [%d]", delay))
+		if err != nil {
+			return nil, lineError(i, raw[i], err)
+		}
+		words = append(words, instr)
 	}
-	return strings.Join(decoded, ""), nil
+	return words, nil
 }
 
-// ErrRedo supports lazy symbol definitions (forward jumps).
-var ErrRedo = errors.New("redo later")
-
-// parseConst returns a positive integer less than or equal to 32,
-// either indirectly via the consts lookup, or because the supplied
-// token is an integer.
-func parseConst(token string, consts map[string]uint16) (uint16, error) {
-	if consts != nil {
-		if n, ok := consts[token]; ok {
-			return n, nil
-		}
+// Append assembles a single line of source and appends the result
+// to the Code of p. The line may instead declare a label at the
+// current end of the Code. Instructions that refer to labels not yet
+// defined are held until Finalize is called. Other directives are
+// not supported.
+func (p *Program) Append(line string) error {
+	if p.Labels == nil {
+		p.Labels = make(map[string]uint16)
 	}
-	n, err := strconv.Atoi(token)
-	if err != nil {
-		return 0, ErrRedo
+	p.pc = uint16(len(p.Code))
+	if label, public, rest, col, ok := leadingLabel(line); ok {
+		if err := p.defineLabel(label, public, p.pc); err != nil {
+			return parseErrorf(-1, line, col, "%v", err)
+		}
+		line = rest
 	}
-	if n > 32 || n < 0 {
-		return 0, ErrBad
+	instr, err := Assemble(line, p)
+	switch err {
+	case nil:
+	case ErrEmpty:
+		return nil
+	case ErrRedo:
+		if p.pending == nil {
+			p.pending = make(map[uint16]string)
+		}
+		p.pending[p.pc] = line
+	case ErrDirective:
+		tokens, cols := tokenize(line)
+		public := len(tokens) == 2 && tokens[0] == "public"
+		if public {
+			tokens, cols = tokens[1:], cols[1:]
+		}
+		label := strings.TrimSuffix(tokens[0], ":")
+		if label == tokens[0] {
+			return parseErrorf(-1, line, cols[0], "directive %q not supported", tokens[0])
+		}
+		if err := p.defineLabel(label, public, p.pc); err != nil {
+			return parseErrorf(-1, line, cols[0], "%v", err)
+		}
+		return nil
+	default:
+		return err
 	}
-	return uint16(n), err
+	p.Code = append(p.Code, instr)
+	return nil
 }
 
-var tokenizer = regexp.MustCompile("([, \r\t]+|//.*|;.*)")
+// Finalize completes a program built with Append. It assembles the
+// instructions that refer to labels defined after them, and updates
+// the Targets of p. An error is returned for any label that remains
+// undefined. Use SetWrap to set the wrap offsets of such a program.
+func (p *Program) Finalize() error {
+	offsets := make([]int, 0, len(p.pending))
+	for offset := range p.pending {
+		offsets = append(offsets, int(offset))
+	}
+	sort.Ints(offsets)
+	for _, offset := range offsets {
+		line := p.pending[uint16(offset)]
+		p.pc = uint16(offset)
+		instr, err := Assemble(line, p)
+		if err != nil {
+			return lineError(-1, line, err)
+		}
+		p.Code[offset] = instr
+		delete(p.pending, uint16(offset))
+	}
+	p.buildTargets()
+	return nil
+}
 
 // Assemble converts a string of assembly code into its uint16
 // representation. The parsing is more relaxed than the official
-// syntax.
+// syntax, and instruction mnemonics are not case sensitive. Use
+// AssembleWith to reject the relaxations. When the failure can be
+// attributed to a specific token, the returned error is a
+// *ParseError with its Column set.
 func Assemble(code string, p *Program) (uint16, error) {
-	tokens := tokenizer.Split(code, -1)
-	for i := 0; i < len(tokens); i++ {
-		if tokens[i] == "" {
-			tokens = append(tokens[:i], tokens[i+1:]...)
+	return AssembleWith(code, p, nil)
+}
+
+// MustAssemble is like Assemble, but panics if the code cannot be
+// assembled. It is intended for tests and for initializing package
+// variables with known-good code.
+func MustAssemble(code string, p *Program) uint16 {
+	instr, err := Assemble(code, p)
+	if err != nil {
+		panic(fmt.Sprintf("pious: Assemble(%q): %v", code, err))
+	}
+	return instr
+}
+
+// AssembleOptions holds the options for AssembleWith.
+type AssembleOptions struct {
+	// StrictSyntax rejects the relaxations of the official pioasm
+	// syntax that Assemble otherwise accepts, to catch code that
+	// the official tool will not compile. These are:
+	//
+	//   - a comma other than the optional one after the first
+	//     operand of in, out, mov and set, or after the condition
+	//     of jmp, as in "wait 1, gpio 3".
+	//   - a '#' comment. The official comments start with ';' or
+	//     "//".
+	//   - a relative jmp target, such as "jmp +2".
+	StrictSyntax bool
+}
+
+// AssembleWith assembles a line of code, as Assemble, according to
+// opts. A nil opts value selects the default options.
+func AssembleWith(code string, p *Program, opts *AssembleOptions) (_ uint16, err error) {
+	if opts == nil {
+		opts = &AssembleOptions{}
+	}
+	text := code
+	if loc := commentRE.FindStringIndex(code); loc != nil {
+		text = code[:loc[0]]
+		if opts.StrictSyntax && code[loc[0]] == '#' {
+			return 0, &ParseError{
+				Column:  loc[0] + 1,
+				RawLine: code,
+				Err:     fmt.Errorf("%w: '#' comment", ErrStrict),
+			}
+		}
+	}
+	for j, c := range text {
+		if c >= utf8.RuneSelf {
+			return 0, &ParseError{
+				Column:  j + 1,
+				RawLine: code,
+				Err:     fmt.Errorf("%w %q (%U) at byte offset %d", ErrNonASCII, c, c, j),
+			}
 		}
 	}
+	tokens, cols := tokenize(code)
 	if len(tokens) == 0 {
 		return 0, ErrEmpty
 	}
-	var labels map[string]uint16
+	if strings.HasPrefix(tokens[0], ".") {
+		return 0, ErrDirective
+	}
+	if last := tokens[len(tokens)-1]; strings.HasSuffix(last, ":") && (len(tokens) == 1 || (len(tokens) == 2 && tokens[0] == "public")) {
+		return 0, ErrDirective
+	}
+	k := 0
+	defer func() {
+		if err == nil || err == ErrRedo || k >= len(tokens) {
+			return
+		}
+		err = &ParseError{
+			Column:  cols[k],
+			RawLine: code,
+			Err:     err,
+		}
+	}()
+	var labels, defines map[string]uint16
 	if p != nil {
 		labels = p.Labels
+		defines = p.Defines
 	}
-	for i, dec := range instructions {
-		if tokens[0] != dec.token {
-			continue
-		}
+	for _, i := range mnemonics[strings.ToLower(tokens[0])] {
+		dec := instructions[i]
 		instr := dec.bits
 		if dec.flags == 0 && len(tokens) == 1 {
 			return instr, nil
 		}
-		if len(tokens) == 1 {
+		if len(tokens) == 1 && i != idxPUSH && i != idxPULL {
 			return 0, ErrBad
 		}
-		k := 1
+		k = 1
 		switch i {
 		case idxJMP:
-			for j, op := range disCondition {
-				if op == tokens[k] {
-					instr = instr | uint16(j<<5)
-					k++
-					break
+			// A condition keyword is only consumed when a target
+			// follows it, so a lone operand is always the target,
+			// even for a label named like a condition.
+			if j, ok := conditionIndex[tokens[k]]; ok && j != 0 && k+1 < len(tokens) {
+				instr = instr | uint16(j<<5)
+				k++
+			}
+			if tok := tokens[k]; tok[0] == '+' || tok[0] == '-' {
+				// A relative target, such as "+2" or "-1",
+				// is an offset from this instruction.
+				if opts.StrictSyntax {
+					return 0, fmt.Errorf("%w: relative jmp %s", ErrStrict, tok)
+				}
+				n, err := strconv.ParseInt(tok, 0, 8)
+				if err != nil {
+					return 0, ErrBad
+				}
+				if p == nil {
+					return 0, fmt.Errorf("relative jmp %s needs a program offset: %w", tok, ErrBad)
 				}
+				target := int64(p.pc) + n
+				if target < 0 || target > 31 {
+					return 0, fmt.Errorf("relative jmp %s from %d out of range: %w", tok, p.pc, ErrBad)
+				}
+				instr = instr | uint16(target)
+				k++
+				break
 			}
-			n, err := parseConst(tokens[k], labels)
+			n, err := parseConst(tokens[k], labels, defines)
 			if err != nil {
 				return 0, err
 			}
@@ -286,33 +503,29 @@ func Assemble(code string, p *Program) (uint16, error) {
 			if len(tokens) < 3 {
 				return 0, ErrBad
 			}
-			if n, err := parseConst(tokens[k], nil); err == nil {
+			if n, err := parseConst(tokens[k], defines); err == nil {
 				if n > 1 {
 					return 0, ErrBad
 				}
 				instr = instr | uint16(n<<7)
 				k++
+			} else if errors.Is(err, ErrNegative) {
+				return 0, err
 			}
 			if k >= len(tokens) {
 				return 0, ErrBad
 			}
-			found := false
-			src := 0
-			for i, bits := range disBitSource {
-				if bits == tokens[k] {
-					src = i
-					k++
-					found = true
-					break
-				}
+			src, found := bitSourceIndex[tokens[k]]
+			if found {
+				k++
 			}
-			if !found || k >= len(tokens) {
+			if !found || (k >= len(tokens) && src != 0b11) {
 				return 0, ErrBad
 			}
 			instr = instr | uint16(src<<5)
 			switch src {
 			case 0b00, 0b01:
-				n, err := parseConst(tokens[k], nil)
+				n, err := parseConst(tokens[k], defines)
 				if err != nil {
 					return 0, err
 				}
@@ -322,7 +535,7 @@ func Assemble(code string, p *Program) (uint16, error) {
 				k++
 				instr = instr | uint16(n)
 			case 0b10:
-				n, err := parseConst(tokens[k], nil)
+				n, err := parseConst(tokens[k], defines)
 				if err == nil {
 					if n > 7 {
 						return 0, ErrBad
@@ -335,6 +548,9 @@ func Assemble(code string, p *Program) (uint16, error) {
 					}
 					break
 				}
+				if errors.Is(err, ErrNegative) {
+					return 0, err
+				}
 				switch tokens[k] {
 				case "prev":
 					instr = instr | 0b01000
@@ -344,17 +560,27 @@ func Assemble(code string, p *Program) (uint16, error) {
 					return 0, ErrBad
 				}
 				k++
-				n, err = parseConst(tokens[k], nil)
-				if err != nil || n > 7 {
+				if k >= len(tokens) {
+					return 0, ErrBad
+				}
+				n, err = parseConst(tokens[k], defines)
+				if err != nil {
+					return 0, err
+				}
+				if n > 7 {
 					return 0, ErrBad
 				}
 				instr = instr | uint16(n)
 				k++
 			case 0b11:
-				if k+2 > len(tokens) || "+" != tokens[k] {
+				// The "+ N" pin offset is optional.
+				if k >= len(tokens) || "+" != tokens[k] {
+					break
+				}
+				if k+2 > len(tokens) {
 					return 0, ErrBad
 				}
-				n, err := parseConst(tokens[k+1], nil)
+				n, err := parseConst(tokens[k+1], defines)
 				if err != nil {
 					return 0, err
 				}
@@ -368,26 +594,20 @@ func Assemble(code string, p *Program) (uint16, error) {
 			if len(tokens) < 3 {
 				return 0, ErrBad
 			}
-			for j, src := range disISources {
-				if src == "" {
-					continue
-				}
-				if src == tokens[k] {
-					instr = instr | uint16(j<<5)
-					k++
-					if p != nil {
-						p.Attr.InPins = p.Attr.InPins || j == 0
-						if p.Attr.In == 0 {
-							p.Attr.In = 1
-						}
+			if j, ok := iSourceIndex[tokens[k]]; ok {
+				instr = instr | uint16(j<<5)
+				k++
+				if p != nil {
+					p.Attr.InPins = p.Attr.InPins || j == 0
+					if p.Attr.In == 0 {
+						p.Attr.In = 1
 					}
-					break
 				}
 			}
 			if k != 2 {
 				return 0, ErrBad
 			}
-			n, err := parseConst(tokens[k], labels)
+			n, err := parseConst(tokens[k], labels, defines)
 			if err != nil {
 				return 0, err
 			}
@@ -400,29 +620,30 @@ func Assemble(code string, p *Program) (uint16, error) {
 			if len(tokens) < 3 {
 				return 0, ErrBad
 			}
-			for j, src := range disDestinations {
-				if src == tokens[k] {
-					instr = instr | uint16(j<<5)
-					k++
-					if p != nil {
-						p.Attr.OutPins = p.Attr.OutPins || j == 0
-						if p.Attr.Out == 0 {
-							p.Attr.Out = 1
-						}
+			if j, ok := destinationIndex[tokens[k]]; ok {
+				instr = instr | uint16(j<<5)
+				k++
+				if p != nil {
+					p.Attr.OutPins = p.Attr.OutPins || j == 0
+					if p.Attr.Out == 0 {
+						p.Attr.Out = 1
 					}
-					break
 				}
 			}
 			if k != 2 {
 				return 0, ErrBad
 			}
-			n, err := parseConst(tokens[k], labels)
+			n, err := parseConst(tokens[k], labels, defines)
 			if err != nil {
 				return 0, err
 			}
 			if n == 0 {
 				return 0, ErrBad
 			}
+			// An executed instruction is 16 bits wide.
+			if instr>>5&0b111 == 7 && n != 16 {
+				return 0, fmt.Errorf("out exec requires a bit count of 16, not %d: %w", n, ErrBad)
+			}
 			instr = instr | uint16(n&0b11111)
 			k++
 		case idxNOP:
@@ -448,59 +669,51 @@ func Assemble(code string, p *Program) (uint16, error) {
 			if len(tokens) < 3 {
 				return 0, ErrBad
 			}
-			var fifo, detail string
+			var fifo, detail, want string
 			if strings.HasPrefix(tokens[k], "rxfifo[") {
-				fifo = tokens[k]
-				if detail = tokens[k+1]; detail != "isr" {
-					return 0, ErrBad
-				}
+				fifo, detail, want = tokens[k], tokens[k+1], "isr"
 			} else if strings.HasPrefix(tokens[k+1], "rxfifo[") {
-				fifo = tokens[k+1]
-				if detail = tokens[k]; detail != "osr" {
-					return 0, ErrBad
-				}
+				fifo, detail, want = tokens[k+1], tokens[k], "osr"
 				instr = instr | (1 << 7)
 			} else {
 				continue
 			}
-			k += 2
 			if fifo[len(fifo)-1] != ']' {
+				return 0, fmt.Errorf("%q needs a y or 0..3 index with no spaces: %w", fifo, ErrBad)
+			}
+			if detail != want {
 				return 0, ErrBad
 			}
 			offset := fifo[7 : len(fifo)-1]
 			if offset != "y" {
-				n, err := parseConst(offset, nil)
-				if err != nil || n > 7 {
-					return 0, ErrBad
+				n, err := parseConst(offset, defines)
+				if err != nil || n > 3 {
+					return 0, fmt.Errorf("rxfifo index %q not y or 0..3: %w", offset, ErrBad)
 				}
 				instr = instr | (1 << 3) | uint16(n)
 			}
+			k += 2
 		case idxMOV2:
 			if len(tokens) < 3 {
 				return 0, ErrBad
 			}
-			found := false
-			for i, dest := range disMDestinations {
-				if dest == tokens[k] {
-					instr = instr | uint16(i<<5)
-					found = true
-					k++
-					break
-				}
-			}
+			dest, found := mDestinationIndex[tokens[k]]
 			if !found {
 				continue
 			}
+			instr = instr | uint16(dest<<5)
+			k++
 			var src string
-			if tok := tokens[k]; strings.HasPrefix(tok, "!") {
-				instr = instr | (0b01 << 3)
-				src = tok[1:]
-				k++
-			} else if strings.HasPrefix(tok, "::") {
-				instr = instr | (0b10 << 3)
-				src = tok[2:]
-				k++
+			for _, op := range []MovOp{MovInvert, MovReverse} {
+				if prefix := op.String(); strings.HasPrefix(tokens[k], prefix) {
+					instr = instr | uint16(op<<3)
+					src = tokens[k][len(prefix):]
+					k++
+					break
+				}
 			}
+			// The operator may be separated from its source
+			// by whitespace.
 			if src == "" {
 				if k >= len(tokens) {
 					return 0, ErrBad
@@ -508,37 +721,41 @@ func Assemble(code string, p *Program) (uint16, error) {
 				src = tokens[k]
 				k++
 			}
-			found = false
-			for i, from := range disMSources {
-				if from == src {
-					instr = instr | uint16(i)
-					found = true
-					break
-				}
+			from, ok := mSourceIndex[src]
+			if !ok {
+				k--
+				return 0, fmt.Errorf("unknown mov source %q", src)
 			}
+			instr = instr | uint16(from)
 		case idxSET:
 			if len(tokens) < 3 {
 				return 0, ErrBad
 			}
-			found := false
-			for j, dest := range disDestinations {
-				if dest == tokens[k] {
-					instr = instr | uint16(j<<5)
-					k++
-					found = true
-					if p != nil && j == 0 /* pins */ && p.Attr.Set == 0 {
-						p.Attr.Set = 1
-					}
-					break
+			j, found := destinationIndex[tokens[k]]
+			if found {
+				// Only pins, x, y and pindirs are valid set
+				// destinations.
+				if j == 0b011 || j >= 0b101 {
+					return 0, fmt.Errorf("invalid set destination %q: %w", tokens[k], ErrBad)
+				}
+				instr = instr | uint16(j<<5)
+				k++
+				if p != nil && j == 0 /* pins */ && p.Attr.Set == 0 {
+					p.Attr.Set = 1
 				}
 			}
 			if !found || k >= len(tokens) {
 				return 0, ErrBad
 			}
-			n, err := parseConst(tokens[k], labels)
+			n, err := parseConst(tokens[k], labels, defines)
 			if err != nil {
 				return 0, err
 			}
+			// Unlike a bit count, the 5-bit data field
+			// cannot encode 32.
+			if n > 31 {
+				return 0, fmt.Errorf("set data %d exceeds 31: %w", n, ErrBad)
+			}
 			k++
 			instr = instr | uint16(n)
 		case idxIRQ:
@@ -557,20 +774,35 @@ func Assemble(code string, p *Program) (uint16, error) {
 			if k >= len(tokens) {
 				return 0, ErrBad
 			}
+			// The irq mode is one of "set" (or its alias
+			// "nowait"), which is the default, "clear" or
+			// "wait". The clear and wait modes are mutually
+			// exclusive: the hardware ignores the wait bit when
+			// the clear bit is set.
+			mode := ""
 			switch tokens[k] {
 			case "nowait", "set":
+				mode = tokens[k]
 				k++
 			case "clear":
 				instr = instr | 0b1000000
+				mode = tokens[k]
 				k++
 			case "wait":
 				instr = instr | 0b100000
+				mode = tokens[k]
 				k++
 			}
 			if k >= len(tokens) {
 				return 0, ErrBad
 			}
-			n, err := parseConst(tokens[k], nil)
+			switch tokens[k] {
+			case "nowait", "set", "clear", "wait":
+				if mode != "" {
+					return 0, fmt.Errorf("irq %s and %s are mutually exclusive: %w", mode, tokens[k], ErrBad)
+				}
+			}
+			n, err := parseConst(tokens[k], defines)
 			if err != nil {
 				return 0, err
 			}
@@ -591,25 +823,42 @@ func Assemble(code string, p *Program) (uint16, error) {
 			return 0, ErrBad
 		}
 
-		var sideVal uint16
-		sideMask := uint16(0b11111)
-		if p != nil && p.Attr.SideSet > 0 {
-			hasSide := k <= len(tokens)-2 && tokens[k] == "side"
-			if hasSide {
-				n, err := parseConst(tokens[k+1], nil)
+		// parse the side-set and delay values, which may be
+		// given in either order.
+		var sideVal, delay uint16
+		var hasSide, hasDelay bool
+		delayK := k
+		for k < len(tokens) {
+			if tok := tokens[k]; tok == "side" && p != nil && p.Attr.SideSet > 0 && k <= len(tokens)-2 {
+				if hasSide {
+					return 0, fmt.Errorf("duplicate side-set specifier: %w", ErrBad)
+				}
+				n, err := parseConst(tokens[k+1], defines)
 				if err != nil {
 					return 0, err
 				}
-				if limit := (uint16(1) << p.Attr.SideSet); n >= limit {
-					return 0, fmt.Errorf("too large for side-set %d bits needed", p.Attr.SideSet)
-				}
-				if p.Attr.SideSetOpt {
-					sideVal = 0b1000000000000 | (n << (8 + 4 - p.Attr.SideSet))
-				} else {
-					sideVal = n << (8 + 5 - p.Attr.SideSet)
+				if sideVal, err = EncodeSideSet(n, p.Attr); err != nil {
+					return 0, err
 				}
+				hasSide = true
 				k = k + 2
-			} else if !p.Attr.SideSetOpt {
+			} else if len(tok) >= 3 && tok[0] == '[' && tok[len(tok)-1] == ']' {
+				if hasDelay {
+					return 0, fmt.Errorf("duplicate delay specifier: %w", ErrBad)
+				}
+				n, err := parseConst(tok[1:len(tok)-1], defines)
+				if err != nil {
+					return 0, err
+				}
+				delay, hasDelay, delayK = n, true, k
+				k++
+			} else {
+				break
+			}
+		}
+		sideMask := uint16(0b11111)
+		if p != nil && p.Attr.SideSet > 0 {
+			if !hasSide && !p.Attr.SideSetOpt {
 				return 0, fmt.Errorf("omitted non-optional side-set %d bits needed", p.Attr.SideSet)
 			}
 			if p.Attr.SideSetOpt {
@@ -617,29 +866,62 @@ func Assemble(code string, p *Program) (uint16, error) {
 			}
 			sideMask = sideMask >> p.Attr.SideSet
 		}
-		// parse a delay value
-		if k != len(tokens) {
-			if delay := tokens[k]; len(delay) >= 3 && delay[0] == '[' && delay[len(delay)-1] == ']' {
-				n, err := parseConst(delay[1:len(delay)-1], nil)
-				if err != nil {
+		if delay&sideMask != delay {
+			k = delayK
+			reserved := 5 - bits.OnesCount16(sideMask)
+			return 0, fmt.Errorf("delay %d exceeds max %d with %d side-set bits: %w", delay, sideMask, reserved, ErrDelay)
+		}
+		instr = instr | sideVal | delay<<8
+		if k != 1 || k == len(tokens) {
+			if k != len(tokens) {
+				// unexpected trailing tokens, such as
+				// "rel" after a wait gpio or pin index.
+				return 0, ErrBad
+			}
+			if opts.StrictSyntax {
+				if k, err = strictCommas(text, tokens, cols, i, instr); err != nil {
 					return 0, err
 				}
-				if n&sideMask != n {
-					return 0, ErrBad
-				}
-				instr = instr | sideVal | uint16(n<<8)
-				k++
 			}
-		} else {
-			instr = instr | sideVal
-		}
-		if k != 1 {
+			if feature := rp2350Feature(instr); feature != "" && p != nil && p.Attr.Target == TargetRP2040 {
+				k = 0
+				return 0, fmt.Errorf("%w: %q uses %s, which the RP2040 lacks", ErrTarget, strings.Join(strings.Fields(text), " "), feature)
+			}
 			return instr, nil
 		}
 	}
 	return 0, ErrBad
 }
 
+// strictCommas checks that the tokens of text, assembled as the
+// instructions entry i into instr, are separated by commas only
+// where the pioasm grammar allows them: after the first operand of
+// in, out, mov and set, and after the condition of jmp. The comma is
+// optional there. On error, k is the index of the token that follows
+// the offending separator.
+func strictCommas(text string, tokens []string, cols []int, i int, instr uint16) (k int, err error) {
+	after := -1
+	switch i {
+	case idxIN, idxOUT, idxMOV1, idxMOV2, idxSET:
+		after = 1
+	case idxJMP:
+		if instr>>5&0b111 != 0 {
+			after = 1
+		}
+	}
+	for k = 1; k < len(tokens); k++ {
+		sep := text[cols[k-1]-1+len(tokens[k-1]) : cols[k]-1]
+		if k-1 != after && strings.Contains(sep, ",") {
+			return k, fmt.Errorf("%w: unexpected comma after %q", ErrStrict, tokens[k-1])
+		}
+	}
+	last := len(tokens) - 1
+	if strings.Contains(text[cols[last]-1+len(tokens[last]):], ",") {
+		return last, fmt.Errorf("%w: unexpected comma after %q", ErrStrict, tokens[last])
+	}
+	return 0, nil
+}
+
 // buildTargets computes the inverse label map for a program.
 func (p *Program) buildTargets() {
 	targets := make(map[uint16][]string)
@@ -654,33 +936,309 @@ func (p *Program) buildTargets() {
 	p.Targets = targets
 }
 
+// condition evaluates the expression of an .if directive. This is
+// either a single value, true when non-zero, or a comparison of two
+// values with one of ==, !=, <, <=, > or >=. A value is an integer,
+// a .define name, or pio_version for the .pio_version setting.
+func (p *Program) condition(tokens []string) (bool, error) {
+	value := func(token string) (int64, error) {
+		if n, ok := p.Defines[token]; ok {
+			return int64(n), nil
+		}
+		if token == "pio_version" {
+			return int64(p.Attr.PioVersion), nil
+		}
+		n, err := strconv.ParseInt(token, 0, 32)
+		if err != nil {
+			return 0, fmt.Errorf("unknown value %q", token)
+		}
+		return n, nil
+	}
+	switch len(tokens) {
+	case 1:
+		a, err := value(tokens[0])
+		return a != 0, err
+	case 3:
+		a, err := value(tokens[0])
+		if err != nil {
+			return false, err
+		}
+		b, err := value(tokens[2])
+		if err != nil {
+			return false, err
+		}
+		switch tokens[1] {
+		case "==":
+			return a == b, nil
+		case "!=":
+			return a != b, nil
+		case "<":
+			return a < b, nil
+		case "<=":
+			return a <= b, nil
+		case ">":
+			return a > b, nil
+		case ">=":
+			return a >= b, nil
+		}
+		return false, fmt.Errorf("unknown comparison %q", tokens[1])
+	}
+	return false, errors.New("syntax error")
+}
+
+// NewProgramOptions holds optional settings for NewProgramWith.
+type NewProgramOptions struct {
+	// Comments requests that source comments and blank lines be
+	// retained in the Comments and InlineComments of the program,
+	// so they are re-emitted by (*Program).Disassemble.
+	Comments bool
+
+	// Semicolons makes ';' separate statements on a line, as in
+	// "set x, 1; jmp loop", instead of starting a comment. A ';'
+	// within a parenthesized expression separates nothing. By
+	// default, code that follows a ';' comment is reported with
+	// Warn.
+	Semicolons bool
+
+	// Warn, if not nil, is called with each warning about the
+	// compiled program. For example, a program that leaves fewer
+	// than 4 of the 32 instruction slots free is reported.
+	Warn func(error)
+
+	// MaxInstructions, if not zero, is the number of instructions
+	// the compiled program may hold. A program exceeding it is an
+	// error.
+	MaxInstructions int
+
+	// StrictSyntax rejects instruction syntax that the official
+	// pioasm tool does not accept. See AssembleOptions.
+	StrictSyntax bool
+
+	// Target is the chip the program is assembled for. It sets
+	// the Target of the program Settings.
+	Target Target
+}
+
 // NewProgram compiles a PIO program from source. The source format is
 // intended to be compatible with that described in the [RP2350
 // Datasheet].
 func NewProgram(source string) (*Program, error) {
+	return NewProgramWith(source, nil)
+}
+
+// MustProgram is like NewProgram, but panics if the source cannot be
+// compiled. It is intended for tests and for initializing package
+// variables with known-good programs.
+func MustProgram(source string) *Program {
+	p, err := NewProgram(source)
+	if err != nil {
+		panic(fmt.Sprintf("pious: NewProgram: %v", err))
+	}
+	return p
+}
+
+// NewProgramWith compiles a PIO program from source, as NewProgram,
+// according to opts. A nil opts value selects the default options.
+func NewProgramWith(source string, opts *NewProgramOptions) (*Program, error) {
+	if opts == nil {
+		opts = &NewProgramOptions{}
+	}
 	lines := strings.Split(source, "\n")
-	var code []uint16
-	var program string
+	if !opts.Semicolons {
+		return newProgram(lines, opts)
+	}
+	// Compile the ';' separated statements as separate lines,
+	// and map the line numbers back to the source.
+	var split []string
+	var from []int
+	block := false
+	for i, line := range lines {
+		// The lines of a code block are not split.
+		if block || codeBlockRE.MatchString(line) {
+			block = !strings.HasPrefix(strings.TrimSpace(line), "%}")
+			split = append(split, line)
+			from = append(from, i)
+			continue
+		}
+		for _, part := range splitStatements(line) {
+			split = append(split, part)
+			from = append(from, i)
+		}
+	}
+	p, err := newProgram(split, opts)
+	var pe *ParseError
+	if errors.As(err, &pe) && pe.Line > 0 {
+		pe.Line = from[pe.Line-1] + 1
+		pe.Column = 0
+		pe.RawLine = lines[pe.Line-1]
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range p.lines {
+		p.lines[i] = from[n-1] + 1
+	}
+	if p.sideSetLine != 0 {
+		p.sideSetLine = from[p.sideSetLine-1] + 1
+	}
+	return p, nil
+}
+
+// splitStatements splits a line of source at each ';' that is
+// outside a parenthesized expression. A "//" or "#" comment is kept
+// with the last statement.
+func splitStatements(line string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for j := 0; j < len(line); j++ {
+		switch c := line[j]; {
+		case c == '#' || strings.HasPrefix(line[j:], "//"):
+			return append(parts, line[start:])
+		case c == '(':
+			depth++
+		case c == ')' && depth > 0:
+			depth--
+		case c == ';' && depth == 0:
+			parts = append(parts, line[start:j])
+			start = j + 1
+		}
+	}
+	return append(parts, line[start:])
+}
+
+// newProgram implements NewProgramWith for source split into lines.
+func newProgram(lines []string, opts *NewProgramOptions) (*Program, error) {
+	var code []uint16
+	var program string
+	var programLine int
 	wrap := uint16(0xffff)
 	wrapTarget := uint16(0xffff)
+	var wrapLine, wrapTargetLine int
 	p := &Program{
-		Labels: make(map[string]uint16),
+		Attr:    Settings{Target: opts.Target},
+		Labels:  make(map[string]uint16),
+		Defines: make(map[string]uint16),
+		Public:  make(map[string]bool),
 	}
 	redos := make(map[int]int)
+	words := make(map[int]int)
+	labeled := make(map[int]string)
+	defined := make(map[string]int)
+	var comments []string
+	if opts.Comments {
+		p.Comments = make(map[uint16][]string)
+		p.InlineComments = make(map[uint16]string)
+	}
+	// active holds, for each enclosing .if, whether its lines are
+	// being assembled.
+	var active []bool
+	var ifLine int
+	// block is the language of an open "% lang {" code block.
+	var block string
+	var blockLine int
 	for i, line := range lines {
-		instr, err := Assemble(line, p)
+		if block != "" {
+			if strings.HasPrefix(strings.TrimSpace(line), "%}") {
+				block = ""
+			} else if len(active) == 0 || active[len(active)-1] {
+				p.Attr.CodeBlocks[block] = append(p.Attr.CodeBlocks[block], line)
+			}
+			continue
+		}
+		if m := codeBlockRE.FindStringSubmatch(line); m != nil {
+			block, blockLine = m[1], i
+			if p.Attr.CodeBlocks == nil {
+				p.Attr.CodeBlocks = make(map[string][]string)
+			}
+			continue
+		}
+		if tokens, cols := tokenize(line); len(tokens) != 0 {
+			switch tokens[0] {
+			case ".if":
+				ok, err := p.condition(tokens[1:])
+				if err != nil {
+					return nil, parseErrorf(i, line, cols[0], "bad .if: %w", err)
+				}
+				if len(active) != 0 && !active[len(active)-1] {
+					ok = false
+				}
+				if len(active) == 0 {
+					ifLine = i
+				}
+				active = append(active, ok)
+				continue
+			case ".endif":
+				if len(active) == 0 {
+					return nil, parseErrorf(i, line, cols[0], ".endif without .if")
+				}
+				active = active[:len(active)-1]
+				continue
+			}
+		}
+		if len(active) != 0 && !active[len(active)-1] {
+			continue
+		}
+		p.pc = uint16(len(code))
+		comment := commentRE.FindString(line)
+		if opts.Warn != nil && strings.HasPrefix(comment, ";") {
+			q := *p
+			if _, err := Assemble(comment[1:], &q); err == nil || err == ErrRedo {
+				opts.Warn(parseErrorf(i, line, strings.Index(line, comment)+1, "code after ';' is a comment"))
+			}
+		}
+		text := line
+		if label, public, rest, col, ok := leadingLabel(line); ok {
+			if err := p.defineLabel(label, public, uint16(len(code))); err != nil {
+				return nil, parseErrorf(i, line, col, "%v", err)
+			}
+			text = rest
+			labeled[i] = rest
+		}
+		instr, err := AssembleWith(text, p, &AssembleOptions{StrictSyntax: opts.StrictSyntax})
+		isWord := false
+		if tokens, cols := tokenize(text); err == ErrDirective && tokens[0] == ".word" {
+			if len(tokens) != 2 {
+				return nil, parseErrorf(i, line, 0, "syntax error for .word")
+			}
+			if instr, err = parseWord(tokens[1]); err != nil {
+				return nil, parseErrorf(i, line, cols[1], "%w", err)
+			}
+			isWord = true
+		}
 		if err == nil || err == ErrRedo {
-			redos[i] = len(code)
+			if opts.Comments {
+				if comments != nil {
+					p.Comments[uint16(len(code))] = comments
+					comments = nil
+				}
+				if comment != "" {
+					p.InlineComments[uint16(len(code))] = comment
+				}
+			}
+			if isWord {
+				words[i] = len(code)
+			} else {
+				redos[i] = len(code)
+			}
 			code = append(code, instr)
 			continue
 		}
-		// not a known instruction, so interpret it as
-		// something else.
-		tokens := tokenizer.Split(line, -1)
-		for i := 0; i < len(tokens); i++ {
-			if tokens[i] == "" {
-				tokens = append(tokens[:i], tokens[i+1:]...)
+		tokens, cols := tokenize(text)
+		if errors.Is(err, ErrNonASCII) || errors.Is(err, ErrStrict) {
+			return nil, lineError(i, line, err)
+		}
+		if err != ErrDirective && err != ErrEmpty {
+			if _, known := mnemonics[strings.ToLower(tokens[0])]; known {
+				pe := lineError(i, line, err)
+				pe.Err = fmt.Errorf("bad %s instruction: %w", tokens[0], pe.Err)
+				return nil, pe
 			}
+			return nil, parseErrorf(i, line, cols[0], "%w %q", ErrBad, tokens[0])
+		}
+		// not an instruction, so interpret it as a directive or
+		// label.
+		if opts.Comments && (comment != "" || (len(tokens) == 0 && (len(code) != 0 || comments != nil))) {
+			comments = append(comments, comment)
 		}
 		if len(tokens) == 0 {
 			continue
@@ -688,73 +1246,222 @@ func NewProgram(source string) (*Program, error) {
 		switch tokens[0] {
 		case ".program":
 			if len(tokens) != 2 {
-				return nil, fmt.Errorf("failed to parse line %d: %q", i, line)
+				return nil, parseErrorf(i, line, 0, "failed to parse .program")
+			}
+			if programLine != 0 {
+				return nil, parseErrorf(i, line, cols[0], "second .program %q after %q of line %d (see ParseFile)", tokens[1], p.Attr.Name, programLine)
+			}
+			name := tokens[1]
+			for j, c := range name {
+				if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (j != 0 && c >= '0' && c <= '9') {
+					continue
+				}
+				return nil, parseErrorf(i, line, cols[1]+j, "invalid character %q in .program name %q", c, name)
 			}
-			p.Attr.Name = tokens[1]
+			programLine = i + 1
+			p.Attr.Name = name
 		case ".wrap":
-			if len(tokens) != 1 || wrap != uint16(0xffff) {
-				return nil, fmt.Errorf("bad wrap line %d: %q", i, line)
+			switch {
+			case len(tokens) != 1:
+				return nil, parseErrorf(i, line, cols[1], ".wrap takes no arguments")
+			case wrap != uint16(0xffff):
+				return nil, parseErrorf(i, line, cols[0], "second .wrap (first at line %d)", wrapLine+1)
+			case len(code) == 0:
+				return nil, parseErrorf(i, line, cols[0], ".wrap before any instruction")
 			}
 			wrap = uint16(len(code)) - 1
+			wrapLine = i
 		case ".wrap_target":
-			if len(tokens) != 1 || wrapTarget != uint16(0xffff) {
-				return nil, fmt.Errorf("bad wrap line %d: %q", i, line)
+			switch {
+			case len(tokens) != 1:
+				return nil, parseErrorf(i, line, cols[1], ".wrap_target takes no arguments")
+			case wrapTarget != uint16(0xffff):
+				return nil, parseErrorf(i, line, cols[0], "second .wrap_target (first at line %d)", wrapTargetLine+1)
 			}
 			wrapTarget = uint16(len(code))
+			wrapTargetLine = i
+		case ".define":
+			if len(tokens) != 3 {
+				return nil, parseErrorf(i, line, 0, "syntax error for .define")
+			}
+			name := tokens[1]
+			if _, hit := p.Defines[name]; hit {
+				return nil, parseErrorf(i, line, cols[1], "redefinition of %q (line %d)", name, defined[name]+1)
+			}
+			value, ok := p.Defines[tokens[2]]
+			if !ok && strings.HasPrefix(tokens[2], "(") {
+				n, err := evalExpr(tokens[2], p.Defines)
+				switch {
+				case err == ErrRedo:
+					return nil, parseErrorf(i, line, cols[2], "bad .define value: undefined symbol in %q", tokens[2])
+				case err != nil:
+					return nil, parseErrorf(i, line, cols[2], "bad .define value: %w", err)
+				case n < 0:
+					return nil, parseErrorf(i, line, cols[2], "bad .define value: %w, got %d", ErrNegative, n)
+				case n > 0xffff:
+					return nil, parseErrorf(i, line, cols[2], "bad .define value: %d out of range", n)
+				}
+				value, ok = uint16(n), true
+			}
+			if !ok {
+				if strings.HasPrefix(tokens[2], "-") {
+					return nil, parseErrorf(i, line, cols[2], "bad .define value: %w", ErrNegative)
+				}
+				n, err := strconv.ParseUint(tokens[2], 0, 16)
+				if err != nil {
+					return nil, parseErrorf(i, line, cols[2], "bad .define value: %w", err)
+				}
+				value = uint16(n)
+			}
+			p.Defines[name] = value
+			defined[name] = i
+		case ".pio_version":
+			if len(tokens) != 2 || len(code) != 0 {
+				return nil, parseErrorf(i, line, 0, "too late to set .pio_version")
+			}
+			v, err := strconv.ParseUint(tokens[1], 0, 16)
+			if err != nil || v > 1 {
+				return nil, parseErrorf(i, line, cols[1], "unsupported .pio_version (0 or 1)")
+			}
+			if v > 0 && p.Attr.Target == TargetRP2040 {
+				return nil, parseErrorf(i, line, cols[1], "%w: .pio_version %d is for the RP2350", ErrTarget, v)
+			}
+			p.Attr.PioVersion = uint16(v)
+		case ".lang_opt":
+			if len(tokens) < 3 {
+				return nil, parseErrorf(i, line, 0, ".lang_opt requires a language and option")
+			}
+			lang, key := tokens[1], tokens[2]
+			rest := tokens[3:]
+			if len(rest) != 0 && rest[0] == "=" {
+				rest = rest[1:]
+			}
+			if p.Attr.LangOpts == nil {
+				p.Attr.LangOpts = make(map[string]map[string]string)
+			}
+			if p.Attr.LangOpts[lang] == nil {
+				p.Attr.LangOpts[lang] = make(map[string]string)
+			}
+			p.Attr.LangOpts[lang][key] = strings.Join(rest, " ")
+		case ".fifo":
+			if len(tokens) != 2 {
+				return nil, parseErrorf(i, line, 0, "syntax error for .fifo")
+			}
+			if len(code) != 0 {
+				return nil, parseErrorf(i, line, 0, "too late to set .fifo")
+			}
+			mode := FifoMode(len(disFifoModes))
+			for j, name := range disFifoModes {
+				if tokens[1] == name {
+					mode = FifoMode(j)
+				}
+			}
+			if mode == FifoMode(len(disFifoModes)) {
+				return nil, parseErrorf(i, line, cols[1], "unknown .fifo mode %q", tokens[1])
+			}
+			if mode >= FifoTxPut && p.Attr.PioVersion < 1 {
+				return nil, parseErrorf(i, line, cols[1], ".fifo %s requires .pio_version 1", tokens[1])
+			}
+			p.Attr.FifoMode = mode
+		case ".clock_div":
+			if len(tokens) != 2 {
+				return nil, parseErrorf(i, line, 0, "syntax error for .clock_div")
+			}
+			div, err := strconv.ParseFloat(tokens[1], 64)
+			if err != nil || div < 1 || div > 65536 {
+				return nil, parseErrorf(i, line, cols[1], "bad .clock_div value (1 to 65536)")
+			}
+			p.Attr.ClockDiv = div
+		case ".jmp_pin":
+			if len(tokens) != 2 {
+				return nil, parseErrorf(i, line, 0, "syntax error for .jmp_pin")
+			}
+			pin, err := parseConst(tokens[1], p.Defines)
+			if err != nil || pin > 31 {
+				return nil, parseErrorf(i, line, cols[1], "bad .jmp_pin value (0 to 31)")
+			}
+			p.Attr.JmpPin = pin
+			p.Attr.HasJmpPin = true
+		case ".mov_status":
+			if len(code) != 0 {
+				return nil, parseErrorf(i, line, 0, "too late to set .mov_status")
+			}
+			var sel MovStatus
+			var at int
+			switch {
+			case len(tokens) == 4 && tokens[1] == "txfifo" && tokens[2] == "<":
+				sel, at = StatusTxLess, 3
+			case len(tokens) == 4 && tokens[1] == "rxfifo" && tokens[2] == "<":
+				sel, at = StatusRxLess, 3
+			case len(tokens) == 4 && tokens[1] == "irq" && tokens[2] == "set":
+				if p.Attr.PioVersion < 1 {
+					return nil, parseErrorf(i, line, cols[1], ".mov_status irq requires .pio_version 1")
+				}
+				sel, at = StatusIRQ, 3
+			default:
+				return nil, parseErrorf(i, line, 0, "syntax error for .mov_status")
+			}
+			n, err := parseConst(tokens[at], p.Defines)
+			if err != nil || (sel == StatusIRQ && n > 7) || n > 31 {
+				return nil, parseErrorf(i, line, cols[at], "bad .mov_status value")
+			}
+			p.Attr.MovStatusSel = sel
+			p.Attr.MovStatusN = n
 		case ".origin":
 			if len(tokens) != 1 {
-				return nil, fmt.Errorf("syntax error for .origin at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, 0, "syntax error for .origin")
 			}
 			p.Attr.Origin = uint16(len(code))
 		case ".side_set":
 			if len(tokens) < 2 || len(code) != 0 {
-				return nil, fmt.Errorf("too late to set side_set line %d: %q", i, line)
+				return nil, parseErrorf(i, line, 0, "too late to set side_set")
 			}
-			p.Attr.SideSet, err = parseConst(tokens[1], nil)
+			p.sideSetLine = i + 1
+			p.Attr.SideSet, err = parseConst(tokens[1], p.Defines)
 			if err != nil {
-				return nil, fmt.Errorf("bad side_set value line %d: %q: %v", i, line, err)
+				return nil, parseErrorf(i, line, cols[1], "bad side_set value: %w", err)
 			}
 			k := 2
 			if len(tokens) > k && tokens[k] == "opt" {
 				p.Attr.SideSetOpt = true
 				if p.Attr.SideSet > 4 {
-					return nil, fmt.Errorf("max optional side_set value is 4, got %d at line %d: %q", p.Attr.SideSet, i, line)
+					return nil, parseErrorf(i, line, cols[1], "max optional side_set value is 4, got %d", p.Attr.SideSet)
 				}
 				k++
 			} else if p.Attr.SideSet > 5 {
-				return nil, fmt.Errorf("max side_set value is 5, got %d at line %d: %q", p.Attr.SideSet, i, line)
+				return nil, parseErrorf(i, line, cols[1], "max side_set value is 5, got %d", p.Attr.SideSet)
 			}
 			if len(tokens) == k {
 				break
 			}
 			if tokens[k] != "pindirs" {
-				return nil, fmt.Errorf("no pindirs at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, cols[k], "no pindirs")
 			}
 			if len(tokens) > k+1 {
-				return nil, fmt.Errorf("syntax error at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, cols[k+1], "syntax error")
 			}
 			p.Attr.SideSetPindirs = true
 		case ".set":
 			if len(tokens) != 2 || len(code) != 0 {
-				return nil, fmt.Errorf("too late to set count line %d: %q", i, line)
+				return nil, parseErrorf(i, line, 0, "too late to set count")
 			}
-			p.Attr.Set, err = parseConst(tokens[1], nil)
+			p.Attr.Set, err = parseConst(tokens[1], p.Defines)
 			if err != nil {
-				return nil, fmt.Errorf("bad set value line %d: %q: %v", i, line, err)
+				return nil, parseErrorf(i, line, cols[1], "bad set value: %w", err)
 			}
 			if p.Attr.Set > 5 {
-				return nil, fmt.Errorf("max set value is 5, got %d at line %d: %q", p.Attr.Set, i, line)
+				return nil, parseErrorf(i, line, cols[1], "max set value is 5, got %d", p.Attr.Set)
 			}
 		case ".out":
 			if len(code) != 0 {
-				return nil, fmt.Errorf("too late to .out at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, 0, "too late to .out")
 			}
 			if len(tokens) < 2 {
-				return nil, fmt.Errorf(".out requires a pin value at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, 0, ".out requires a pin value")
 			}
-			p.Attr.Out, err = parseConst(tokens[1], nil)
+			p.Attr.Out, err = parseConst(tokens[1], p.Defines)
 			if err != nil || p.Attr.Out == 0 {
-				return nil, fmt.Errorf(".out requires bit count > 0 and <= 32 at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, cols[1], ".out requires bit count > 0 and <= 32")
 			}
 			k := 2
 			if len(tokens) > k {
@@ -769,34 +1476,34 @@ func NewProgram(source string) (*Program, error) {
 				break
 			}
 			if tokens[k] != "auto" {
-				return nil, fmt.Errorf("expecting \"auto\" at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, cols[k], "expecting \"auto\"")
 			}
 			p.Attr.OutAuto = true
 			k++
 			if k == len(tokens) {
 				break
 			}
-			p.Attr.OutThreshold, err = parseConst(tokens[k], nil)
+			p.Attr.OutThreshold, err = parseConst(tokens[k], p.Defines)
 			if err != nil || p.Attr.OutThreshold == 0 {
-				return nil, fmt.Errorf("expecting threshold in range (0,32] at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, cols[k], "expecting threshold in range (0,32]")
 			}
 			if p.Attr.OutThreshold == 32 {
 				p.Attr.OutThreshold = 0
 			}
 			k++
 			if k != len(tokens) {
-				return nil, fmt.Errorf(".out syntax error at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, cols[k], ".out syntax error")
 			}
 		case ".in":
 			if len(code) != 0 {
-				return nil, fmt.Errorf("too late to .in at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, 0, "too late to .in")
 			}
 			if len(tokens) < 2 {
-				return nil, fmt.Errorf(".in requires a pin value at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, 0, ".in requires a pin value")
 			}
-			p.Attr.In, err = parseConst(tokens[1], nil)
+			p.Attr.In, err = parseConst(tokens[1], p.Defines)
 			if err != nil || p.Attr.In == 0 {
-				return nil, fmt.Errorf(".in requires bit count > 0 and <= 32 at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, cols[1], ".in requires bit count > 0 and <= 32")
 			}
 			k := 2
 			if len(tokens) > k {
@@ -811,52 +1518,93 @@ func NewProgram(source string) (*Program, error) {
 				break
 			}
 			if tokens[k] != "auto" {
-				return nil, fmt.Errorf("expecting \"auto\" at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, cols[k], "expecting \"auto\"")
 			}
 			p.Attr.InAuto = true
 			k++
 			if k == len(tokens) {
 				break
 			}
-			p.Attr.InThreshold, err = parseConst(tokens[k], nil)
+			p.Attr.InThreshold, err = parseConst(tokens[k], p.Defines)
 			if err != nil || p.Attr.InThreshold == 0 {
-				return nil, fmt.Errorf("expecting threshold in range (0,32] at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, cols[k], "expecting threshold in range (0,32]")
 			}
 			if p.Attr.InThreshold == 32 {
 				p.Attr.InThreshold = 0
 			}
 			k++
 			if k != len(tokens) {
-				return nil, fmt.Errorf(".in syntax error at line %d: %q", i, line)
+				return nil, parseErrorf(i, line, cols[k], ".in syntax error")
 			}
 		default:
 			if len(tokens) == 0 || tokens[0] == "" {
 				continue
 			}
-			if len(tokens) != 1 || !strings.HasSuffix(tokens[0], ":") {
-				return nil, fmt.Errorf("unable to parse line %d: %q as %v", i, line, tokens)
+			if strings.HasPrefix(tokens[0], ".") {
+				return nil, parseErrorf(i, line, cols[0], "unknown directive %q", tokens[0])
+			}
+			public := len(tokens) == 2 && tokens[0] == "public"
+			if public {
+				tokens, cols = tokens[1:], cols[1:]
 			}
 			label := tokens[0]
 			label = label[:len(label)-1]
-			if label == "" {
-				return nil, fmt.Errorf("missing label line %d: %q", i, line)
+			if err := p.defineLabel(label, public, uint16(len(code))); err != nil {
+				return nil, parseErrorf(i, line, cols[0], "%v", err)
 			}
-			if value, hit := p.Labels[label]; hit {
-				return nil, fmt.Errorf("duplicate label %q declared at line %d of value %d", label, i, value)
-			}
-			p.Labels[label] = uint16(len(code))
 		}
 	}
 	for i, offset := range redos {
-		instr, err := Assemble(lines[i], p)
+		tokens, cols := tokenize(lines[i])
+		for j, tok := range tokens {
+			if at, ok := defined[tok]; ok && at > i {
+				return nil, parseErrorf(i, lines[i], cols[j], "%q used before its .define (line %d)", tok, at+1)
+			}
+		}
+		p.pc = uint16(offset)
+		text, ok := labeled[i]
+		if !ok {
+			text = lines[i]
+		}
+		instr, err := AssembleWith(text, p, &AssembleOptions{StrictSyntax: opts.StrictSyntax})
 		if err != nil {
-			return nil, fmt.Errorf("unable to resolve: %q: %v", lines[i], err)
+			return nil, lineError(i, lines[i], err)
+		}
+		if v := PioVersion(instr); v > p.Attr.PioVersion {
+			return nil, parseErrorf(i, lines[i], 0, "instruction requires .pio_version %d", v)
 		}
 		code[offset] = instr
 	}
+	if block != "" {
+		return nil, parseErrorf(blockLine, lines[blockLine], 0, "unterminated %% %s block", block)
+	}
+	if len(active) != 0 {
+		return nil, parseErrorf(ifLine, lines[ifLine], 0, ".if without .endif")
+	}
+	for len(comments) != 0 && comments[len(comments)-1] == "" {
+		comments = comments[:len(comments)-1]
+	}
+	if len(comments) != 0 {
+		p.Comments[uint16(len(code))] = comments
+	}
+	p.lines = make([]int, len(code))
+	for i, offset := range redos {
+		p.lines[offset] = i + 1
+	}
+	for i, offset := range words {
+		p.lines[offset] = i + 1
+	}
 	if program == "" {
 		program = "unknown"
 	}
+	if wrapTarget != uint16(0xffff) {
+		if int(wrapTarget) == len(code) {
+			return nil, parseErrorf(wrapTargetLine, lines[wrapTargetLine], 0, ".wrap_target at offset %d has no instruction after it", wrapTarget)
+		}
+		if wrap != uint16(0xffff) && wrapTarget > wrap {
+			return nil, parseErrorf(wrapTargetLine, lines[wrapTargetLine], 0, ".wrap_target at offset %d follows .wrap at offset %d (line %d)", wrapTarget, wrap, wrapLine+1)
+		}
+	}
 	if wrap == uint16(0xffff) {
 		wrap = uint16(len(code))
 	}
@@ -867,18 +1615,358 @@ func NewProgram(source string) (*Program, error) {
 	p.Attr.Wrap = wrap
 	p.Attr.WrapTarget = wrapTarget
 	p.Code = code
+	if limit := opts.MaxInstructions; limit != 0 && len(code) > limit {
+		return nil, fmt.Errorf("code for %q too long: %d > %d", p.Attr.Name, len(code), limit)
+	}
+	if u := p.MemoryUsage(); opts.Warn != nil && u.Free < 4 {
+		opts.Warn(fmt.Errorf("program %q nearly fills memory: %v", p.Attr.Name, u))
+	}
 	return p, nil
 }
 
+// AssembleAll compiles a PIO program from source, as NewProgram,
+// but instead of stopping at the first error it reports every line
+// that fails to compile. A failing instruction line is replaced by a
+// placeholder .word 0 instruction, keeping any label it declares,
+// and any other failing line is ignored, before the source is
+// compiled again. The errors are returned in line order, and the
+// returned Program is the best-effort result, which is nil if an
+// error could not be attributed to a line.
+func AssembleAll(source string) (*Program, []ParseError) {
+	lines := strings.Split(source, "\n")
+	var errs []ParseError
+	replaced := make(map[int]bool)
+	for {
+		p, err := newProgram(lines, &NewProgramOptions{})
+		if err == nil {
+			sort.SliceStable(errs, func(a, b int) bool { return errs[a].Line < errs[b].Line })
+			return p, errs
+		}
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			pe = &ParseError{Err: err}
+		}
+		i := pe.Line - 1
+		if i < 0 || i >= len(lines) || lines[i] == "" {
+			return nil, append(errs, *pe)
+		}
+		if !replaced[i] {
+			errs = append(errs, *pe)
+		}
+		text, prefix := lines[i], ""
+		if label, public, rest, _, ok := leadingLabel(text); ok {
+			text, prefix = rest, label+": "
+			if public {
+				prefix = "public " + prefix
+			}
+		}
+		tokens, _ := tokenize(text)
+		if replaced[i] || len(tokens) == 0 || strings.HasPrefix(tokens[0], ".") || strings.HasSuffix(tokens[len(tokens)-1], ":") || codeBlockRE.MatchString(text) {
+			lines[i] = ""
+		} else {
+			lines[i] = prefix + ".word 0"
+		}
+		replaced[i] = true
+	}
+}
+
+// ParseFile compiles all of the PIO programs found in source. Each
+// program starts with a .program directive and its labels are scoped
+// to that program. Any lines preceding the first .program directive
+// are compiled as part of the first program, and the global .define,
+// .if and .endif directives among them also apply to the programs
+// that follow.
+func ParseFile(source string) ([]*Program, error) {
+	lines := strings.Split(source, "\n")
+	var starts []int
+	for i, line := range lines {
+		if tokens, _ := tokenize(line); len(tokens) != 0 && tokens[0] == ".program" {
+			starts = append(starts, i)
+		}
+	}
+	if len(starts) == 0 {
+		p, err := NewProgram(source)
+		if err != nil {
+			return nil, err
+		}
+		return []*Program{p}, nil
+	}
+	// The global directives are kept in place, so the line
+	// numbers of the preamble need no adjustment.
+	var globals []string
+	for _, line := range lines[:starts[0]] {
+		if tokens, _ := tokenize(line); len(tokens) != 0 && (tokens[0] == ".define" || tokens[0] == ".if" || tokens[0] == ".endif") {
+			globals = append(globals, line)
+		} else {
+			globals = append(globals, "")
+		}
+	}
+	starts[0] = 0
+	var ps []*Program
+	for j, start := range starts {
+		end := len(lines)
+		if j+1 < len(starts) {
+			end = starts[j+1]
+		}
+		var preamble []string
+		if j != 0 {
+			preamble = globals
+		}
+		// at maps a 1-based line number of the compiled source
+		// to that of source.
+		at := func(n int) int {
+			if n > len(preamble) {
+				return n - len(preamble) + start
+			}
+			return n
+		}
+		p, err := NewProgram(strings.Join(append(append([]string(nil), preamble...), lines[start:end]...), "\n"))
+		if err != nil {
+			var pe *ParseError
+			if errors.As(err, &pe) {
+				pe.Line = at(pe.Line)
+			}
+			return nil, err
+		}
+		for i := range p.lines {
+			p.lines[i] = at(p.lines[i])
+		}
+		if p.sideSetLine != 0 {
+			p.sideSetLine = at(p.sideSetLine)
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+// fileError tags err with a source file name when it is a
+// *ParseError.
+func fileError(name string, err error) error {
+	var pe *ParseError
+	if errors.As(err, &pe) {
+		pe.File = name
+	}
+	return err
+}
+
+// NewProgramFromReader compiles a PIO program read from r. The name
+// identifies the source, and is recorded in the File field of any
+// returned *ParseError.
+func NewProgramFromReader(name string, r io.Reader) (*Program, error) {
+	source, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p, err := NewProgram(string(source))
+	return p, fileError(name, err)
+}
+
+// ParseReader compiles all of the PIO programs read from r, in the
+// manner of ParseFile. The name identifies the source, and is
+// recorded in the File field of any returned *ParseError.
+func ParseReader(name string, r io.Reader) ([]*Program, error) {
+	source, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	ps, err := ParseFile(string(source))
+	return ps, fileError(name, err)
+}
+
+// labelLines returns the source lines declaring the labels of the
+// instruction offset, addr.
+func (p *Program) labelLines(addr uint16) []string {
+	var lines []string
+	for _, sym := range p.Targets[addr] {
+		if p.Public[sym] {
+			lines = append(lines, fmt.Sprintf("public %s:", sym))
+		} else {
+			lines = append(lines, fmt.Sprintf("%s:", sym))
+		}
+	}
+	return lines
+}
+
+// Label is a named instruction offset.
+type Label struct {
+	Name string
+	Addr uint16
+}
+
+// SortedLabels returns the Labels of a program ordered by offset,
+// and then by name. Unlike iteration over the Labels map, this order
+// is deterministic.
+func (p *Program) SortedLabels() []Label {
+	labels := make([]Label, 0, len(p.Labels))
+	for name, addr := range p.Labels {
+		labels = append(labels, Label{Name: name, Addr: addr})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].Addr != labels[j].Addr {
+			return labels[i].Addr < labels[j].Addr
+		}
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+// LabelRef holds the cross-reference details of a label.
+type LabelRef struct {
+	// Def is the instruction offset of the label.
+	Def uint16
+
+	// Uses holds the offsets of the jmp instructions that target
+	// the label, in increasing order.
+	Uses []uint16
+}
+
+// XRef returns the cross-reference details of every label of a
+// program. Labels that are never jumped to have an empty Uses slice.
+func (p *Program) XRef() map[string]LabelRef {
+	refs := make(map[string]LabelRef)
+	for label, addr := range p.Labels {
+		refs[label] = LabelRef{Def: addr, Uses: []uint16{}}
+	}
+	ins := instructions[idxJMP]
+	for i, code := range p.Code {
+		if code&ins.mask != ins.bits {
+			continue
+		}
+		for _, label := range p.Targets[code&0b11111] {
+			ref := refs[label]
+			ref.Uses = append(ref.Uses, uint16(i))
+			refs[label] = ref
+		}
+	}
+	return refs
+}
+
+// moduleAt returns a Program for disassembling the instruction at
+// offset pc of p. For combined programs this has the Settings of the
+// sub-program (module) containing pc, so the per-module side-set
+// width is used. Offsets outside any module use p itself.
+func (p *Program) moduleAt(pc uint16) *Program {
+	var start uint16
+	for _, m := range p.Modules {
+		if pc >= start && pc < start+m.Length {
+			return &Program{
+				Attr:    m,
+				Labels:  p.Labels,
+				Defines: p.Defines,
+				Targets: p.Targets,
+			}
+		}
+		start += m.Length
+	}
+	return p
+}
+
+// modules returns the Modules of a combined program. For other
+// programs, it returns a single module of the whole Code with the
+// Attr settings.
+func (p *Program) modules() []Settings {
+	if p.Modules != nil {
+		return p.Modules
+	}
+	m := p.Attr
+	m.Length = uint16(len(p.Code))
+	return []Settings{m}
+}
+
+// moduleNames returns the symbol name of each module of p. The
+// modules of a combined program are numbered, as their labels are,
+// since Cat can combine a program with itself.
+func (p *Program) moduleNames() []string {
+	var names []string
+	for j, m := range p.modules() {
+		if p.Modules != nil {
+			names = append(names, fmt.Sprint(m.Name, j))
+		} else {
+			names = append(names, m.Name)
+		}
+	}
+	return names
+}
+
+// lastWraps returns the offset of the last instruction of the
+// wrapped loop of each module of p. A Wrap value at the end of a
+// module, the default when its source has no .wrap directive, refers
+// to the last instruction of that module.
+func (p *Program) lastWraps() []uint16 {
+	var wraps []uint16
+	var start uint16
+	for _, m := range p.modules() {
+		wrap := m.Wrap
+		if m.Length != 0 && wrap == start+m.Length {
+			wrap--
+		}
+		wraps = append(wraps, wrap)
+		start += m.Length
+	}
+	return wraps
+}
+
+// wrapAt returns the offset of the last instruction of the wrapped
+// loop, and the wrap target, of the module of p holding pc.
+func (p *Program) wrapAt(pc uint16) (wrap, target uint16) {
+	wraps := p.lastWraps()
+	var start uint16
+	for i, m := range p.modules() {
+		if pc < start+m.Length || i == len(wraps)-1 {
+			return wraps[i], m.WrapTarget
+		}
+		start += m.Length
+	}
+	return p.Attr.Wrap, p.Attr.WrapTarget
+}
+
 // Disassemble disassembles a whole program, p, into a slice of string lines.
 func (p *Program) Disassemble() []string {
+	return p.DisassembleWith(&DisassembleOptions{Indent: "\t"})
+}
+
+// DisassembleWith disassembles a whole program, p, into a slice of
+// string lines formatted according to opts. A combined program, from
+// Cat, is listed as a sequence of its modules, each with its own
+// .program and settings directives. ParseFile can recompile such a
+// listing into the programs that Cat combined.
+func (p *Program) DisassembleWith(opts *DisassembleOptions) []string {
+	if p.Modules != nil {
+		var listing []string
+		o := *opts
+		image := p.Image()
+		var start int
+		for i, q := range p.split() {
+			if i != 0 {
+				listing = append(listing, "")
+			}
+			o.pc, o.words = p.base+uint16(start), image[start:start+len(q.Code)]
+			listing = append(listing, q.DisassembleWith(&o)...)
+			start += len(q.Code)
+		}
+		return listing
+	}
 	listing := []string{
 		fmt.Sprint(".program ", p.Attr.Name),
 	}
+	if p.Attr.PioVersion != 0 {
+		listing = append(listing, fmt.Sprint(".pio_version ", p.Attr.PioVersion))
+	}
+	var names []string
+	for name := range p.Defines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		listing = append(listing, fmt.Sprint(".define ", name, " ", p.Defines[name]))
+	}
 	if p.Attr.In != 0 {
 		var suffix string
-		if p.Attr.InThreshold != 0 {
-			suffix = fmt.Sprint(" auto ", p.Attr.InThreshold)
+		if p.Attr.InAuto {
+			suffix = " auto"
+			if p.Attr.InThreshold != 0 {
+				suffix = fmt.Sprint(suffix, " ", p.Attr.InThreshold)
+			}
 		}
 		if p.Attr.InLeft {
 			listing = append(listing, fmt.Sprintf(".in %d left%s", p.Attr.In, suffix))
@@ -888,8 +1976,11 @@ func (p *Program) Disassemble() []string {
 	}
 	if p.Attr.Out != 0 {
 		var suffix string
-		if p.Attr.OutThreshold != 0 {
-			suffix = fmt.Sprint(" auto ", p.Attr.OutThreshold)
+		if p.Attr.OutAuto {
+			suffix = " auto"
+			if p.Attr.OutThreshold != 0 {
+				suffix = fmt.Sprint(suffix, " ", p.Attr.OutThreshold)
+			}
 		}
 		if p.Attr.OutLeft {
 			listing = append(listing, fmt.Sprintf(".out %d left%s", p.Attr.Out, suffix))
@@ -910,35 +2001,108 @@ func (p *Program) Disassemble() []string {
 	if p.Attr.Set != 0 {
 		listing = append(listing, fmt.Sprint(".set ", p.Attr.Set))
 	}
+	if p.Attr.ClockDiv != 0 {
+		listing = append(listing, fmt.Sprint(".clock_div ", strconv.FormatFloat(p.Attr.ClockDiv, 'g', -1, 64)))
+	}
+	if p.Attr.HasJmpPin {
+		listing = append(listing, fmt.Sprint(".jmp_pin ", p.Attr.JmpPin))
+	}
+	if p.Attr.FifoMode != FifoTxRx {
+		listing = append(listing, fmt.Sprint(".fifo ", disFifoModes[p.Attr.FifoMode]))
+	}
+	switch {
+	case p.Attr.MovStatusSel == StatusIRQ:
+		listing = append(listing, fmt.Sprint(".mov_status irq set ", p.Attr.MovStatusN))
+	case p.Attr.MovStatusSel == StatusRxLess:
+		listing = append(listing, fmt.Sprint(".mov_status rxfifo < ", p.Attr.MovStatusN))
+	case p.Attr.MovStatusN != 0:
+		listing = append(listing, fmt.Sprint(".mov_status txfifo < ", p.Attr.MovStatusN))
+	}
+	var langs []string
+	for lang := range p.Attr.LangOpts {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	for _, lang := range langs {
+		opts := p.Attr.LangOpts[lang]
+		var keys []string
+		for key := range opts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			listing = append(listing, fmt.Sprint(".lang_opt ", lang, " ", key, " = ", opts[key]))
+		}
+	}
+	irqNames := make(map[uint16]string)
+	for _, name := range opts.IRQNames {
+		if n, ok := p.Defines[name]; ok && n < 8 {
+			if _, dup := irqNames[n]; !dup {
+				irqNames[n] = name
+			}
+		}
+	}
+	var at []int
+	var fields [][4]string
 	for i, code := range p.Code {
-		if uint16(i) == p.Attr.WrapTarget {
+		pc := uint16(i)
+		listing = append(listing, p.Comments[pc]...)
+		if pc == p.Attr.WrapTarget {
 			listing = append(listing, ".wrap_target")
 		}
-		if uint16(i) == p.Attr.Origin && p.Attr.Origin != 0 {
+		if pc == p.Attr.Origin && p.Attr.Origin != 0 {
 			listing = append(listing, ".origin")
 		}
-		if list, ok := p.Targets[uint16(i)]; ok {
-			for _, sym := range list {
-				listing = append(listing, fmt.Sprintf("%s:", sym))
-			}
-		}
-		text, err := Disassemble(code, p)
-		if err != nil {
-			panic(fmt.Sprintf("error at code offset %d: %v", i, err))
+		listing = append(listing, p.labelLines(pc)...)
+		at = append(at, len(listing))
+		if text, err := Disassemble(code, p.moduleAt(uint16(i))); err != nil {
+			// A word, such as one from .word, that does not
+			// decode is listed as a .word.
+			fields = append(fields, [4]string{".word", fmt.Sprintf("0x%04x", code)})
+		} else {
+			f := splitFields(text)
+			f[1] = irqSymbol(code, f[1], irqNames)
+			fields = append(fields, f)
 		}
-		listing = append(listing, fmt.Sprintf("\t%s", text))
-		if uint16(i) == p.Attr.Wrap {
+		listing = append(listing, "")
+		if pc == p.Attr.Wrap {
 			listing = append(listing, ".wrap")
 		}
 	}
-	if list, ok := p.Targets[uint16(len(p.Code))]; ok {
-		for _, sym := range list {
-			listing = append(listing, fmt.Sprintf("%s:", sym))
-		}
-	}
-	if p.Attr.Wrap == uint16(len(p.Code)) {
+	end := uint16(len(p.Code))
+	listing = append(listing, p.labelLines(end)...)
+	if p.Attr.Wrap == end {
 		listing = append(listing, ".wrap")
 	}
+	listing = append(listing, p.Comments[uint16(len(p.Code))]...)
+	langs = langs[:0]
+	for lang := range p.Attr.CodeBlocks {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	for _, lang := range langs {
+		listing = append(listing, fmt.Sprintf("%% %s {", lang))
+		listing = append(listing, p.Attr.CodeBlocks[lang]...)
+		listing = append(listing, "%}")
+	}
+	pc, words := p.base, p.Image()
+	if opts.words != nil {
+		pc, words = opts.pc, opts.words
+	}
+	for j, line := range opts.format(fields) {
+		if opts.SideSetNotes && p.Attr.SideSetOpt && fields[j][0] != ".word" {
+			if _, present, _ := DecodeSideSet(p.Code[j], p.Attr); !present {
+				line += "\t; no side-set (opt bit clear)"
+			}
+		}
+		if comment, ok := p.InlineComments[uint16(j)]; ok {
+			line += "\t" + comment
+		}
+		if opts.Annotate {
+			line = fmt.Sprintf("%02x: 0x%04x  %s", pc+uint16(j), words[j], line)
+		}
+		listing[at[j]] = line
+	}
 	return listing
 }
 
@@ -959,21 +2123,64 @@ func jumpCodeAdjust(code uint16, delta uint16) (recode uint16) {
 // Cat merges together a number of programs to create a combination
 // program with multiple entry and wrapping targets. The idea is that
 // different state machines running within one of the PIO<N> units can
-// perform different PIO tasks.
+// perform different PIO tasks. The side-set settings of the combined
+// program are only set when all of the programs share them, and are
+// otherwise zero. The per-program settings are preserved in the
+// Modules of the combined program, and the methods of Program that
+// decode instructions, such as DisassembleWith, MakeCHeader,
+// MakePackage and Validate, use the settings of the module holding
+// each instruction.
 func Cat(name string, ps ...*Program) (*Program, error) {
+	return CatWith(name, nil, ps...)
+}
+
+// CatOptions holds the options for CatWith.
+type CatOptions struct {
+	// MaxInstructions is the number of instructions the combined
+	// program may hold. The default, 0, selects 32, the size of
+	// the instruction memory of a PIO block.
+	MaxInstructions int
+}
+
+// CatWith merges programs, as Cat, according to opts. A nil opts
+// value selects the default options. When the combined program is
+// too long, the error lists the size of each program.
+func CatWith(name string, opts *CatOptions, ps ...*Program) (*Program, error) {
+	limit := 32
+	if opts != nil && opts.MaxInstructions != 0 {
+		limit = opts.MaxInstructions
+	}
 	prog := &Program{
 		Attr: Settings{
 			Name: name,
 		},
 		Labels: make(map[string]uint16),
+		Public: make(map[string]bool),
 	}
 	var offset uint16
+	owners := make(map[string]int)
 	for i, p := range ps {
+		if p.Attr.PioVersion > prog.Attr.PioVersion {
+			prog.Attr.PioVersion = p.Attr.PioVersion
+		}
+		if p.Attr.Target == TargetRP2040 {
+			prog.Attr.Target = TargetRP2040
+		}
+		if i == 0 {
+			prog.Attr.SideSet = p.Attr.SideSet
+			prog.Attr.SideSetOpt = p.Attr.SideSetOpt
+			prog.Attr.SideSetPindirs = p.Attr.SideSetPindirs
+		} else if q := ps[0]; p.Attr.SideSet != q.Attr.SideSet || p.Attr.SideSetOpt != q.Attr.SideSetOpt || p.Attr.SideSetPindirs != q.Attr.SideSetPindirs {
+			prog.Attr.SideSet = 0
+			prog.Attr.SideSetOpt = false
+			prog.Attr.SideSetPindirs = false
+		}
 		attr := Settings{
 			Name:           p.Attr.Name,
 			Origin:         offset + p.Attr.Origin,
 			Wrap:           offset + p.Attr.Wrap,
 			WrapTarget:     offset + p.Attr.WrapTarget,
+			Length:         uint16(len(p.Code)),
 			SideSet:        p.Attr.SideSet,
 			SideSetOpt:     p.Attr.SideSetOpt,
 			SideSetPindirs: p.Attr.SideSetPindirs,
@@ -988,12 +2195,37 @@ func Cat(name string, ps ...*Program) (*Program, error) {
 			InLeft:         p.Attr.InLeft,
 			InAuto:         p.Attr.InAuto,
 			InThreshold:    p.Attr.InThreshold,
+			FifoMode:       p.Attr.FifoMode,
+			ClockDiv:       p.Attr.ClockDiv,
+			JmpPin:         p.Attr.JmpPin,
+			HasJmpPin:      p.Attr.HasJmpPin,
+			MovStatusSel:   p.Attr.MovStatusSel,
+			MovStatusN:     p.Attr.MovStatusN,
+			LangOpts:       p.Attr.LangOpts,
+			CodeBlocks:     p.Attr.CodeBlocks,
+			PioVersion:     p.Attr.PioVersion,
+			Target:         p.Attr.Target,
 		}
-		prog.Labels[fmt.Sprint(p.Attr.Name, i, "_origin")] = offset + p.Attr.Origin
-		prog.Labels[fmt.Sprint(p.Attr.Name, i, "_wrap")] = offset + p.Attr.Wrap
-		prog.Labels[fmt.Sprint(p.Attr.Name, i, "_wrap_target")] = offset + p.Attr.WrapTarget
-		for label, val := range p.Labels {
-			prog.Labels[fmt.Sprint(p.Attr.Name, i, "_", label)] = offset + val
+		labels := []Label{
+			{Name: "origin", Addr: p.Attr.Origin},
+			{Name: "wrap", Addr: p.Attr.Wrap},
+			{Name: "wrap_target", Addr: p.Attr.WrapTarget},
+		}
+		for _, label := range append(labels, p.SortedLabels()...) {
+			name := fmt.Sprint(p.Attr.Name, i, "_", label.Name)
+			// Program names ending in digits, or labels
+			// named like those added here, can produce the
+			// same combined label twice.
+			if j, dup := owners[name]; dup && j == i {
+				return nil, fmt.Errorf("combined label %q of module %d is generated twice", name, i)
+			} else if dup {
+				return nil, fmt.Errorf("combined label %q of module %d collides with module %d", name, i, j)
+			}
+			owners[name] = i
+			prog.Labels[name] = offset + label.Addr
+			if p.Public[label.Name] {
+				prog.Public[name] = true
+			}
 		}
 		for _, c := range p.Code {
 			prog.Code = append(prog.Code, jumpCodeAdjust(c, offset))
@@ -1001,8 +2233,12 @@ func Cat(name string, ps ...*Program) (*Program, error) {
 		offset += uint16(len(p.Code))
 		prog.Modules = append(prog.Modules, attr)
 	}
-	if len(prog.Code) > 32 {
-		return nil, fmt.Errorf("combined code for %q too long: %d > 32", name, len(prog.Code))
+	if len(prog.Code) > limit {
+		var sizes []string
+		for _, p := range ps {
+			sizes = append(sizes, fmt.Sprintf("%s: %d", p.Attr.Name, len(p.Code)))
+		}
+		return nil, fmt.Errorf("combined code for %q too long: %d > %d (%s)", name, len(prog.Code), limit, strings.Join(sizes, ", "))
 	}
 	prog.buildTargets()
 	prog.Attr.Wrap = uint16(len(prog.Code))
@@ -1010,6 +2246,142 @@ func Cat(name string, ps ...*Program) (*Program, error) {
 	return prog, nil
 }
 
+// split separates a combined program into a program per module,
+// reversing Cat. The module names prefixed to labels by Cat are
+// removed, and the labels Cat adds for the origin and wrap offsets
+// are dropped.
+func (p *Program) split() []*Program {
+	var ps []*Program
+	var start uint16
+	for i, m := range p.Modules {
+		end := start + m.Length
+		m.Origin -= start
+		m.Wrap -= start
+		m.WrapTarget -= start
+		m.Length = 0
+		q := &Program{
+			Attr:   m,
+			Labels: make(map[string]uint16),
+			Public: make(map[string]bool),
+		}
+		prefix := fmt.Sprint(m.Name, i, "_")
+		for label, val := range p.Labels {
+			if !strings.HasPrefix(label, prefix) || val < start || val > end {
+				continue
+			}
+			name := strings.TrimPrefix(label, prefix)
+			switch name {
+			case "origin", "wrap", "wrap_target":
+				continue
+			}
+			q.Labels[name] = val - start
+			if p.Public[label] {
+				q.Public[name] = true
+			}
+		}
+		for _, c := range p.Code[start:end] {
+			q.Code = append(q.Code, jumpCodeAdjust(c, 32-start))
+		}
+		q.buildTargets()
+		ps = append(ps, q)
+		start = end
+	}
+	return ps
+}
+
+// AppendProgram grows p in place by appending the code of other, as
+// if p were replaced by the result of Cat of the programs of p and
+// other. The jmp targets of the appended code are relocated by the
+// length of p, its labels are prefixed with its name and module
+// index, and a module is added to the Modules of p. A program that
+// is not combined becomes the first module. The source comments of
+// p are not retained. It is an error for the result to exceed 32
+// instructions, and p is left unchanged on error.
+func (p *Program) AppendProgram(other *Program) error {
+	ps := []*Program{p}
+	if p.Modules != nil {
+		ps = p.split()
+	}
+	if other.Modules != nil {
+		ps = append(ps, other.split()...)
+	} else {
+		ps = append(ps, other)
+	}
+	q, err := Cat(p.Attr.Name, ps...)
+	if err != nil {
+		return err
+	}
+	*p = *q
+	return nil
+}
+
+// Relocate returns a copy of a program, assembled to be loaded at
+// instruction memory offset 0, that is instead to be loaded at the
+// newOrigin offset. The Code, Labels and Attr offsets of the copy
+// are unchanged, so the methods of Program treat it as before, and
+// the move is applied when the program is loaded: Image shifts the
+// jmp targets by newOrigin, and the generated sources load the code
+// at that offset. The relocated code must fit within the 32
+// instructions of a PIO block.
+func (p *Program) Relocate(newOrigin uint16) (*Program, error) {
+	if n := int(p.base+newOrigin) + len(p.Code); n > 32 {
+		return nil, fmt.Errorf("relocated code for %q too long: %d > 32", p.Attr.Name, n)
+	}
+	prog := &Program{
+		Attr:           p.Attr,
+		Labels:         make(map[string]uint16),
+		Public:         make(map[string]bool),
+		Defines:        make(map[string]uint16),
+		Code:           append([]uint16(nil), p.Code...),
+		Modules:        append([]Settings(nil), p.Modules...),
+		Comments:       p.Comments,
+		InlineComments: p.InlineComments,
+		base:           p.base + newOrigin,
+	}
+	for label, val := range p.Labels {
+		prog.Labels[label] = val
+	}
+	for label, public := range p.Public {
+		prog.Public[label] = public
+	}
+	for name, val := range p.Defines {
+		prog.Defines[name] = val
+	}
+	prog.buildTargets()
+	return prog, nil
+}
+
+// LoadOffset returns the instruction memory offset at which the
+// program is to be loaded. It is 0 unless the program was moved
+// with Relocate.
+func (p *Program) LoadOffset() uint16 {
+	return p.base
+}
+
+// SetWrap sets the Attr WrapTarget and Wrap offsets of a program, as
+// the .wrap_target and .wrap directives do. After executing the
+// instruction at offset wrap, the PC continues at offset wrapTarget.
+// Both offsets must address instructions of the Code, and wrapTarget
+// may not follow wrap. As a special case, wrap may be the offset
+// just past the end of the Code, which is what NewProgram uses when
+// there is no .wrap directive: the PC then wraps after the last
+// instruction.
+func (p *Program) SetWrap(wrapTarget, wrap uint16) error {
+	end := uint16(len(p.Code))
+	if wrapTarget >= end {
+		return fmt.Errorf("wrap target %d outside code [0,%d)", wrapTarget, end)
+	}
+	if wrap > end {
+		return fmt.Errorf("wrap %d outside code [0,%d]", wrap, end)
+	}
+	if wrapTarget > wrap {
+		return fmt.Errorf("wrap target %d follows wrap %d", wrapTarget, wrap)
+	}
+	p.Attr.WrapTarget = wrapTarget
+	p.Attr.Wrap = wrap
+	return nil
+}
+
 var cCaseRE = regexp.MustCompile(`_[a-zA-Z]`)
 
 // camelCase rewrites a symbol to be more Go friendly.
@@ -1018,3 +2390,12 @@ func camelCase(text string) string {
 		return strings.ToUpper(a[1:])
 	})
 }
+
+var snakeCaseRE = regexp.MustCompile(`[a-z0-9][A-Z]`)
+
+// snakeCase rewrites a symbol to be more Rust friendly.
+func snakeCase(text string) string {
+	return strings.ToLower(snakeCaseRE.ReplaceAllStringFunc(text, func(a string) string {
+		return a[:1] + "_" + a[1:]
+	}))
+}
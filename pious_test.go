@@ -1,6 +1,15 @@
 package pious
 
-import "testing"
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestDisassemble(t *testing.T) {
 	vs := []struct {
@@ -72,3 +81,3138 @@ func TestAssemble(t *testing.T) {
 		}
 	}
 }
+
+func TestParseError(t *testing.T) {
+	_, err := NewProgram(".program bad\n\tset x, 1\n\tset\tx, 1 [99]\n")
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected a *ParseError, got %v", err)
+	}
+	if pe.Line != 3 || pe.Column != 11 || pe.RawLine != "\tset\tx, 1 [99]" {
+		t.Errorf("bad error location: %#v", pe)
+	}
+	if _, err := Assemble("jmp x-- 99", nil); !errors.Is(err, ErrBad) {
+		t.Errorf("expected ErrBad, got %v", err)
+	} else if !errors.As(err, &pe) || pe.Column != 9 {
+		t.Errorf("bad column for %v", err)
+	}
+}
+
+func TestDefine(t *testing.T) {
+	p, err := NewProgram(`.program defs
+.define CLKDIV 7
+.define BITS 8
+	set	x, CLKDIV
+	out	pins, BITS
+`)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if want := []uint16{0xe027, 0x6008}; len(p.Code) != 2 || p.Code[0] != want[0] || p.Code[1] != want[1] {
+		t.Errorf("got=%04x want=%04x", p.Code, want)
+	}
+	for i, src := range []string{
+		".define A 1\n.define A 2\n",
+		"\tset\tx, LATER\n.define LATER 3\n",
+	} {
+		if _, err := NewProgram(src); err == nil {
+			t.Errorf("test %d: expected error for %q", i, src)
+		}
+	}
+}
+
+func TestMakeCHeader(t *testing.T) {
+	p, err := NewProgram(".program clock\n.set 1\n\tset\tpindirs, 1\n.wrap_target\n\tset\tpins, 0 [1]\n\tset\tpins, 1 [1]\n.wrap\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	text := strings.Join(p.MakeCHeader("test"), "\n")
+	for _, want := range []string{
+		"#define clock_wrap_target 1\n",
+		"#define clock_wrap 2\n",
+		"    0xe101, //  2: set pins, 1 [1]\n",
+		"    .length = 3,\n",
+		"static inline pio_sm_config clock_program_get_default_config(uint offset) {\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("missing %q in:\n%s", want, text)
+		}
+	}
+}
+
+func TestMakeCHeaderNoWrap(t *testing.T) {
+	p, err := NewProgram(".program blink\n\tset\tpins, 1 [31]\n\tset\tpins, 0 [31]\n\tjmp\t0\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	// The corresponding part of the pioasm output for this program.
+	pioasm := []string{
+		"#define blink_wrap_target 0",
+		"#define blink_wrap 2",
+		"#define blink_pio_version 0",
+		"",
+		"static const uint16_t blink_program_instructions[] = {",
+		"            //     .wrap_target",
+		"    0xff01, //  0: set    pins, 1                [31]",
+		"    0xff00, //  1: set    pins, 0                [31]",
+		"    0x0000, //  2: jmp    0",
+		"            //     .wrap",
+		"};",
+	}
+	header := p.MakeCHeader("test")
+	start := -1
+	for i, line := range header {
+		if line == pioasm[0] {
+			start = i
+			break
+		}
+	}
+	if start < 0 || start+len(pioasm) > len(header) {
+		t.Fatalf("no %q in:\n%s", pioasm[0], strings.Join(header, "\n"))
+	}
+	for i, want := range pioasm {
+		got := header[start+i]
+		if strings.HasPrefix(want, "    0x") {
+			// pioasm aligns the disassembly differently.
+			got, want = got[:12], want[:12]
+		}
+		if got != want {
+			t.Errorf("[%d] got=%q want=%q", i, got, want)
+		}
+	}
+}
+
+func TestCatSideSet(t *testing.T) {
+	a, err := NewProgram(".program a\n.side_set 1\n\tset\tpins, 1 side 1\n")
+	if err != nil {
+		t.Fatalf("failed to compile a: %v", err)
+	}
+	b, err := NewProgram(".program b\n.side_set 2 opt\n\tset\tpins, 1 side 1\n")
+	if err != nil {
+		t.Fatalf("failed to compile b: %v", err)
+	}
+	p, err := Cat("ab", a, b)
+	if err != nil {
+		t.Fatalf("failed to cat a, b: %v", err)
+	}
+	if p.Attr.SideSet != 0 {
+		t.Errorf("mixed side-set combination has side-set %d", p.Attr.SideSet)
+	}
+	if got := strings.Join(p.Disassemble(), "\n"); strings.Count(got, "\tset\tpins, 1\tside 1\n") != 2 {
+		t.Errorf("bad per-module disassembly:\n%s", got)
+	}
+	if errs := p.Validate(); len(errs) != 0 {
+		t.Errorf("mixed side-set combination invalid: %v", errs)
+	}
+	for _, want := range []string{
+		"    sm_config_set_sideset(&c, 1, false, false);\n",
+		"    sm_config_set_sideset(&c, 3, true, false);\n",
+	} {
+		if got := strings.Join(p.MakeCHeader("test"), "\n"); !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+	for _, want := range []string{"cfg.SetSidesetParams(1, false, false)", "cfg.SetSidesetParams(2, true, false)"} {
+		if got := strings.Join(p.MakePackage("test", nil), "\n"); !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+	if got := strings.Join(p.DisassembleWith(&DisassembleOptions{SideSetNotes: true}), "\n"); strings.Contains(got, "no side-set") {
+		t.Errorf("spurious side-set notes:\n%s", got)
+	}
+	d, err := NewProgram(".program d\n.side_set 2 opt\n\tnop\n")
+	if err != nil {
+		t.Fatalf("failed to compile d: %v", err)
+	}
+	if ad, err := Cat("ad", a, d); err != nil {
+		t.Fatalf("failed to cat a, d: %v", err)
+	} else if got := strings.Join(ad.DisassembleWith(&DisassembleOptions{SideSetNotes: true}), "\n"); !strings.Contains(got, "\nnop") || strings.Count(got, "no side-set") != 1 {
+		t.Errorf("bad side-set notes:\n%s", got)
+	}
+	if e := NewEmulator(p); e.Attr.SideSet != 1 || e.Attr.Wrap != 0 {
+		t.Errorf("emulator side-set %d, wrap %d: want 1, 0", e.Attr.SideSet, e.Attr.Wrap)
+	}
+	c, err := NewProgram(".program c\n.side_set 1 pindirs\n\tset\tpins, 1 side 1\n")
+	if err != nil {
+		t.Fatalf("failed to compile c: %v", err)
+	}
+	if p, err = Cat("ac", a, c); err != nil {
+		t.Fatalf("failed to cat a, c: %v", err)
+	} else if p.Attr.SideSet != 0 || p.Attr.SideSetPindirs {
+		t.Errorf("mixed pindirs combination has side-set %d pindirs=%v", p.Attr.SideSet, p.Attr.SideSetPindirs)
+	}
+	p, err = Cat("aa", a, a)
+	if err != nil {
+		t.Fatalf("failed to cat a, a: %v", err)
+	}
+	if got := strings.Join(p.Disassemble(), "\n"); !strings.Contains(got, ".side_set 1\n") || strings.Count(got, "\tset\tpins, 1\tside 1\n") != 2 {
+		t.Errorf("bad disassembly:\n%s", got)
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	ps, err := ParseFile(`// two programs in one file
+.program first
+loop:
+	set	pins, 1
+	jmp	loop
+.program second
+	set	x, 1
+loop:
+	jmp	loop
+`)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if len(ps) != 2 {
+		t.Fatalf("got %d programs, want 2", len(ps))
+	}
+	for i, want := range []struct {
+		name string
+		loop uint16
+	}{{"first", 0}, {"second", 1}} {
+		if p := ps[i]; p.Attr.Name != want.name || p.Labels["loop"] != want.loop || len(p.Code) != 2 {
+			t.Errorf("program %d: got %q loop=%d, want %q loop=%d", i, p.Attr.Name, p.Labels["loop"], want.name, want.loop)
+		}
+	}
+	_, err = ParseFile(".program a\n\tnop\n.program b\n\tbogus\n")
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Line != 4 {
+		t.Errorf("expected error at line 4, got %v", err)
+	}
+	ps, err = ParseFile(".define N 3\n.define M 2\n.program a\n\tset\tx, N\n.program b\n\tset\ty, M\n\tset\tx, N\n")
+	if err != nil {
+		t.Fatalf("failed to parse global defines: %v", err)
+	}
+	if len(ps) != 2 {
+		t.Fatalf("got %d programs, want 2", len(ps))
+	}
+	for i, want := range [][]uint16{{0xe023}, {0xe042, 0xe023}} {
+		if got := ps[i].Code; fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("program %d: got=%04x want=%04x", i, got, want)
+		}
+	}
+	if got := ps[1].where(1); got != "line 7: offset 1" {
+		t.Errorf("got %q, want line 7", got)
+	}
+	_, err = ParseFile(".define N 3\n.program a\n\tnop\n.program b\n\tbogus\n")
+	if !errors.As(err, &pe) || pe.Line != 5 {
+		t.Errorf("expected error at line 5, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	p, err := NewProgram(".program v\nloop:\n\tjmp\tloop\n\tjmp\tend\n\tjmp\t9\nend:\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	errs := p.Validate()
+	if len(errs) != 2 {
+		t.Fatalf("got %d errors, want 2: %v", len(errs), errs)
+	}
+	for _, err := range errs {
+		if !errors.Is(err, ErrOutOfRange) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if got := errs[0].Error(); got != "offset 1: target 3 (end) of 3 instructions: jmp target out of range" {
+		t.Errorf("bad error text: %q", got)
+	}
+}
+
+func TestCycleCount(t *testing.T) {
+	p, err := NewProgram(`.program timing
+.side_set 1 opt
+	pull	block
+loop:
+	set	pins, 0	side 1 [3]
+	set	pins, 1 [7]
+	jmp	loop
+done:
+`)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	want := []Cycles{{1, true}, {4, false}, {8, false}, {1, false}}
+	got := p.CycleCount()
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("[%d] got=%v want=%v", i, got[i], want[i])
+		}
+	}
+	if c, err := p.CyclesBetween("loop", "done"); err != nil || c != (Cycles{13, false}) {
+		t.Errorf("loop got=%v, %v", c, err)
+	}
+}
+
+func TestAssembleLines(t *testing.T) {
+	words, err := AssembleLines(`
+	jmp	skip	// forward reference
+top:
+	set	x, 1
+skip:
+	jmp	top
+`, nil)
+	if err != nil {
+		t.Fatalf("failed to assemble: %v", err)
+	}
+	if want := []uint16{0x0002, 0xe021, 0x0001}; len(words) != len(want) || words[0] != want[0] || words[1] != want[1] || words[2] != want[2] {
+		t.Errorf("got=%04x want=%04x", words, want)
+	}
+	_, err = AssembleLines("\tnop\n\tjmp\tnowhere\n", nil)
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Line != 2 {
+		t.Errorf("expected error at line 2, got %v", err)
+	}
+}
+
+func TestMakePackageOptions(t *testing.T) {
+	p, err := NewProgram(".program clock\n.set 1\n\tset\tpindirs, 1\n.wrap_target\n\tset\tpins, 0 [1]\n\tset\tpins, 1 [1]\n.wrap\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	text := strings.Join(p.MakePackage("test", &MakePackageOptions{
+		Package:    "clk",
+		WrapConsts: true,
+		Prefix:     "pio",
+		GoGenerate: "piocli --src clock.pio --tinygo",
+		ByteOrder:  binary.BigEndian,
+	}), "\n")
+	for _, want := range []string{
+		"\npackage clk\n",
+		"\n\t\t0xe081,\n",
+		"\n// PioCodeBytes holds the program code as raw bytes in BigEndian byte\n",
+		"\nvar PioCodeBytes = []byte{\n",
+		"\ntype PioEngine struct {\n",
+		"\ntype PioStateMachine struct {\n",
+		"\nfunc PioAssign(block *pio.PIO) (*PioEngine, error) {\n",
+		"\n\treturn &PioStateMachine{\n",
+		"\n\t0xe0, 0x81, // 0xe081\n",
+		"\n//go:generate piocli --src clock.pio --tinygo\n",
+		"\nconst PioClockWrapTarget = 1\n",
+		"\nconst PioClockWrap = 2\n",
+		"\nfunc (e *PioEngine) ConfigureClock(setBase machine.Pin) (*PioStateMachine, error) {\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("missing %q in:\n%s", want, text)
+		}
+	}
+	p, err = NewProgram(".program blink\n\tset\tpins, 1 [31]\n\tset\tpins, 0 [31]\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	text = strings.Join(p.MakePackage("test", &MakePackageOptions{WrapConsts: true}), "\n")
+	for _, want := range []string{
+		"\nconst BlinkWrap = 1\n",
+		"\tcfg.SetWrap(e.offset+0, e.offset+1)\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("missing %q in:\n%s", want, text)
+		}
+	}
+}
+
+func TestLangOpt(t *testing.T) {
+	p, err := NewProgram(`.program ws2812
+.side_set 1
+.lang_opt python sideset_init = pico.PIO.OUT_HIGH
+.lang_opt python out_shiftdir = 1
+	out	x, 1	side 0 [2]
+`)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if got := p.Attr.LangOpts["python"]["sideset_init"]; got != "pico.PIO.OUT_HIGH" {
+		t.Errorf("got sideset_init=%q", got)
+	}
+	if got := p.Disassemble()[3]; got != ".lang_opt python out_shiftdir = 1" {
+		t.Errorf("got %q", got)
+	}
+	if _, err := NewProgram(".program x\n.bogus 1\n"); err == nil || !strings.Contains(err.Error(), `unknown directive ".bogus"`) {
+		t.Errorf("bad error for unknown directive: %v", err)
+	}
+}
+
+func TestPioVersion(t *testing.T) {
+	src := "\tmov\trxfifo[y], isr\n\twait\t1 jmppin + 1\n\tirq\tnext set 2\n\tmov\tpindirs, x\n"
+	if _, err := NewProgram(".program v0\n" + src); err == nil {
+		t.Error("RP2350 instructions accepted for .pio_version 0")
+	}
+	p, err := NewProgram(".program v1\n.pio_version 1\n" + src)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	for i, code := range p.Code {
+		if v := PioVersion(code); v != 1 {
+			t.Errorf("[%d] %04x got version %d", i, code, v)
+		}
+	}
+	if v := PioVersion(0xe001); v != 0 {
+		t.Errorf("set pins, 1 got version %d", v)
+	}
+}
+
+func TestPublicLabels(t *testing.T) {
+	p, err := NewProgram(`.program pub
+public entry:
+	set	x, 1
+loop:
+	jmp	loop
+`)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if !p.Public["entry"] || p.Public["loop"] {
+		t.Errorf("bad public labels: %v", p.Public)
+	}
+	if got := p.Disassemble()[2]; got != "public entry:" {
+		t.Errorf("got %q", got)
+	}
+	if text := strings.Join(p.MakeCHeader("test"), "\n"); !strings.Contains(text, "\n#define pub_offset_entry 0u\n") || strings.Contains(text, "offset_loop") {
+		t.Errorf("bad C header:\n%s", text)
+	}
+	if text := strings.Join(p.MakePackage("test", nil), "\n"); !strings.Contains(text, "\nconst PubOffsetEntry = 0\n") || strings.Contains(text, "OffsetLoop") {
+		t.Errorf("bad package:\n%s", text)
+	}
+}
+
+func TestAssembleCaseAndBase(t *testing.T) {
+	vs := []struct {
+		code, same string
+	}{
+		{"SET x, 0x1f", "set x, 31"},
+		{"Jmp 0b11", "jmp 3"},
+		{"OUT pins, 0x10", "out pins, 16"},
+		{"NOP", "nop"},
+	}
+	for i, v := range vs {
+		got, err := Assemble(v.code, nil)
+		if err != nil {
+			t.Fatalf("[%d] %q failed: %v", i, v.code, err)
+		}
+		want, err := Assemble(v.same, nil)
+		if err != nil {
+			t.Fatalf("[%d] %q failed: %v", i, v.same, err)
+		}
+		if got != want {
+			t.Errorf("[%d] %q got %04x, want %04x", i, v.code, got, want)
+		}
+	}
+	for _, bad := range []string{"set x, 0x21", "set x, 0b100001", "jmp 0x"} {
+		if _, err := Assemble(bad, nil); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestDisassembleStream(t *testing.T) {
+	var buf bytes.Buffer
+	in := bytes.NewReader([]byte{0xa0, 0x80, 0x40, 0x60, 0x60, 0xe0})
+	if err := DisassembleStreamPC(in, &buf, nil); err != nil {
+		t.Fatalf("stream failed: %v", err)
+	}
+	if want := "0000: pull\tblock\n0001: out\ty, 32\n0002: unknown <e060>\n"; buf.String() != want {
+		t.Errorf("got=%q want=%q", buf.String(), want)
+	}
+	buf.Reset()
+	if err := DisassembleStream(bytes.NewReader([]byte{0x01, 0xe0, 0x00}), &buf, nil); err == nil {
+		t.Errorf("odd byte count not reported")
+	} else if buf.String() != "set\tpins, 1\n" {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+func TestDisassembleWith(t *testing.T) {
+	p, err := NewProgram(`.program fmt
+.side_set 1 opt
+loop:
+	out	pins, 16	side 1 [2]
+	jmp	!osre loop
+	nop
+`)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	got := p.DisassembleWith(&DisassembleOptions{
+		Indent: "    ",
+		Align:  true,
+		Upper:  true,
+		Hex:    true,
+	})
+	want := []string{
+		"    OUT pins, 0x10 side 1 [2]",
+		"    JMP !osre loop",
+		"    NOP",
+	}
+	for i, line := range want {
+		if got[i+5] != line {
+			t.Errorf("[%d] got=%q want=%q", i, got[i+5], line)
+		}
+	}
+	q, err := NewProgram(strings.Join(got, "\n"))
+	if err != nil {
+		t.Fatalf("failed to recompile: %v", err)
+	}
+	if len(q.Code) != len(p.Code) {
+		t.Fatalf("recompiled code length %d != %d", len(q.Code), len(p.Code))
+	}
+	for i := range p.Code {
+		if q.Code[i] != p.Code[i] {
+			t.Errorf("[%d] recompiled %04x != %04x", i, q.Code[i], p.Code[i])
+		}
+	}
+}
+
+func TestMovStatus(t *testing.T) {
+	for _, dest := range disMDestinations {
+		for _, op := range []string{"", "!", "::"} {
+			text := fmt.Sprint("mov\t", dest, ", ", op, "status")
+			code, err := Assemble(text, nil)
+			if err != nil {
+				t.Errorf("failed to assemble %q: %v", text, err)
+				continue
+			}
+			if got, err := Disassemble(code, nil); err != nil || got != text {
+				t.Errorf("got=%q want=%q: %v", got, text, err)
+			}
+		}
+	}
+	p, err := NewProgram(".program flow\n\tmov\ty, status\n\tjmp\t!y 0\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	p.Attr.MovStatusSel = StatusRxLess
+	p.Attr.MovStatusN = 2
+	if text := strings.Join(p.MakeCHeader("test"), "\n"); !strings.Contains(text, "    sm_config_set_mov_status(&c, STATUS_RX_LESSTHAN, 2);\n") {
+		t.Errorf("missing mov status config:\n%s", text)
+	}
+	q := *p
+	q.Attr.MovStatusSel = 7
+	if text := strings.Join(q.MakeCHeader("test"), "\n"); !strings.Contains(text, "    sm_config_set_mov_status(&c, (enum pio_mov_status_type) 7, 2);\n") {
+		t.Errorf("missing numeric mov status config:\n%s", text)
+	}
+	e := NewEmulator(p)
+	if _, err := e.Step(0); err != nil || e.Y != 0xffffffff {
+		t.Errorf("got y=%08x: %v", e.Y, err)
+	}
+}
+
+// roundTripSettings holds a range of side-set configurations used
+// to confirm that assembly reverses disassembly.
+var roundTripSettings = func() []Settings {
+	var ss []Settings
+	for n := uint16(0); n <= 5; n++ {
+		ss = append(ss, Settings{SideSet: n}, Settings{SideSet: n, SideSetPindirs: true})
+	}
+	for n := uint16(1); n <= 4; n++ {
+		ss = append(ss, Settings{SideSet: n, SideSetOpt: true}, Settings{SideSet: n, SideSetOpt: true, SideSetPindirs: true})
+	}
+	return ss
+}()
+
+func FuzzRoundTrip(f *testing.F) {
+	for _, seed := range []uint16{0x0000, 0x2020, 0x4061, 0x6040, 0x80a0, 0x8018, 0xa042, 0xa0c9, 0xc030, 0xe081, 0x1f00, 0x1542} {
+		f.Add(seed, uint8(0))
+		f.Add(seed, uint8(len(roundTripSettings)-1))
+	}
+	f.Fuzz(func(t *testing.T, instr uint16, sel uint8) {
+		p := &Program{Attr: roundTripSettings[int(sel)%len(roundTripSettings)]}
+		d, err := Disassemble(instr, p)
+		if err != nil {
+			return
+		}
+		got, err := Assemble(d, p)
+		if ins := instructions[idxIRQ]; err == nil && got^instr == 0b100000 && got&(ins.mask|0b1000000) == (ins.bits|0b1000000) {
+			// the wait bit is ignored if clear is set.
+			return
+		}
+		if err != nil || got != instr {
+			t.Errorf("%+v: %04x -> %q -> %04x: %v", p.Attr, instr, d, got, err)
+		}
+	})
+}
+
+func TestComments(t *testing.T) {
+	p, err := NewProgram(`# a hash comment
+.program comments # trailing hash
+.side_set 1 ; semicolon
+	set	x, 1	side 0 # hash after side-set
+	jmp	x-- 0 side 1 [1] // slashes # and a hash
+# ; // all styles
+`)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if want := []uint16{0xe021, 0x1140}; len(p.Code) != 2 || p.Code[0] != want[0] || p.Code[1] != want[1] {
+		t.Errorf("got=%04x want=%04x", p.Code, want)
+	}
+	if p.Attr.Name != "comments" {
+		t.Errorf("got name %q", p.Attr.Name)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	p, err := NewProgram(".program clock\n.set 1\n\tset\tpindirs, 1\n.wrap_target\n\tset\tpins, 0 [1]\n\tset\tpins, 1 [1]\n.wrap\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	data := p.Bytes()
+	if want := []byte{0x81, 0xe0, 0x00, 0xe1, 0x01, 0xe1}; !bytes.Equal(data, want) {
+		t.Errorf("got=%02x want=%02x", data, want)
+	}
+	q, err := FromBytes(data)
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if !bytes.Equal(q.Bytes(), data) {
+		t.Errorf("round trip got=%04x want=%04x", q.Code, p.Code)
+	}
+	if _, err := FromBytes(data[1:]); err == nil {
+		t.Error("odd length accepted")
+	}
+}
+
+func TestJmpConditions(t *testing.T) {
+	p, err := NewProgram(".program conds\ntarget:\n\tjmp\tpin, target\n\tjmp\t!osre, target\npin:\n\tjmp\tpin\n\tjmp\tx--, pin\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	want := []uint16{0x00c0, 0x00e0, 0x0002, 0x0042}
+	if len(p.Code) != len(want) {
+		t.Fatalf("got=%04x want=%04x", p.Code, want)
+	}
+	for i, code := range want {
+		if p.Code[i] != code {
+			t.Errorf("[%d] got=%04x want=%04x", i, p.Code[i], code)
+		}
+	}
+	for _, bad := range []string{"jmp", "jmp pin, 32"} {
+		if _, err := Assemble(bad, p); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestPinConfig(t *testing.T) {
+	p, err := NewProgram(".program pins\n.side_set 1 opt pindirs\n.set 2\n.out 8\n.in 3\n\tset\tpins, 1\n\tout\tpins, 8 side 1\n\tin\tx, 3\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	want := PinConfig{
+		SetCount:       2,
+		OutCount:       8,
+		SideSetCount:   1,
+		SideSetPindirs: true,
+		Total:          11,
+	}
+	if got := p.PinConfig(); got != want {
+		t.Errorf("got=%+v want=%+v", got, want)
+	}
+}
+
+func TestMakeMicroPython(t *testing.T) {
+	p, err := NewProgram(`.program blink
+.pio_version 1
+.side_set 1
+.set 1
+.out 8 left auto 16
+.wrap_target
+loop:
+	set	pins, 1 side 1 [3]
+	mov	x, !y side 0
+	irq	clear 2 rel side 0
+	wait	1 irq prev 1 side 0
+	jmp	x--, 2 side 0
+	jmp	loop side 0
+.wrap
+`)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	want := `import rp2
+
+
+@rp2.asm_pio(set_init=(rp2.PIO.OUT_LOW,), sideset_init=(rp2.PIO.OUT_LOW,), out_shiftdir=rp2.PIO.SHIFT_LEFT, autopull=True, pull_thresh=16)
+def blink():
+    wrap_target()
+    label("loop")
+    set(pins, 1) .side(1) [3]
+    mov(x, invert(y)) .side(0)
+    label("L2")
+    irq(clear, rel(2)) .side(0)
+    word(0x20c9)  # wait 1 irq prev 1 side 0
+    jmp(x_dec, "L2") .side(0)
+    jmp("loop") .side(0)
+    wrap()
+`
+	if got := strings.Join(p.MakeMicroPython(), "\n"); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	vs := []struct {
+		src  string
+		want []uint16
+	}{
+		{
+			src:  ".program a\nloop:\n\tset\tx, 1\n\tjmp\tloop\n\tset\tx, 2\n\tset\tx, 3\n",
+			want: []uint16{2, 3},
+		},
+		{
+			src:  ".program b\n\tjmp\tx--, skip\n\tnop\nskip:\n\tnop\n",
+			want: nil,
+		},
+		{
+			src:  ".program c\n.wrap_target\n\tnop\n.wrap\n\tnop\n",
+			want: []uint16{1},
+		},
+		{
+			src:  ".program d\n\tout\tx, 5\n\tmov\tpc, x\n\tjmp\t0\n\tnop\n",
+			want: nil,
+		},
+		{
+			src:  ".program e\n\tjmp\t2\n.wrap_target\n\tset\tx, 1\n\tnop\n",
+			want: nil,
+		},
+	}
+	for i, v := range vs {
+		p, err := NewProgram(v.src)
+		if err != nil {
+			t.Fatalf("[%d] failed to compile: %v", i, err)
+		}
+		if got := p.Unreachable(); fmt.Sprint(got) != fmt.Sprint(v.want) {
+			t.Errorf("[%d] got=%v want=%v", i, got, v.want)
+		}
+	}
+}
+
+func TestDelayError(t *testing.T) {
+	vs := []struct {
+		attr Settings
+		src  string
+		want string
+	}{
+		{Settings{}, "nop [32]", "delay 32 exceeds max 31 with 0 side-set bits"},
+		{Settings{SideSet: 2}, "nop side 1 [12]", "delay 12 exceeds max 7 with 2 side-set bits"},
+		{Settings{SideSet: 1, SideSetOpt: true}, "nop [8]", "delay 8 exceeds max 7 with 2 side-set bits"},
+	}
+	for i, v := range vs {
+		_, err := Assemble(v.src, &Program{Attr: v.attr})
+		if !errors.Is(err, ErrDelay) {
+			t.Errorf("[%d] got=%v want ErrDelay", i, err)
+		} else if !strings.Contains(err.Error(), v.want) {
+			t.Errorf("[%d] got=%q want %q", i, err, v.want)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	a, err := NewProgram(".program a\n.side_set 1 opt\n.define N 3\npublic start:\n\tset\tx, N side 1\n\tjmp\tstart [1]\n")
+	if err != nil {
+		t.Fatalf("failed to compile a: %v", err)
+	}
+	b, err := NewProgram(".program b\nloop:\n\tnop\n\tjmp\tloop\n")
+	if err != nil {
+		t.Fatalf("failed to compile b: %v", err)
+	}
+	p, err := Cat("ab", a, b)
+	if err != nil {
+		t.Fatalf("failed to cat: %v", err)
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	var q Program
+	if err := json.Unmarshal(data, &q); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	if got, want := strings.Join(q.Disassemble(), "\n"), strings.Join(p.Disassemble(), "\n"); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if fmt.Sprint(q.Targets) != fmt.Sprint(p.Targets) {
+		t.Errorf("targets got=%v want=%v", q.Targets, p.Targets)
+	}
+}
+
+func TestOutExec(t *testing.T) {
+	code, err := Assemble("out exec, 16", nil)
+	if err != nil {
+		t.Fatalf("failed to assemble: %v", err)
+	}
+	if code != 0x60f0 {
+		t.Errorf("got=%04x want=60f0", code)
+	}
+	if text, err := Disassemble(code, nil); err != nil || text != "out\texec, 16" {
+		t.Errorf("got=%q, %v", text, err)
+	}
+	for _, bad := range []string{"out exec, 8", "out exec, 32", "in exec, 16"} {
+		if _, err := Assemble(bad, nil); !errors.Is(err, ErrBad) {
+			t.Errorf("%q got %v, want ErrBad", bad, err)
+		}
+	}
+	if _, err := OUT(DestExec, 8); !errors.Is(err, ErrBad) {
+		t.Errorf("OUT(DestExec, 8) got %v, want ErrBad", err)
+	}
+	for _, code := range []uint16{0x60e0, 0x60e8, 0x7fe0} {
+		if text, err := Disassemble(code, nil); !errors.Is(err, ErrBad) {
+			t.Errorf("%04x disassembled to %q, %v", code, text, err)
+		}
+	}
+}
+
+func TestRelocate(t *testing.T) {
+	p, err := NewProgram(".program r\n.wrap_target\nloop:\n\tset\tx, 1\n\tjmp\tx--, loop\n.wrap\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	q, err := p.Relocate(4)
+	if err != nil {
+		t.Fatalf("failed to relocate: %v", err)
+	}
+	if fmt.Sprint(q.Code) != fmt.Sprint(p.Code) {
+		t.Errorf("code got=%04x want unchanged %04x", q.Code, p.Code)
+	}
+	if want := []uint16{0xe021, 0x0044}; fmt.Sprint(q.Image()) != fmt.Sprint(want) || q.LoadOffset() != 4 {
+		t.Errorf("image got=%04x at %d want=%04x at 4", q.Image(), q.LoadOffset(), want)
+	}
+	var buf bytes.Buffer
+	if err := q.WriteImage(&buf, binary.LittleEndian); err != nil || fmt.Sprintf("% x", buf.Bytes()) != "21 e0 44 00" {
+		t.Errorf("written image got=% x (%v)", buf.Bytes(), err)
+	}
+	if q.Labels["loop"] != 0 || q.Attr.WrapTarget != 0 || q.Attr.Wrap != 1 {
+		t.Errorf("labels got=%v wrap got=%d,%d want unchanged", q.Labels, q.Attr.WrapTarget, q.Attr.Wrap)
+	}
+	if p.LoadOffset() != 0 || p.Image()[1] != 0x0040 {
+		t.Errorf("original modified: %04x at %d", p.Image(), p.LoadOffset())
+	}
+	if errs := q.Validate(); len(errs) != 0 {
+		t.Errorf("relocated program invalid: %v", errs)
+	}
+	if dead := q.Unreachable(); len(dead) != 0 {
+		t.Errorf("relocated program has unreachable code: %v", dead)
+	}
+	if _, err := q.CyclesBetween("loop", "loop"); err != nil {
+		t.Errorf("relocated cycles failed: %v", err)
+	}
+	e := NewEmulator(q)
+	for i := 0; i < 6; i++ {
+		if _, err := e.Step(0); err != nil {
+			t.Fatalf("relocated step %d failed: %v", i, err)
+		}
+	}
+	if dot := q.DOT(); strings.Contains(dot, "n4") {
+		t.Errorf("relocated graph has relocated nodes:\n%s", dot)
+	}
+	for _, v := range []struct {
+		text string
+		want []string
+	}{
+		{strings.Join(q.MakeCHeader("test"), "\n"), []string{"#define r_wrap_target 0\n", "#define r_wrap 1\n", "    0x0040, //  1: jmp x-- loop\n", "    .origin = 4,\n"}},
+		{strings.Join(q.MakeRust("test"), "\n"), []string{"pub const R_WRAP: u8 = 1;\n", "        origin: Some(4),\n", "            source: 1,\n"}},
+		{strings.Join(q.MakePackage("test", nil), "\n"), []string{"\t\t0x0040,\n\t}, 4)\n"}},
+	} {
+		for _, want := range v.want {
+			if !strings.Contains(v.text, want) {
+				t.Errorf("missing %q in:\n%s", want, v.text)
+			}
+		}
+	}
+	if _, err := p.Relocate(31); err == nil {
+		t.Error("relocation beyond 32 instructions accepted")
+	}
+	listing := q.Disassemble()
+	for _, want := range []string{".wrap_target", "loop:", "\tjmp\tx-- loop", ".wrap"} {
+		found := false
+		for _, line := range listing {
+			found = found || line == want
+		}
+		if !found {
+			t.Errorf("missing %q in relocated listing:\n%s", want, strings.Join(listing, "\n"))
+		}
+	}
+	c, err := Cat("rr", p, p)
+	if err != nil {
+		t.Fatalf("failed to cat: %v", err)
+	}
+	if c, err = c.Relocate(4); err != nil {
+		t.Fatalf("failed to relocate combined: %v", err)
+	}
+	pp := append(append([]uint16(nil), p.Code...), p.Code...)
+	for i, r := range []*Program{q, c} {
+		text := strings.Join(r.Disassemble(), "\n")
+		ps, err := ParseFile(text)
+		if err != nil {
+			t.Fatalf("failed to recompile %q: %v", text, err)
+		}
+		var code []uint16
+		for _, s := range ps {
+			code = append(code, s.Code...)
+		}
+		if want := pp[:len(r.Code)]; fmt.Sprint(code) != fmt.Sprint(want) {
+			t.Errorf("[%d] recompiled code got=%04x want unrelocated %04x", i, code, want)
+		}
+	}
+}
+
+func TestWaitJmpPin(t *testing.T) {
+	p := &Program{Attr: Settings{PioVersion: 1, SideSet: 1, SideSetOpt: true}}
+	vs := []struct {
+		src, dis string
+		code     uint16
+	}{
+		{"wait 1 jmppin", "wait\t1 jmppin", 0x20e0},
+		{"wait 1 jmppin + 0", "wait\t1 jmppin", 0x20e0},
+		{"wait 0 jmppin + 3", "wait\t0 jmppin + 3", 0x2063},
+		{"wait 1 jmppin side 1", "wait\t1 jmppin\tside 1", 0x38e0},
+		{"wait 1 jmppin [2]", "wait\t1 jmppin [2]", 0x22e0},
+	}
+	for i, v := range vs {
+		code, err := Assemble(v.src, p)
+		if err != nil {
+			t.Errorf("[%d] failed to assemble %q: %v", i, v.src, err)
+			continue
+		}
+		if code != v.code {
+			t.Errorf("[%d] got=%04x want=%04x", i, code, v.code)
+		}
+		if dis, err := Disassemble(code, p); err != nil || dis != v.dis {
+			t.Errorf("[%d] got=%q, %v want=%q", i, dis, err, v.dis)
+		}
+	}
+	if _, err := Assemble("wait 1 jmppin +", p); err == nil {
+		t.Error("missing pin offset accepted")
+	}
+}
+
+func TestXRef(t *testing.T) {
+	p, err := NewProgram(".program x\nstart:\n\tset\tx, 3\nloop:\n\tjmp\tx--, loop\n\tjmp\tloop\nunused:\n\tnop\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	refs := p.XRef()
+	want := map[string]LabelRef{
+		"start":  {Def: 0, Uses: []uint16{}},
+		"loop":   {Def: 1, Uses: []uint16{1, 2}},
+		"unused": {Def: 3, Uses: []uint16{}},
+	}
+	if len(refs) != len(want) {
+		t.Fatalf("got=%v want=%v", refs, want)
+	}
+	for label, w := range want {
+		got, ok := refs[label]
+		if !ok || got.Def != w.Def || got.Uses == nil || fmt.Sprint(got.Uses) != fmt.Sprint(w.Uses) {
+			t.Errorf("%q got=%+v want=%+v", label, got, w)
+		}
+	}
+}
+
+func TestNewProgramFromReader(t *testing.T) {
+	p, err := NewProgramFromReader("ok.pio", strings.NewReader(".program ok\n\tset\tx, 1\n"))
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if len(p.Code) != 1 || p.Code[0] != 0xe021 {
+		t.Errorf("got=%04x want=[e021]", p.Code)
+	}
+	_, err = NewProgramFromReader("bad.pio", strings.NewReader(".program bad\n\tset\tx, 99\n"))
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("got=%v want a *ParseError", err)
+	}
+	if pe.File != "bad.pio" || pe.Line != 2 || !strings.HasPrefix(err.Error(), "bad.pio: line 2") {
+		t.Errorf("bad error: %v", err)
+	}
+	_, err = ParseReader("multi.pio", strings.NewReader(".program a\n\tnop\n.program b\n\tbogus\n"))
+	if !errors.As(err, &pe) || pe.File != "multi.pio" || pe.Line != 4 {
+		t.Errorf("bad error: %v", err)
+	}
+}
+
+func TestImage(t *testing.T) {
+	p, err := NewProgram(".program image\n\tset\tx, 1\n\tjmp\tx--, 0\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		var buf bytes.Buffer
+		if err := p.WriteImage(&buf, order); err != nil {
+			t.Fatalf("%v: failed to write: %v", order, err)
+		}
+		if got := order.Uint16(buf.Bytes()); got != 0xe021 {
+			t.Errorf("%v: got=%04x want=e021", order, got)
+		}
+		q, err := LoadImage(&buf, order, len(p.Code))
+		if err != nil {
+			t.Fatalf("%v: failed to load: %v", order, err)
+		}
+		if fmt.Sprint(q.Image()) != fmt.Sprint(p.Image()) {
+			t.Errorf("%v: got=%04x want=%04x", order, q.Image(), p.Image())
+		}
+	}
+	if _, err := LoadImage(bytes.NewReader([]byte{0x21, 0xe0}), binary.LittleEndian, 2); err == nil {
+		t.Error("short image accepted")
+	}
+}
+
+func TestValidateSideSet(t *testing.T) {
+	p, err := NewProgram(".program unused\n.side_set 1 opt\n\tnop\n\tnop [3]\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	errs := p.Validate()
+	if len(errs) != 1 || !errors.Is(errs[0], ErrSideSet) {
+		t.Fatalf("got=%v want one ErrSideSet", errs)
+	}
+	if got, want := errs[0].Error(), `line 2: "unused" optional side-set 1 bits never used: side-set misconfigured`; got != want {
+		t.Errorf("got=%q want=%q", got, want)
+	}
+
+	p, err = NewProgram(".program used\n.side_set 1 opt\n\tnop side 1\n\tnop [3]\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if errs := p.Validate(); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	// Corrupt the second instruction to set a side-set bit
+	// without the opt bit.
+	p.Code[1] |= 0b100000000000
+	errs = p.Validate()
+	if len(errs) != 1 || !errors.Is(errs[0], ErrSideSet) || !strings.HasPrefix(errs[0].Error(), "line 4: offset 1: ") {
+		t.Errorf("got=%v want line 4 ErrSideSet", errs)
+	}
+}
+
+func TestMovOp(t *testing.T) {
+	vs := []struct {
+		src  string
+		code uint16
+		op   MovOp
+	}{
+		{"mov\tx, y", 0xa022, MovNone},
+		{"mov\tx, !y", 0xa02a, MovInvert},
+		{"mov\tx, ::y", 0xa032, MovReverse},
+	}
+	for i, v := range vs {
+		code, err := Assemble(v.src, nil)
+		if err != nil || code != v.code {
+			t.Errorf("[%d] got=%04x, %v want=%04x", i, code, err, v.code)
+			continue
+		}
+		if op := MovOp(code>>3) & 0b11; op != v.op {
+			t.Errorf("[%d] op got=%d want=%d", i, op, v.op)
+		}
+		if dis, err := Disassemble(code, nil); err != nil || dis != v.src {
+			t.Errorf("[%d] got=%q, %v want=%q", i, dis, err, v.src)
+		}
+	}
+	if got := MovInvert.Apply(0x0000ffff); got != 0xffff0000 {
+		t.Errorf("invert got=%08x", got)
+	}
+	if got := MovReverse.Apply(0x00000001); got != 0x80000000 {
+		t.Errorf("reverse got=%08x", got)
+	}
+	if got := MovNone.Apply(0x12345678); got != 0x12345678 {
+		t.Errorf("none got=%08x", got)
+	}
+}
+
+func TestMovOpSpacing(t *testing.T) {
+	vs := []struct {
+		src  string
+		code uint16
+	}{
+		{"mov x, !y", 0xa02a},
+		{"mov x, ! y", 0xa02a},
+		{"mov x, ::y", 0xa032},
+		{"mov x, :: y", 0xa032},
+		{"mov x, :: y [1]", 0xa132},
+	}
+	for i, v := range vs {
+		if code, err := Assemble(v.src, nil); err != nil || code != v.code {
+			t.Errorf("[%d] %q got=%04x, %v want=%04x", i, v.src, code, err, v.code)
+		}
+	}
+	for _, bad := range []string{"mov x, !", "mov x, bogus", "mov x, ! bogus"} {
+		if code, err := Assemble(bad, nil); err == nil {
+			t.Errorf("%q accepted as %04x", bad, code)
+		}
+	}
+}
+
+func TestBuilders(t *testing.T) {
+	build := func(code uint16, err error) uint16 {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("failed to build: %v", err)
+		}
+		return code
+	}
+	vs := []struct {
+		code uint16
+		src  string
+	}{
+		{build(JMP(CondXDec, 3)), "jmp x--, 3"},
+		{build(JMP(CondAlways, 0)), "jmp 0"},
+		{build(OUT(DestY, 32)), "out y, 32"},
+		{build(OUT(DestExec, 16)), "out exec, 16"},
+		{build(SET(DestPindirs, 1)), "set pindirs, 1"},
+		{build(MOV(MDestX, MovReverse, MSrcY)), "mov x, ::y"},
+		{build(MOV(MDestOSR, MovNone, MSrcStatus)), "mov osr, status"},
+	}
+	for i, v := range vs {
+		want, err := Assemble(v.src, nil)
+		if err != nil {
+			t.Fatalf("[%d] failed to assemble %q: %v", i, v.src, err)
+		}
+		if v.code != want {
+			t.Errorf("[%d] %q got=%04x want=%04x", i, v.src, v.code, want)
+		}
+	}
+	for i, err := range []error{
+		func() error { _, err := JMP(CondAlways, 32); return err }(),
+		func() error { _, err := OUT(DestX, 0); return err }(),
+		func() error { _, err := OUT(DestExec, 8); return err }(),
+		func() error { _, err := SET(DestPC, 1); return err }(),
+		func() error { _, err := SET(DestX, 32); return err }(),
+		func() error { _, err := MOV(MDestX, MovOp(3), MSrcY); return err }(),
+		func() error { _, err := MOV(MDestX, MovNone, MSource(4)); return err }(),
+	} {
+		if err == nil {
+			t.Errorf("[%d] invalid instruction built", i)
+		}
+	}
+	if got := CondXNotEqualY.String(); got != "x!=y" {
+		t.Errorf("got=%q want x!=y", got)
+	}
+}
+
+func TestNop(t *testing.T) {
+	p := &Program{Attr: Settings{SideSet: 1, SideSetOpt: true}}
+	vs := []struct {
+		src, dis string
+		code     uint16
+	}{
+		{"nop", "nop\t", 0xa042},
+		{"mov y, y", "nop\t", 0xa042},
+		{"nop [1]", "nop\t [1]", 0xa142},
+		{"nop side 1", "nop\t\tside 1", 0xb842},
+		{"nop side 1 [3]", "nop\t\tside 1 [3]", 0xbb42},
+	}
+	for i, v := range vs {
+		code, err := Assemble(v.src, p)
+		if err != nil || code != v.code {
+			t.Errorf("[%d] %q got=%04x, %v want=%04x", i, v.src, code, err, v.code)
+			continue
+		}
+		dis, err := Disassemble(code, p)
+		if err != nil || dis != v.dis {
+			t.Errorf("[%d] got=%q, %v want=%q", i, dis, err, v.dis)
+		}
+		if again, err := Assemble(dis, p); err != nil || again != code {
+			t.Errorf("[%d] %q round trip got=%04x, %v", i, dis, again, err)
+		}
+	}
+}
+
+func TestNopDelay(t *testing.T) {
+	for _, delay := range []uint16{1, 3, 31} {
+		src := fmt.Sprintf("nop [%d]", delay)
+		code, err := Assemble(src, nil)
+		if err != nil {
+			t.Fatalf("failed to assemble %q: %v", src, err)
+		}
+		if want := 0xa042 | delay<<8; code != want {
+			t.Errorf("%q got=%04x want=%04x", src, code, want)
+		}
+		dis, err := Disassemble(code, nil)
+		if err != nil || dis != "nop\t "+src[4:] {
+			t.Errorf("%q disassembled as %q, %v", src, dis, err)
+		}
+		if again, err := Assemble(dis, nil); err != nil || again != code {
+			t.Errorf("%q round trip got=%04x, %v", dis, again, err)
+		}
+	}
+}
+
+func TestDisassembleAnnotate(t *testing.T) {
+	p, err := NewProgram(".program pc\n.out 32\n.wrap_target\nloop:\n\tpull\tblock\n\tout\ty, 32\n\tjmp\tloop\n.wrap\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	got := strings.Join(p.DisassembleWith(&DisassembleOptions{Annotate: true}), "\n")
+	want := `.program pc
+.out 32 right
+.wrap_target
+loop:
+00: 0x80a0  pull	block
+01: 0x6040  out	y, 32
+02: 0x0000  jmp	loop
+.wrap`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	q, err := p.Relocate(4)
+	if err != nil {
+		t.Fatalf("failed to relocate: %v", err)
+	}
+	got = strings.Join(q.DisassembleWith(&DisassembleOptions{Annotate: true}), "\n")
+	want = `.program pc
+.out 32 right
+.wrap_target
+loop:
+04: 0x80a0  pull	block
+05: 0x6040  out	y, 32
+06: 0x0004  jmp	loop
+.wrap`
+	if got != want {
+		t.Errorf("relocated got:\n%s\nwant:\n%s", got, want)
+	}
+	c, err := Cat("pcs", p, p)
+	if err != nil {
+		t.Fatalf("failed to cat: %v", err)
+	}
+	lines := c.DisassembleWith(&DisassembleOptions{Annotate: true})
+	if got := lines[len(lines)-2]; got != "05: 0x0003  jmp\tloop" {
+		t.Errorf("combined got %q in:\n%s", got, strings.Join(lines, "\n"))
+	}
+}
+
+func TestIRQModes(t *testing.T) {
+	vs := []struct {
+		src  string
+		code uint16
+	}{
+		{"irq 3", 0xc003},
+		{"irq set 3", 0xc003},
+		{"irq nowait 3", 0xc003},
+		{"irq wait 3", 0xc023},
+		{"irq clear 3", 0xc043},
+	}
+	for i, v := range vs {
+		if code, err := Assemble(v.src, nil); err != nil || code != v.code {
+			t.Errorf("[%d] %q got=%04x, %v want=%04x", i, v.src, code, err, v.code)
+		}
+	}
+	for _, bad := range []string{"irq clear wait 3", "irq wait clear 3", "irq set wait 3"} {
+		_, err := Assemble(bad, nil)
+		if !errors.Is(err, ErrBad) || !strings.Contains(err.Error(), "mutually exclusive") {
+			t.Errorf("%q got=%v", bad, err)
+		}
+	}
+	if dis, err := Disassemble(0xc063, nil); err != nil || dis != "irq\tclear 3" {
+		t.Errorf("got=%q, %v want clear only", dis, err)
+	}
+}
+
+func TestKeepComments(t *testing.T) {
+	src := `.program keep
+; Toggle a pin.
+.set 1
+
+.wrap_target
+loop:
+	set	pins, 1 [1]	; high
+	// low
+	set	pins, 0
+
+	jmp	loop
+.wrap
+# the end
+`
+	p, err := NewProgramWith(src, &NewProgramOptions{Comments: true})
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	got := strings.Join(p.Disassemble(), "\n")
+	want := `.program keep
+.set 1
+; Toggle a pin.
+
+.wrap_target
+loop:
+	set	pins, 1 [1]	; high
+// low
+	set	pins, 0
+
+	jmp	loop
+.wrap
+# the end`
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	q, err := NewProgram(src)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if q.Comments != nil || q.InlineComments != nil {
+		t.Errorf("comments retained by default: %v %v", q.Comments, q.InlineComments)
+	}
+}
+
+func TestFifoMovStatus(t *testing.T) {
+	p, err := NewProgram(".program f\n.pio_version 1\n.fifo putget\n.mov_status irq set 3\n\tmov\tx, status\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if p.Attr.FifoMode != FifoPutGet || p.Attr.MovStatusSel != StatusIRQ || p.Attr.MovStatusN != 3 {
+		t.Errorf("got attr=%+v", p.Attr)
+	}
+	listing := strings.Join(p.Disassemble(), "\n")
+	for _, want := range []string{".fifo putget", ".mov_status irq set 3"} {
+		if !strings.Contains(listing, want) {
+			t.Errorf("listing missing %q:\n%s", want, listing)
+		}
+	}
+	q, err := NewProgram(listing)
+	if err != nil {
+		t.Fatalf("failed to recompile: %v", err)
+	}
+	if q.Attr.FifoMode != p.Attr.FifoMode || q.Attr.MovStatusSel != p.Attr.MovStatusSel || q.Attr.MovStatusN != p.Attr.MovStatusN {
+		t.Errorf("round trip got=%+v want=%+v", q.Attr, p.Attr)
+	}
+	header := strings.Join(p.MakeCHeader("test"), "\n")
+	for _, want := range []string{"sm_config_set_fifo_join(&c, PIO_FIFO_JOIN_PUTGET);", "sm_config_set_mov_status(&c, STATUS_IRQ_SET, 3);"} {
+		if !strings.Contains(header, want) {
+			t.Errorf("header missing %q", want)
+		}
+	}
+	if pkg := strings.Join(p.MakePackage("test", nil), "\n"); !strings.Contains(pkg, "\tcfg.ShiftCtrl |= 1<<15 | 1<<14 // .fifo putget\n") {
+		t.Errorf("package missing fifo putget:\n%s", pkg)
+	}
+	if py := strings.Join(p.MakeMicroPython(), "\n"); !strings.Contains(py, "\nf[4] |= 1<<15 | 1<<14  # .fifo putget\n") {
+		t.Errorf("MicroPython missing fifo putget:\n%s", py)
+	}
+
+	p, err = NewProgram(".program g\n.fifo tx\n.mov_status rxfifo < 2\n\tmov\tx, status\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if p.Attr.FifoMode != FifoTx || p.Attr.MovStatusSel != StatusRxLess || p.Attr.MovStatusN != 2 {
+		t.Errorf("got attr=%+v", p.Attr)
+	}
+	if pkg := strings.Join(p.MakePackage("test", nil), "\n"); !strings.Contains(pkg, "cfg.SetFIFOJoin(pio.FifoJoinTx)") {
+		t.Error("package missing fifo join")
+	}
+
+	if _, err := NewProgram(".program b\n.fifo\n"); err == nil || !strings.Contains(err.Error(), "syntax error for .fifo") {
+		t.Errorf("missing .fifo mode got %v", err)
+	}
+	for _, bad := range []string{
+		".program b\n.fifo putget\n",
+		".program b\n.fifo sideways\n",
+		".program b\n.mov_status irq set 1\n",
+		".program b\n.mov_status txfifo 2\n",
+		".program b\n\tnop\n.fifo rx\n",
+	} {
+		if _, err := NewProgram(bad); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func TestDisassembleStruct(t *testing.T) {
+	p, err := NewProgram(".program s\n.side_set 1 opt\nloop:\n\tjmp\tx--, loop side 1 [2]\n\tout\tpins, 32\n\tmov\tisr, ::osr [3]\n\tset\tpindirs, 5\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	want := []DecodedInstruction{
+		{Mnemonic: "jmp", Operands: "x-- loop", Condition: "x--", Label: "loop", Delay: 2, SideSet: 1, HasSideSet: true, Flags: flagCondition | flagAddress},
+		{Mnemonic: "out", Operands: "pins, 32", Destination: "pins", Immediate: 32, Flags: flagDestination | flagBitCount},
+		{Mnemonic: "mov", Operands: "isr, ::osr", Destination: "isr", Source: "osr", Op: MovReverse, Delay: 3, Flags: flagMDestination | flagOp | flagMSource},
+		{Mnemonic: "set", Operands: "pindirs, 5", Destination: "pindirs", Immediate: 5, Flags: flagDestination | flagData},
+	}
+	for i, code := range p.Code {
+		got, err := DisassembleStruct(code, p)
+		if err != nil {
+			t.Fatalf("[%d] failed to decode %04x: %v", i, code, err)
+		}
+		if got != want[i] {
+			t.Errorf("[%d] got=%+v want=%+v", i, got, want[i])
+		}
+	}
+	if _, err := DisassembleStruct(0x8001, nil); err == nil {
+		t.Error("invalid instruction decoded")
+	}
+	q := &Program{Attr: Settings{PioVersion: 1}}
+	vs := []struct {
+		src  string
+		want DecodedInstruction
+	}{
+		{"wait 1 irq next 3", DecodedInstruction{Mnemonic: "wait", Operands: "1 irq next 3", Source: "irq", Polarity: 1, Immediate: 3, IndexMode: "next"}},
+		{"wait 0 irq 7", DecodedInstruction{Mnemonic: "wait", Operands: "0 irq 7", Source: "irq", Immediate: 7, IndexMode: "absolute"}},
+		{"wait 0 gpio 17", DecodedInstruction{Mnemonic: "wait", Operands: "0 gpio 17", Source: "gpio", Immediate: 17}},
+		{"irq prev 2", DecodedInstruction{Mnemonic: "irq", Operands: "prev 2", Immediate: 2, IndexMode: "prev"}},
+		{"mov rxfifo[y], isr", DecodedInstruction{Mnemonic: "mov", Operands: "rxfifo[y], isr", Destination: "rxfifo[y]", Source: "isr"}},
+		{"mov osr, rxfifo[2]", DecodedInstruction{Mnemonic: "mov", Operands: "osr, rxfifo[2]", Destination: "osr", Source: "rxfifo[2]"}},
+		{"nop", DecodedInstruction{Mnemonic: "nop", Destination: "y", Source: "y"}},
+		{"wait 1 jmppin + 2", DecodedInstruction{Mnemonic: "wait", Operands: "1 jmppin + 2", Source: "jmppin", Polarity: 1, Immediate: 2}},
+		{"push iffull block", DecodedInstruction{Mnemonic: "push", Operands: "iffull block", IfFull: true, Block: true}},
+		{"pull noblock", DecodedInstruction{Mnemonic: "pull", Operands: "noblock"}},
+		{"pull ifempty", DecodedInstruction{Mnemonic: "pull", Operands: "ifempty block", IfEmpty: true, Block: true}},
+		{"irq wait 5 rel", DecodedInstruction{Mnemonic: "irq", Operands: "wait 5 rel", Wait: true, Immediate: 5, IndexMode: "rel"}},
+		{"irq next clear 1", DecodedInstruction{Mnemonic: "irq", Operands: "next clear 1", Clear: true, Immediate: 1, IndexMode: "next"}},
+	}
+	for i, v := range vs {
+		code, err := Assemble(v.src, q)
+		if err != nil {
+			t.Fatalf("[%d] failed to assemble %q: %v", i, v.src, err)
+		}
+		got, err := DisassembleStruct(code, q)
+		if err != nil {
+			t.Fatalf("[%d] failed to decode %04x: %v", i, code, err)
+		}
+		v.want.Flags = instructions[decode(code)].flags
+		if got != v.want {
+			t.Errorf("[%d] got=%+v want=%+v", i, got, v.want)
+		}
+		if text, err := Disassemble(code, q); err != nil || text != v.want.Mnemonic+"\t"+v.want.Operands {
+			t.Errorf("[%d] got=%q, %v want the %q operands", i, text, err, v.want.Operands)
+		}
+	}
+}
+
+func TestValidateAutoFIFO(t *testing.T) {
+	p, err := NewProgram(".program auto\n.out 8 left auto 8\n.in 8 left auto 8\n\tpull\tblock\n\tout\tx, 8\n\tin\tx, 8\n\tpush\tiffull block\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	errs := p.Validate()
+	if len(errs) != 2 {
+		t.Fatalf("got=%v want 2 errors", errs)
+	}
+	for i, want := range []string{"line 4: offset 0: pull", "line 7: offset 3: push"} {
+		if !errors.Is(errs[i], ErrAutoFIFO) || !strings.HasPrefix(errs[i].Error(), want) {
+			t.Errorf("[%d] got=%v want prefix %q", i, errs[i], want)
+		}
+	}
+	p, err = NewProgram(".program manual\n.out 8 left\n\tpull\tblock\n\tout\tx, 8\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if errs := p.Validate(); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
+
+func TestSetDestinations(t *testing.T) {
+	for _, dest := range []string{"pins", "x", "y", "pindirs"} {
+		if _, err := Assemble("set "+dest+", 1", nil); err != nil {
+			t.Errorf("set %s rejected: %v", dest, err)
+		}
+	}
+	for _, dest := range []string{"null", "pc", "isr", "exec"} {
+		_, err := Assemble("set "+dest+", 1", nil)
+		if !errors.Is(err, ErrBad) || !strings.Contains(err.Error(), "invalid set destination") {
+			t.Errorf("set %s got=%v", dest, err)
+		}
+	}
+}
+
+func TestClockDiv(t *testing.T) {
+	p, err := NewProgram(".program slow\n.clock_div 2.5\n\tnop\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if p.Attr.ClockDiv != 2.5 {
+		t.Errorf("got=%v want=2.5", p.Attr.ClockDiv)
+	}
+	if listing := strings.Join(p.Disassemble(), "\n"); !strings.Contains(listing, ".clock_div 2.5\n") {
+		t.Errorf("listing missing .clock_div:\n%s", listing)
+	}
+	if header := strings.Join(p.MakeCHeader("test"), "\n"); !strings.Contains(header, "sm_config_set_clkdiv(&c, 2.5);") {
+		t.Error("header missing clkdiv")
+	}
+	if pkg := strings.Join(p.MakePackage("test", nil), "\n"); !strings.Contains(pkg, "cfg.SetClkDivIntFrac(2, 128)") {
+		t.Error("package missing clkdiv")
+	}
+	for _, bad := range []string{"0", "-1", "0.5", "fast", "70000"} {
+		if _, err := NewProgram(".program bad\n.clock_div " + bad + "\n"); err == nil {
+			t.Errorf(".clock_div %s accepted", bad)
+		}
+	}
+}
+
+func TestSortedLabels(t *testing.T) {
+	a, err := NewProgram(".program a\npublic start:\nloop:\n\tset\tx, 1\n\tjmp\tloop\nend:\n")
+	if err != nil {
+		t.Fatalf("failed to compile a: %v", err)
+	}
+	b, err := NewProgram(".program b\nagain:\n\tjmp\tagain\n")
+	if err != nil {
+		t.Fatalf("failed to compile b: %v", err)
+	}
+	p, err := Cat("ab", a, b)
+	if err != nil {
+		t.Fatalf("failed to cat: %v", err)
+	}
+	got := fmt.Sprint(p.SortedLabels())
+	want := "[{a0_loop 0} {a0_origin 0} {a0_start 0} {a0_wrap_target 0} {a0_end 2} {a0_wrap 2} {b1_again 2} {b1_origin 2} {b1_wrap_target 2} {b1_wrap 3}]"
+	if got != want {
+		t.Errorf("got=%s\nwant=%s", got, want)
+	}
+	render := func() string {
+		return strings.Join(append(append(p.Disassemble(), p.MakeCHeader("x")...), p.MakePackage("x", nil)...), "\n")
+	}
+	first := render()
+	for i := 0; i < 20; i++ {
+		if render() != first {
+			t.Fatal("generated output is not deterministic")
+		}
+	}
+}
+
+func TestIfEndif(t *testing.T) {
+	src := `.program cond
+.define VERSION 1
+.define FAST 0
+.if VERSION >= 1
+	set	x, 1
+.if FAST
+	set	x, 2
+.endif
+.if FAST == 0
+	set	x, 3
+.endif
+.endif
+.if VERSION < 1
+	set	x, 4
+.if 1
+	set	x, 5
+.endif
+.endif
+.if pio_version == 0
+	set	x, 6
+.endif
+`
+	p, err := NewProgram(src)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	want := []uint16{0xe021, 0xe023, 0xe026}
+	if fmt.Sprint(p.Code) != fmt.Sprint(want) {
+		t.Errorf("got=%04x want=%04x", p.Code, want)
+	}
+	vs := []struct {
+		src  string
+		line int
+	}{
+		{".program bad\n\tnop\n.endif\n", 3},
+		{".program bad\n.if 1\n\tnop\n", 2},
+		{".program bad\n.if UNKNOWN\n.endif\n", 2},
+		{".program bad\n.if 1 =< 2\n.endif\n", 2},
+	}
+	for i, v := range vs {
+		_, err := NewProgram(v.src)
+		var pe *ParseError
+		if !errors.As(err, &pe) || pe.Line != v.line {
+			t.Errorf("[%d] got=%v want error on line %d", i, err, v.line)
+		}
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	src := ".program full\n" + strings.Repeat("\tnop\n", 29)
+	var warnings []error
+	p, err := NewProgramWith(src, &NewProgramOptions{Warn: func(err error) { warnings = append(warnings, err) }})
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if u := p.MemoryUsage(); u != (Usage{Instructions: 29, Free: 3}) || u.String() != "29/32 slots used" {
+		t.Errorf("got=%+v %q", u, u)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0].Error(), "29/32 slots used") {
+		t.Errorf("got warnings=%v", warnings)
+	}
+	p, err = NewProgram(".program small\n\tnop\n\tnop\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	q, err := p.Relocate(10)
+	if err != nil {
+		t.Fatalf("failed to relocate: %v", err)
+	}
+	if u := q.MemoryUsage(); u != (Usage{Instructions: 2, Free: 20}) {
+		t.Errorf("relocated got=%+v", u)
+	}
+	if _, err := q.Relocate(21); err == nil {
+		t.Error("second relocation beyond 32 instructions accepted")
+	}
+}
+
+func TestShiftConfig(t *testing.T) {
+	p, err := NewProgram(".program shift\n.out 8 left auto 16\n.in 4 right auto\n\tout\tpins, 8\n\tin\tpins, 4\n\tmov\tosr, x\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	a := p.Attr
+	if !a.OutLeft || !a.OutAuto || a.OutThreshold != 16 || a.InLeft || !a.InAuto || a.InThreshold != 0 {
+		t.Errorf("got attr=%+v", a)
+	}
+	pkg := strings.Join(p.MakePackage("test", nil), "\n")
+	for _, want := range []string{"cfg.SetOutShift(false, true, 16)", "cfg.SetInShift(true, true, 0)"} {
+		if !strings.Contains(pkg, want) {
+			t.Errorf("package missing %q", want)
+		}
+	}
+	header := strings.Join(p.MakeCHeader("test"), "\n")
+	for _, want := range []string{"sm_config_set_out_shift(&c, false, true, 16);", "sm_config_set_in_shift(&c, true, true, 0);"} {
+		if !strings.Contains(header, want) {
+			t.Errorf("header missing %q", want)
+		}
+	}
+	errs := p.Validate()
+	if len(errs) != 1 || !errors.Is(errs[0], ErrAutoFIFO) || !strings.Contains(errs[0].Error(), "mov osr") {
+		t.Errorf("got=%v want a mov osr warning", errs)
+	}
+	if _, err := NewProgram(".program bad\n.out 8 up\n"); err == nil {
+		t.Error("bad shift direction accepted")
+	}
+}
+
+func TestAutoFlags(t *testing.T) {
+	p, err := NewProgram(".program auto\n.out 8 left auto 32\n.in 8 auto\n\tout\tx, 8\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if !p.Attr.OutAuto || p.Attr.OutThreshold != 0 || !p.Attr.OutLeft {
+		t.Errorf("out got=%+v", p.Attr)
+	}
+	if !p.Attr.InAuto || p.Attr.InThreshold != 0 {
+		t.Errorf("in got=%+v", p.Attr)
+	}
+	listing := p.Disassemble()
+	for _, want := range []string{".in 8 right auto", ".out 8 left auto"} {
+		found := false
+		for _, line := range listing {
+			found = found || line == want
+		}
+		if !found {
+			t.Errorf("listing missing %q:\n%s", want, strings.Join(listing, "\n"))
+		}
+	}
+	q, err := NewProgram(strings.Join(listing, "\n"))
+	if err != nil {
+		t.Fatalf("failed to recompile: %v", err)
+	}
+	if q.Attr.OutAuto != p.Attr.OutAuto || q.Attr.InAuto != p.Attr.InAuto || q.Attr.OutLeft != p.Attr.OutLeft {
+		t.Errorf("round trip got=%+v want=%+v", q.Attr, p.Attr)
+	}
+}
+
+func TestDelayOverlaps(t *testing.T) {
+	p, err := NewProgram(".program timing\n\tset\tpins, 1 [12]\n\tset\tpins, 0 [3]\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if errs := p.DelayOverlaps(p.Attr); len(errs) != 0 {
+		t.Errorf("unexpected overlaps: %v", errs)
+	}
+	errs := p.DelayOverlaps(Settings{SideSet: 2})
+	if len(errs) != 1 || !errors.Is(errs[0], ErrDelayOverlap) {
+		t.Fatalf("got=%v want one ErrDelayOverlap", errs)
+	}
+	if got, want := errs[0].Error(), "line 2: offset 0: intended [12] interpreted as side 1 [4]: delay overlaps side-set bits"; got != want {
+		t.Errorf("got=%q want=%q", got, want)
+	}
+}
+
+func TestSemicolons(t *testing.T) {
+	src := ".program semi\nloop: \n\tset x, 1; jmp loop // again\n\tset x, 2 ; trailing\n"
+	var warnings []error
+	p, err := NewProgramWith(src, &NewProgramOptions{Warn: func(err error) { warnings = append(warnings, err) }})
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if len(p.Code) != 2 {
+		t.Errorf("got=%04x want 2 instructions", p.Code)
+	}
+	if len(warnings) != 1 || !strings.HasPrefix(warnings[0].Error(), "line 3:10: code after ';' is a comment") {
+		t.Errorf("got warnings=%v", warnings)
+	}
+
+	src = ".program semi\nloop: \n\tset x, 1; jmp loop // again\n\tset x, 2 # trailing\n"
+	p, err = NewProgramWith(src, &NewProgramOptions{Semicolons: true})
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	want := []uint16{0xe021, 0x0000, 0xe022}
+	if fmt.Sprint(p.Code) != fmt.Sprint(want) {
+		t.Errorf("got=%04x want=%04x", p.Code, want)
+	}
+	if got := p.lines; fmt.Sprint(got) != "[3 3 4]" {
+		t.Errorf("got lines=%v", got)
+	}
+
+	src = ".program div\n\tset x, (8 / 2); set y, (9/3) // not; code\n\tset pins, (4/2) ; nop # nor; this\n"
+	p, err = NewProgramWith(src, &NewProgramOptions{Semicolons: true})
+	if err != nil {
+		t.Fatalf("failed to compile division: %v", err)
+	}
+	want = []uint16{0xe024, 0xe043, 0xe002, 0xa042}
+	if fmt.Sprint(p.Code) != fmt.Sprint(want) {
+		t.Errorf("division got=%04x want=%04x", p.Code, want)
+	}
+
+	_, err = NewProgramWith(".program bad\n\tnop; bogus\n", &NewProgramOptions{Semicolons: true})
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Line != 2 || pe.RawLine != "\tnop; bogus" {
+		t.Errorf("got=%v want error on line 2", err)
+	}
+}
+
+func TestDOT(t *testing.T) {
+	p, err := NewProgram(".program flow\n.wrap_target\nloop:\n\tset\tx, 3\n\tjmp\tx--, loop\n\tjmp\tloop\n\tnop\n.wrap\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	want := `digraph "flow" {
+  node [shape=box, fontname=monospace];
+  n0 [label="loop:\n0: set x, 3"];
+  n1 [label="1: jmp x-- loop"];
+  n2 [label="2: jmp loop"];
+  n3 [label="3: nop"];
+  n0 -> n1;
+  n1 -> n0 [label="jmp"];
+  n1 -> n2;
+  n2 -> n0 [label="jmp"];
+  n3 -> n0 [style=dashed, label="wrap"];
+}
+`
+	if got := p.DOT(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+	p, err = NewProgram(".program nowrap\n\tset\tx, 1\n\tnop\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if got, want := p.DOT(), "  n1 -> n0 [style=dashed, label=\"wrap\"];\n"; !strings.Contains(got, want) {
+		t.Errorf("got:\n%s\nwant to contain: %q", got, want)
+	}
+}
+
+func TestRelativeJmp(t *testing.T) {
+	p, err := NewProgram(".program rel\n\tset\tx, 3\n\tjmp\tx--, -0\n\tjmp\t+2\n\tnop\n\tjmp\t-4\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	want := []uint16{0xe023, 0x0041, 0x0004, 0xa042, 0x0000}
+	if fmt.Sprint(p.Code) != fmt.Sprint(want) {
+		t.Errorf("got=%04x want=%04x", p.Code, want)
+	}
+	words, err := AssembleLines("\tnop\n\tjmp\t-1\n", nil)
+	if err != nil || fmt.Sprint(words) != fmt.Sprint([]uint16{0xa042, 0x0000}) {
+		t.Errorf("got=%04x, %v", words, err)
+	}
+	for _, bad := range []string{".program bad\n\tjmp\t-1\n", ".program bad\n\tjmp\t+32\n"} {
+		if _, err := NewProgram(bad); !errors.Is(err, ErrBad) {
+			t.Errorf("%q got %v, want ErrBad", bad, err)
+		}
+	}
+	if _, err := Assemble("jmp +1", nil); !errors.Is(err, ErrBad) {
+		t.Errorf("relative jmp without a program got %v, want ErrBad", err)
+	}
+}
+
+func TestSettingsValidate(t *testing.T) {
+	vs := []struct {
+		s   Settings
+		err bool
+	}{
+		{s: Settings{}},
+		{s: Settings{SideSet: 5}},
+		{s: Settings{SideSet: 6}, err: true},
+		{s: Settings{SideSet: 4, SideSetOpt: true}},
+		{s: Settings{SideSet: 5, SideSetOpt: true}, err: true},
+		{s: Settings{Set: 6}, err: true},
+		{s: Settings{Out: 32, OutThreshold: 32, In: 32, InThreshold: 32}},
+		{s: Settings{Out: 33}, err: true},
+		{s: Settings{InThreshold: 33}, err: true},
+		{s: Settings{PioVersion: 2}, err: true},
+		{s: Settings{FifoMode: FifoPutGet}, err: true},
+		{s: Settings{FifoMode: FifoPutGet, PioVersion: 1}},
+		{s: Settings{MovStatusSel: StatusIRQ, MovStatusN: 7, PioVersion: 1}},
+		{s: Settings{MovStatusSel: StatusIRQ, MovStatusN: 8, PioVersion: 1}, err: true},
+		{s: Settings{MovStatusN: 32}, err: true},
+		{s: Settings{ClockDiv: 0.5}, err: true},
+		{s: Settings{ClockDiv: 2.5}},
+	}
+	for i, v := range vs {
+		err := v.s.Validate()
+		if v.err != (err != nil) {
+			t.Errorf("test=%d got=%v want error=%v", i, err, v.err)
+		} else if err != nil && !errors.Is(err, ErrSettings) {
+			t.Errorf("test=%d got=%v, want ErrSettings", i, err)
+		}
+	}
+}
+
+func TestValidateExec(t *testing.T) {
+	p, err := NewProgram(`.program exec
+    set x, 3
+    mov exec, x
+    out exec, 16
+    mov exec, !y
+`)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	errs := p.Validate()
+	if len(errs) != 3 {
+		t.Fatalf("got %d errors, want 3: %v", len(errs), errs)
+	}
+	want := []string{
+		`line 3: offset 1: mov exec of x data (executes jmp 3): exec of data as instruction`,
+		`line 4: offset 2: out exec of osr data: exec of data as instruction`,
+		`line 5: offset 3: mov exec of !y data: exec of data as instruction`,
+	}
+	for i, err := range errs {
+		if !errors.Is(err, ErrExec) {
+			t.Errorf("[%d] got=%v, want ErrExec", i, err)
+		} else if got := err.Error(); got != want[i] {
+			t.Errorf("[%d] got=%q want=%q", i, got, want[i])
+		}
+	}
+}
+
+func TestErrDirective(t *testing.T) {
+	for _, line := range []string{".wrap", ".side_set 1 opt", "loop:", "public start:"} {
+		if _, err := Assemble(line, nil); err != ErrDirective {
+			t.Errorf("%q: got=%v want ErrDirective", line, err)
+		}
+	}
+	for _, line := range []string{"jmp x-- 99", "jmpp 3", "set x, 1 [99]"} {
+		if _, err := Assemble(line, nil); err == nil || errors.Is(err, ErrDirective) {
+			t.Errorf("%q: got=%v want a non-directive error", line, err)
+		}
+	}
+	vs := []struct {
+		src, want string
+	}{
+		{"jmpp 3", `line 2:1: invalid instruction "jmpp"`},
+		{"set x, 1 [32]", "line 2:10: bad set instruction: delay 32 exceeds max 31 with 0 side-set bits"},
+	}
+	for i, v := range vs {
+		_, err := NewProgram(".program typo\n" + v.src + "\n")
+		if err == nil {
+			t.Errorf("[%d] %q: expected an error", i, v.src)
+		} else if !strings.HasPrefix(err.Error(), v.want) {
+			t.Errorf("[%d] got=%q want=%q", i, err, v.want)
+		} else if !errors.Is(err, ErrBad) && !errors.Is(err, ErrDelay) {
+			t.Errorf("[%d] %q: got=%v, want a wrapped ErrBad or ErrDelay", i, v.src, err)
+		}
+	}
+}
+
+func TestMakeRust(t *testing.T) {
+	p, err := NewProgram(".program MyClock\n.side_set 1 opt\n.set 1\npublic entry:\n\tset\tpindirs, 1\n.wrap_target\n\tset\tpins, 0 [1]\n\tset\tpins, 1 side 1\n.wrap\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	text := strings.Join(p.MakeRust("test"), "\n")
+	for _, want := range []string{
+		"pub const MY_CLOCK_WRAP_TARGET: u8 = 1;\n",
+		"pub const MY_CLOCK_WRAP: u8 = 2;\n",
+		"pub const MY_CLOCK_OFFSET_ENTRY: u8 = 0;\n",
+		"pub fn my_clock_program() -> pio::Program<{ pio::RP2040_MAX_PROGRAM_SIZE }> {\n",
+		"            0xf801, //  2: set pins, 1 side 1\n",
+		"            source: 2,\n",
+		"        side_set: pio::SideSet::new(true, 1, false),\n",
+		"        version: pio::PioVersion::V0,\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("missing %q in:\n%s", want, text)
+		}
+	}
+}
+
+func TestMakeRustNoWrap(t *testing.T) {
+	p, err := NewProgram(".program blink\n\tset\tpins, 1 [31]\n\tset\tpins, 0 [31]\n\tjmp\t0\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	text := strings.Join(p.MakeRust("test"), "\n")
+	for _, want := range []string{
+		"pub const BLINK_WRAP: u8 = 2;\n",
+		"            0x0000, //  2: jmp 0\n            //     .wrap\n",
+		"            source: 2,\n            target: 0,\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("missing %q in:\n%s", want, text)
+		}
+	}
+	q, err := Cat("both", p, p)
+	if err != nil {
+		t.Fatalf("failed to cat: %v", err)
+	}
+	text = strings.Join(q.MakeRust("test"), "\n")
+	for _, want := range []string{
+		"pub const BLINK0_WRAP: u8 = 2;\n",
+		"pub const BLINK1_WRAP: u8 = 5;\n",
+		"pub fn both_program() -> pio::Program<{ pio::RP2040_MAX_PROGRAM_SIZE }> {\n",
+		"            0xff00, //  1: set pins, 0 [31]\n            0x0000, //  2: jmp blink0_origin\n            //     .wrap\n",
+		"            0x0003, //  5: jmp blink0_wrap\n            //     .wrap\n",
+		"            source: 2,\n            target: 0,\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("missing %q in:\n%s", want, text)
+		}
+	}
+}
+
+func TestCatModuleNames(t *testing.T) {
+	p, err := NewProgram(".program blink\n.set 1\n\tset\tpins, 1 [31]\n\tset\tpins, 0 [31]\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	q, err := Cat("both", p, p)
+	if err != nil {
+		t.Fatalf("failed to cat: %v", err)
+	}
+	vs := []struct {
+		text string
+		want []string
+	}{
+		{strings.Join(q.MakeCHeader("test"), "\n"), []string{
+			"#define blink0_wrap 1\n",
+			"#define blink1_wrap 3\n",
+			"static inline pio_sm_config blink1_program_get_default_config(uint offset) {\n",
+			"    sm_config_set_wrap(&c, offset + blink1_wrap_target, offset + blink1_wrap);\n",
+		}},
+		{strings.Join(q.MakePackage("test", &MakePackageOptions{WrapConsts: true}), "\n"), []string{
+			"\nconst Blink0Wrap = 1\n",
+			"\nconst Blink1Wrap = 3\n",
+			"\nfunc (e *Engine) ConfigureBlink1(setBase machine.Pin) (*StateMachine, error) {\n",
+		}},
+		{strings.Join(q.MakeMicroPython(), "\n"), []string{
+			"\ndef blink0():\n",
+			"\ndef blink1():\n",
+		}},
+	}
+	for i, v := range vs {
+		for _, want := range v.want {
+			if !strings.Contains(v.text, want) {
+				t.Errorf("[%d] missing %q in:\n%s", i, want, v.text)
+			}
+		}
+	}
+}
+
+func TestWord(t *testing.T) {
+	p, err := NewProgram(".program raw\n\tset\tx, 1\n.word 0xa042 ; a nop\n\tjmp\t1\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if want := []uint16{0xe021, 0xa042, 0x0001}; fmt.Sprint(p.Code) != fmt.Sprint(want) {
+		t.Errorf("got=%04x want=%04x", p.Code, want)
+	}
+	if got := p.where(1); got != "line 3: offset 1" {
+		t.Errorf("got=%q want line 3", got)
+	}
+	words, err := AssembleLines("set x, 1\n.word 0x1234\njmp 1", nil)
+	if err != nil {
+		t.Fatalf("failed to assemble lines: %v", err)
+	}
+	if want := []uint16{0xe021, 0x1234, 0x0001}; fmt.Sprint(words) != fmt.Sprint(want) {
+		t.Errorf("got=%04x want=%04x", words, want)
+	}
+	p, err = NewProgram(".program raw\n\tset\tx, 1\n.word 0x8001\n")
+	if err != nil {
+		t.Fatalf("failed to compile an undecodable word: %v", err)
+	}
+	for _, opts := range []*DisassembleOptions{{Indent: "\t"}, {Indent: "  ", Align: true, Upper: true, Hex: true}} {
+		listing := p.DisassembleWith(opts)
+		sep := "\t"
+		if opts.Align {
+			sep = " "
+		}
+		if got, want := listing[len(listing)-2], opts.Indent+".word"+sep+"0x8001"; got != want {
+			t.Errorf("got %q in:\n%s", got, strings.Join(listing, "\n"))
+		}
+		q, err := NewProgram(strings.Join(listing, "\n"))
+		if err != nil {
+			t.Fatalf("failed to recompile %q: %v", listing, err)
+		}
+		if fmt.Sprint(q.Code) != fmt.Sprint(p.Code) {
+			t.Errorf("recompiled got=%04x want=%04x", q.Code, p.Code)
+		}
+	}
+	for _, src := range []string{".word 0x10000", ".word", ".word x"} {
+		if _, err := NewProgram(".program bad\n" + src + "\n"); err == nil {
+			t.Errorf("%q: expected an error", src)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a, err := NewProgram(".program a\n\tset\tx, 1\nloop:\n\tjmp\tx--, loop\n\tnop\n")
+	if err != nil {
+		t.Fatalf("failed to compile a: %v", err)
+	}
+	b, err := NewProgram(".program a\n.set 1\n\tset\tx, 2\nagain:\n\tjmp\tx--, again\n")
+	if err != nil {
+		t.Fatalf("failed to compile b: %v", err)
+	}
+	if got := Diff(a, a); got != nil {
+		t.Errorf("self diff: got=%q", got)
+	}
+	want := []string{
+		"~Wrap: 3 -> 2",
+		"~Set: 0 -> 1",
+		"~00: set x, 1 -> set x, 2",
+		"-02: nop",
+		"+label again: 1",
+		"-label loop: 1",
+	}
+	if got := Diff(a, b); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got=%q want=%q", got, want)
+	}
+}
+
+func TestWaitSources(t *testing.T) {
+	vs := []struct {
+		src  string
+		code uint16
+		want string
+	}{
+		{"wait 1 gpio 3", 0x2083, "wait\t1 gpio 3"},
+		{"wait 0 gpio 31", 0x201f, "wait\t0 gpio 31"},
+		{"wait 1 pin 3", 0x20a3, "wait\t1 pin 3"},
+		{"wait 0 pin 0", 0x2020, "wait\t0 pin 0"},
+		{"wait 1 irq 2 rel", 0x20d2, "wait\t1 irq 2 rel"},
+	}
+	for i, v := range vs {
+		code, err := Assemble(v.src, nil)
+		if err != nil {
+			t.Errorf("[%d] %q failed: %v", i, v.src, err)
+			continue
+		}
+		if code != v.code {
+			t.Errorf("[%d] %q got=%04x want=%04x", i, v.src, code, v.code)
+		}
+		if got, err := Disassemble(code, nil); err != nil || got != v.want {
+			t.Errorf("[%d] got=%q (%v) want=%q", i, got, err, v.want)
+		}
+	}
+	gpio, _ := DisassembleStruct(0x2083, nil)
+	pin, _ := DisassembleStruct(0x20a3, nil)
+	if gpio.Source != "gpio" || pin.Source != "pin" {
+		t.Errorf("got sources %q and %q", gpio.Source, pin.Source)
+	}
+	for _, src := range []string{"wait 1 pin 3 rel", "wait 1 gpio 3 rel", "wait 1 gpio 32"} {
+		if _, err := Assemble(src, nil); err == nil {
+			t.Errorf("%q: expected an error", src)
+		}
+	}
+}
+
+func TestSetWrap(t *testing.T) {
+	p := &Program{}
+	for _, c := range []uint16{0xe021, 0x0041, 0xa042} {
+		p.Code = append(p.Code, c)
+	}
+	if err := p.SetWrap(1, 2); err != nil {
+		t.Fatalf("SetWrap(1, 2) failed: %v", err)
+	}
+	if p.Attr.WrapTarget != 1 || p.Attr.Wrap != 2 {
+		t.Errorf("got wrap_target=%d wrap=%d", p.Attr.WrapTarget, p.Attr.Wrap)
+	}
+	if err := p.SetWrap(0, 3); err != nil {
+		t.Errorf("SetWrap(0, 3) failed: %v", err)
+	}
+	for _, v := range [][2]uint16{{3, 3}, {0, 4}, {2, 1}} {
+		if err := p.SetWrap(v[0], v[1]); err == nil {
+			t.Errorf("SetWrap(%d, %d) expected an error", v[0], v[1])
+		}
+	}
+	q, err := p.Relocate(4)
+	if err != nil {
+		t.Fatalf("relocate failed: %v", err)
+	}
+	if err := q.SetWrap(1, 2); err != nil {
+		t.Errorf("relocated SetWrap(1, 2) failed: %v", err)
+	}
+	if err := q.SetWrap(5, 6); err == nil {
+		t.Error("relocated SetWrap(5, 6) expected an error")
+	}
+}
+
+func TestProgramName(t *testing.T) {
+	vs := []struct {
+		src, want string
+	}{
+		{".program a\n\tnop\n.program b\n\tnop\n", `line 3:1: second .program "b" after "a" of line 1`},
+		{".program a\n.program a\n", `line 2:1: second .program "a" after "a" of line 1`},
+		{".program my-prog\n\tnop\n", `line 1:12: invalid character '-' in .program name "my-prog"`},
+		{".program 2wire\n\tnop\n", `line 1:10: invalid character '2' in .program name "2wire"`},
+	}
+	for i, v := range vs {
+		_, err := NewProgram(v.src)
+		if err == nil {
+			t.Errorf("[%d] expected an error", i)
+		} else if !strings.HasPrefix(err.Error(), v.want) {
+			t.Errorf("[%d] got=%q want=%q", i, err, v.want)
+		}
+	}
+	if _, err := NewProgram(".program _wire2\n\tnop\n"); err != nil {
+		t.Errorf("valid name rejected: %v", err)
+	}
+	if ps, err := ParseFile(vs[0].src); err != nil || len(ps) != 2 {
+		t.Errorf("ParseFile got=%d programs, %v", len(ps), err)
+	}
+}
+
+func TestPinWriters(t *testing.T) {
+	p, err := NewProgram(".program dirs\n.set 2\n.out 1\n\tset\tpindirs, 3\n\tout\tpindirs, 1\n\tmov\tpins, x\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	pkg := strings.Join(p.MakePackage("test", nil), "\n")
+	for _, want := range []string{
+		"ConfigureDirs(outBase, setBase machine.Pin)",
+		"\t// The set pin group is written by: set pindirs.\n",
+		"\tsm.SetPindirsConsecutive(setBase, 2, false)\n",
+		"\t// The out pin group is written by: mov pins, out pindirs.\n",
+		"\tsm.SetPindirsConsecutive(outBase, 1, true)\n",
+	} {
+		if !strings.Contains(pkg, want) {
+			t.Errorf("missing %q in:\n%s", want, pkg)
+		}
+	}
+	hdr := strings.Join(p.MakeCHeader("test"), "\n")
+	for _, want := range []string{
+		"    // use sm_config_set_out_pins() for: mov pins, out pindirs\n",
+		"    // use sm_config_set_set_pins() for: set pindirs\n",
+	} {
+		if !strings.Contains(hdr, want) {
+			t.Errorf("missing %q in:\n%s", want, hdr)
+		}
+	}
+	if c := p.PinConfig(); c.OutCount != 1 || c.Total != 3 {
+		t.Errorf("got pin config %+v", c)
+	}
+	p, err = NewProgram(".program noout\n\tmov\tpins, x\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if pkg := strings.Join(p.MakePackage("test", nil), "\n"); strings.Contains(pkg, "outBase") {
+		t.Errorf("outBase without .out in:\n%s", pkg)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	p := &Program{}
+	for _, line := range []string{
+		"start:",
+		"\tjmp\tpin, done",
+		"\tjmp\tstart",
+		"",
+		"public done:",
+		"\tset\tx, 1",
+	} {
+		if err := p.Append(line); err != nil {
+			t.Fatalf("Append(%q) failed: %v", line, err)
+		}
+	}
+	if err := p.Finalize(); err != nil {
+		t.Fatalf("Finalize failed: %v", err)
+	}
+	if want := []uint16{0x00c2, 0x0000, 0xe021}; fmt.Sprint(p.Code) != fmt.Sprint(want) {
+		t.Errorf("got=%04x want=%04x", p.Code, want)
+	}
+	if !p.Public["done"] || p.Targets[2][0] != "done" {
+		t.Errorf("bad labels: public=%v targets=%v", p.Public, p.Targets)
+	}
+	for _, line := range []string{"start:", ".wrap", "jmp 99"} {
+		if err := p.Append(line); err == nil {
+			t.Errorf("Append(%q) expected an error", line)
+		}
+	}
+	q := &Program{}
+	if err := q.Append("jmp nowhere"); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	if err := q.Finalize(); !errors.Is(err, ErrRedo) {
+		t.Errorf("got=%v want an unresolved symbol error", err)
+	}
+}
+
+func TestForwardLabel(t *testing.T) {
+	p, err := NewProgram(".program fwd\n\tjmp\tahead\n\tjmp\t!x, ahead\n\tnop\nahead:\n\tset\tx, 1\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if want := []uint16{0x0003, 0x0023, 0xa042, 0xe021}; fmt.Sprint(p.Code) != fmt.Sprint(want) {
+		t.Errorf("got=%04x want=%04x", p.Code, want)
+	}
+	if p.Labels["ahead"] != 3 {
+		t.Errorf("got ahead=%d want 3", p.Labels["ahead"])
+	}
+}
+
+func TestCatListing(t *testing.T) {
+	a, err := NewProgram(".program a\n.side_set 1\n\tset\tpins, 1 side 1\nloop:\n\tjmp\tloop side 0\n.wrap\n")
+	if err != nil {
+		t.Fatalf("failed to compile a: %v", err)
+	}
+	b, err := NewProgram(".program b\n.side_set 2 opt\n.out 8 left auto\npublic start:\n\tout\tpins, 8\n.wrap_target\n\tjmp\t!osre, start side 1\n\tjmp\t1\n.wrap\n")
+	if err != nil {
+		t.Fatalf("failed to compile b: %v", err)
+	}
+	p, err := Cat("ab", a, b)
+	if err != nil {
+		t.Fatalf("failed to cat a, b: %v", err)
+	}
+	listing := strings.Join(p.Disassemble(), "\n")
+	for _, want := range []string{
+		".program a\n.side_set 1\n",
+		"\n\n.program b\n.out 8 left auto\n.side_set 2 opt\n",
+		"\npublic start:\n",
+		"\tjmp\t1\n",
+	} {
+		if !strings.Contains(listing, want) {
+			t.Errorf("missing %q in:\n%s", want, listing)
+		}
+	}
+	ps, err := ParseFile(listing)
+	if err != nil {
+		t.Fatalf("failed to parse listing: %v\n%s", err, listing)
+	}
+	q, err := Cat("ab", ps...)
+	if err != nil {
+		t.Fatalf("failed to re-cat: %v", err)
+	}
+	if fmt.Sprint(q.Code) != fmt.Sprint(p.Code) {
+		t.Errorf("code mismatch: got=%04x want=%04x", q.Code, p.Code)
+	}
+	if fmt.Sprint(q.Modules) != fmt.Sprint(p.Modules) {
+		t.Errorf("modules mismatch:\n got=%+v\nwant=%+v", q.Modules, p.Modules)
+	}
+	if fmt.Sprint(q.Labels) != fmt.Sprint(p.Labels) || fmt.Sprint(q.Public) != fmt.Sprint(p.Public) {
+		t.Errorf("labels mismatch: got=%v %v want=%v %v", q.Labels, q.Public, p.Labels, p.Public)
+	}
+}
+
+func TestJmpPin(t *testing.T) {
+	p, err := NewProgram(".program edge\n.jmp_pin 7\nloop:\n\tjmp\tpin, loop\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if !p.Attr.HasJmpPin || p.Attr.JmpPin != 7 {
+		t.Errorf("got jmp pin %v %d", p.Attr.HasJmpPin, p.Attr.JmpPin)
+	}
+	if got := strings.Join(p.Disassemble(), "\n"); !strings.Contains(got, "\n.jmp_pin 7\n") {
+		t.Errorf("missing .jmp_pin in:\n%s", got)
+	}
+	if got := strings.Join(p.MakePackage("test", nil), "\n"); !strings.Contains(got, "\tcfg.SetJmpPin(7)\n") {
+		t.Errorf("missing SetJmpPin in:\n%s", got)
+	}
+	if got := strings.Join(p.MakeCHeader("test"), "\n"); !strings.Contains(got, "    sm_config_set_jmp_pin(&c, 7);\n") {
+		t.Errorf("missing sm_config_set_jmp_pin in:\n%s", got)
+	}
+	for _, src := range []string{".jmp_pin 32", ".jmp_pin", ".jmp_pin 1 2"} {
+		if _, err := NewProgram(".program bad\n" + src + "\n"); err == nil {
+			t.Errorf("%q: expected an error", src)
+		}
+	}
+}
+
+func TestNonASCII(t *testing.T) {
+	_, err := Assemble("set\u00a0x, 1", nil)
+	var pe *ParseError
+	if !errors.Is(err, ErrNonASCII) || !errors.As(err, &pe) || pe.Column != 4 {
+		t.Errorf("got=%v want ErrNonASCII at column 4", err)
+	}
+	_, err = NewProgram(".program quote\n\tset\tx, 1\n\tjmp\t“loop”\n")
+	if !errors.Is(err, ErrNonASCII) {
+		t.Fatalf("got=%v want ErrNonASCII", err)
+	}
+	if want := `line 3:6: non-ASCII character '“' (U+201C) at byte offset 5`; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("got=%q want=%q", err, want)
+	}
+	if _, err := NewProgram(".program ok ; café\n\tnop  // “quoted”\n"); err != nil {
+		t.Errorf("non-ASCII comment rejected: %v", err)
+	}
+}
+
+func TestIRQRoundTrip(t *testing.T) {
+	modes := []struct {
+		word string
+		bits uint16
+	}{
+		{"set", 0}, {"wait", 0b0100000}, {"clear", 0b1000000},
+	}
+	for _, m := range modes {
+		for idxMode := uint16(0); idxMode < 4; idxMode++ {
+			for n := uint16(0); n < 8; n++ {
+				var src string
+				switch idxMode {
+				case 0b00:
+					src = fmt.Sprint("irq ", m.word, " ", n)
+				case 0b01:
+					src = fmt.Sprint("irq prev ", m.word, " ", n)
+				case 0b10:
+					src = fmt.Sprint("irq ", m.word, " ", n, " rel")
+				case 0b11:
+					src = fmt.Sprint("irq next ", m.word, " ", n)
+				}
+				want := 0xc000 | m.bits | idxMode<<3 | n
+				code, err := Assemble(src, nil)
+				if err != nil || code != want {
+					t.Errorf("%q: got=%04x want=%04x: %v", src, code, want, err)
+					continue
+				}
+				text, err := Disassemble(code, nil)
+				if err != nil {
+					t.Errorf("%q: disassemble failed: %v", src, err)
+					continue
+				}
+				if again, err := Assemble(text, nil); err != nil || again != code {
+					t.Errorf("%q -> %q: got=%04x want=%04x: %v", src, text, again, code, err)
+				}
+			}
+		}
+	}
+	for _, v := range []struct {
+		src  string
+		code uint16
+		text string
+	}{
+		{"irq next set 3", 0xc01b, "irq\tnext 3"},
+		{"irq clear 2 rel", 0xc052, "irq\tclear 2 rel"},
+		{"irq nowait 1", 0xc001, "irq\t1"},
+	} {
+		code, err := Assemble(v.src, nil)
+		if err != nil || code != v.code {
+			t.Errorf("%q: got=%04x want=%04x: %v", v.src, code, v.code, err)
+		} else if text, _ := Disassemble(code, nil); text != v.text {
+			t.Errorf("%q: got=%q want=%q", v.src, text, v.text)
+		}
+	}
+	for _, src := range []string{"irq prev 1 rel", "irq next 8", "irq clear wait 1"} {
+		if _, err := Assemble(src, nil); err == nil {
+			t.Errorf("%q: expected an error", src)
+		}
+	}
+}
+
+func TestLabelWithInstruction(t *testing.T) {
+	p, err := NewProgram(".program compact\nstart: set x, 3\nloop:\tjmp x--, loop\npublic done: jmp start [1]\n\tjmp done\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if want := []uint16{0xe023, 0x0041, 0x0100, 0x0002}; fmt.Sprint(p.Code) != fmt.Sprint(want) {
+		t.Errorf("got=%04x want=%04x", p.Code, want)
+	}
+	if p.Labels["start"] != 0 || p.Labels["loop"] != 1 || p.Labels["done"] != 2 || !p.Public["done"] {
+		t.Errorf("bad labels: %v public=%v", p.Labels, p.Public)
+	}
+	if got := p.where(1); got != "line 3: offset 1" {
+		t.Errorf("got=%q want line 3", got)
+	}
+	vs := []struct {
+		src, want string
+	}{
+		{"a: nop\na: nop\n", `line 3:1: duplicate label "a" of value 0`},
+		{"a: set x, 99\n", `line 2:11: bad set instruction`},
+		{"a: jmpp 1\n", `line 2:4: invalid instruction "jmpp"`},
+	}
+	for i, v := range vs {
+		_, err := NewProgram(".program bad\n" + v.src)
+		if err == nil {
+			t.Errorf("[%d] expected an error", i)
+		} else if !strings.HasPrefix(err.Error(), v.want) {
+			t.Errorf("[%d] got=%q want=%q", i, err, v.want)
+		}
+	}
+	q := &Program{}
+	for _, line := range []string{"top: jmp next", "next: jmp top"} {
+		if err := q.Append(line); err != nil {
+			t.Fatalf("Append(%q) failed: %v", line, err)
+		}
+	}
+	if err := q.Finalize(); err != nil || fmt.Sprint(q.Code) != fmt.Sprint([]uint16{1, 0}) {
+		t.Errorf("got=%04x: %v", q.Code, err)
+	}
+}
+
+func TestAssembleLinesLabel(t *testing.T) {
+	words, err := AssembleLines("top: set x, 1\n\tjmp top\n", nil)
+	if err != nil {
+		t.Fatalf("failed to assemble: %v", err)
+	}
+	if want := []uint16{0xe021, 0x0000}; fmt.Sprint(words) != fmt.Sprint(want) {
+		t.Errorf("got=%04x want=%04x", words, want)
+	}
+}
+
+func TestRxFifoIndex(t *testing.T) {
+	for _, v := range []struct {
+		src  string
+		code uint16
+	}{
+		{"mov rxfifo[y], isr", 0x8010},
+		{"mov osr, rxfifo[y]", 0x8090},
+		{"mov rxfifo[3], isr", 0x801b},
+		{"mov osr, rxfifo[2]", 0x809a},
+	} {
+		code, err := Assemble(v.src, nil)
+		if err != nil || code != v.code {
+			t.Errorf("%q: got=%04x want=%04x: %v", v.src, code, v.code, err)
+			continue
+		}
+		if text, _ := Disassemble(code, nil); strings.Join(strings.Fields(text), " ") != v.src {
+			t.Errorf("%q: disassembled as %q", v.src, text)
+		}
+	}
+	for _, v := range []struct {
+		src, want string
+	}{
+		{"mov rxfifo[4], isr", `rxfifo index "4" not y or 0..3`},
+		{"mov osr, rxfifo[x]", `rxfifo index "x" not y or 0..3`},
+		{"mov rxfifo[ 0 ], isr", `"rxfifo[" needs a y or 0..3 index with no spaces`},
+	} {
+		_, err := Assemble(v.src, nil)
+		if !errors.Is(err, ErrBad) || !strings.Contains(err.Error(), v.want) {
+			t.Errorf("%q: got=%v want %q", v.src, err, v.want)
+		}
+	}
+}
+
+func TestSideSetField(t *testing.T) {
+	vs := []struct {
+		s     Settings
+		value uint16
+		bits  uint16
+	}{
+		{Settings{SideSet: 1}, 1, 0x1000},
+		{Settings{SideSet: 2}, 3, 0x1800},
+		{Settings{SideSet: 5}, 0x15, 0x1500},
+		{Settings{SideSet: 1, SideSetOpt: true}, 1, 0x1800},
+		{Settings{SideSet: 2, SideSetOpt: true}, 0, 0x1000},
+		{Settings{SideSet: 4, SideSetOpt: true}, 9, 0x1900},
+	}
+	for i, v := range vs {
+		bits, err := EncodeSideSet(v.value, v.s)
+		if err != nil || bits != v.bits {
+			t.Errorf("[%d] got=%04x want=%04x: %v", i, bits, v.bits, err)
+			continue
+		}
+		value, present, err := DecodeSideSet(0xa042|bits, v.s)
+		if err != nil || !present || value != v.value {
+			t.Errorf("[%d] decoded %d, %v, %v want %d", i, value, present, err, v.value)
+		}
+	}
+	if _, err := EncodeSideSet(2, Settings{SideSet: 1}); err == nil {
+		t.Error("expected an error for a side-set value too large")
+	}
+	if _, err := EncodeSideSet(0, Settings{}); err == nil {
+		t.Error("expected an error for no side-set bits")
+	}
+	if _, present, err := DecodeSideSet(0xa042, Settings{SideSet: 1, SideSetOpt: true}); present || err != nil {
+		t.Errorf("omitted opt side-set: present=%v err=%v", present, err)
+	}
+	if _, _, err := DecodeSideSet(0xa842, Settings{SideSet: 1, SideSetOpt: true}); !errors.Is(err, ErrBad) {
+		t.Errorf("got=%v want ErrBad", err)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	p, err := NewProgram(`.program all
+.pio_version 1
+.side_set 1 opt
+.out 8 left auto
+.fifo putget
+	jmp	pin, 2 side 1
+	wait	1 jmppin
+	wait	0 irq 1
+	irq	set 2 side 0
+	out	exec, 16
+	mov	rxfifo[0], isr
+`)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	want := Features{SideSet: 2, AutoPull: true, JmpPin: 2, IRQ: 2, Exec: 1, DirectFIFO: 1}
+	if got := p.Features(); got != want {
+		t.Errorf("got=%+v want=%+v", got, want)
+	}
+}
+
+func TestNegativeOperand(t *testing.T) {
+	for _, src := range []string{
+		"set x, -1",
+		"out pins, -8",
+		"in x, -1",
+		"wait -1 gpio 2",
+		"wait 1 gpio -2",
+		"wait 1 irq -1",
+		"wait 1 irq prev -1",
+		"wait 1 jmppin + -1",
+		"irq -1",
+		"irq clear -3 rel",
+		"nop [-1]",
+	} {
+		_, err := Assemble(src, nil)
+		if !errors.Is(err, ErrNegative) {
+			t.Errorf("%q: got=%v want ErrNegative", src, err)
+		} else if !strings.Contains(err.Error(), "operand must be non-negative") {
+			t.Errorf("%q: got=%q", src, err)
+		}
+	}
+	if _, err := NewProgram(".program neg\n.define N -1\n"); !errors.Is(err, ErrNegative) {
+		t.Errorf("got=%v want ErrNegative", err)
+	}
+}
+
+func TestCatOptions(t *testing.T) {
+	a, err := NewProgram(".program a\n\tnop\n\tnop\n\tnop\n")
+	if err != nil {
+		t.Fatalf("failed to compile a: %v", err)
+	}
+	b, err := NewProgram(".program b\n\tnop\n\tnop\n")
+	if err != nil {
+		t.Fatalf("failed to compile b: %v", err)
+	}
+	if _, err := Cat("ab", a, b); err != nil {
+		t.Errorf("default limit rejected 5 instructions: %v", err)
+	}
+	_, err = CatWith("ab", &CatOptions{MaxInstructions: 4}, a, b)
+	if err == nil {
+		t.Fatal("limit of 4 accepted 5 instructions")
+	}
+	if want := `combined code for "ab" too long: 5 > 4 (a: 3, b: 2)`; err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+	if _, err := NewProgramWith(".program a\n\tnop\n\tnop\n\tnop\n", &NewProgramOptions{MaxInstructions: 2}); err == nil {
+		t.Error("NewProgramWith accepted 3 instructions with a limit of 2")
+	}
+}
+
+func TestExplainInstruction(t *testing.T) {
+	p, err := NewProgram(".program a\n.side_set 1 opt\nl:\n\tjmp !x l side 1 [2]\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	vs := []struct {
+		instr uint16
+		p     *Program
+		want  string
+	}{
+		{p.Code[0], p, "bits 15-13: 000 (jmp)\nbit 12: 1 (side-set enable)\nbit 11: 1 (side-set 1)\nbits 10-8: 010 (delay 2)\nbits 7-5: 001 (condition !x)\nbits 4-0: 00000 (address 0, l)"},
+		{0x6021, nil, "bits 15-13: 011 (out)\nbits 12-8: 00000 (delay 0)\nbits 7-5: 001 (destination x)\nbits 4-0: 00001 (bit count 1)"},
+		{0x801f, nil, "bits 15-13: 100 (unknown)\nbits 12-8: 00000 (delay 0)\nbits 7-0: 00011111 (unknown operands)"},
+		{0xa022, nil, "bits 15-13: 101 (mov)\nbits 12-8: 00000 (delay 0)\nbits 7-5: 001 (destination x)\nbits 4-3: 00 (operation none)\nbits 2-0: 010 (source y)"},
+		{0xa02a, nil, "bits 15-13: 101 (mov)\nbits 12-8: 00000 (delay 0)\nbits 7-5: 001 (destination x)\nbits 4-3: 01 (operation invert)\nbits 2-0: 010 (source y)"},
+		{0xa032, nil, "bits 15-13: 101 (mov)\nbits 12-8: 00000 (delay 0)\nbits 7-5: 001 (destination x)\nbits 4-3: 10 (operation bit-reverse)\nbits 2-0: 010 (source y)"},
+	}
+	for i, v := range vs {
+		if got := ExplainInstruction(v.instr, v.p); got != v.want {
+			t.Errorf("[%d] got:\n%s\nwant:\n%s", i, got, v.want)
+		}
+	}
+}
+
+func TestStrictSyntax(t *testing.T) {
+	p := &Program{Labels: map[string]uint16{"loop": 0}}
+	strict := &AssembleOptions{StrictSyntax: true}
+	for _, code := range []string{
+		"set x, 1",
+		"set x 1",
+		"wait 1 gpio 3",
+		"mov x, ! y ; comment",
+		"jmp !x, loop",
+		"jmp !x loop",
+		"jmp loop",
+		"mov rxfifo[0], isr",
+		"pull ifempty noblock",
+		"out pins, 8 [2]",
+	} {
+		if _, err := AssembleWith(code, p, strict); err != nil {
+			t.Errorf("%q rejected: %v", code, err)
+		}
+	}
+	for _, code := range []string{
+		"wait 1, gpio 3",
+		"set x, 1,",
+		"mov x, y # comment",
+		"jmp +1",
+	} {
+		if _, err := Assemble(code, p); err != nil {
+			t.Errorf("%q rejected by default: %v", code, err)
+		}
+		if _, err := AssembleWith(code, p, strict); !errors.Is(err, ErrStrict) {
+			t.Errorf("%q got %v, want ErrStrict", code, err)
+		}
+	}
+	if _, err := NewProgramWith(".program a\n# comment\n\tnop\n", &NewProgramOptions{StrictSyntax: true}); !errors.Is(err, ErrStrict) {
+		t.Errorf("'#' comment line got %v, want ErrStrict", err)
+	}
+}
+
+func TestCatLabelCollision(t *testing.T) {
+	a, err := NewProgram(".program a\n\tnop\n")
+	if err != nil {
+		t.Fatalf("failed to compile a: %v", err)
+	}
+	a1, err := NewProgram(".program a1\n\tnop\n")
+	if err != nil {
+		t.Fatalf("failed to compile a1: %v", err)
+	}
+	ps := []*Program{a, a1}
+	for len(ps) < 11 {
+		ps = append(ps, a)
+	}
+	if _, err := Cat("big", ps...); err != nil {
+		t.Fatalf("unexpected cat failure: %v", err)
+	}
+	// Module 11 is named "a" and module 1 is named "a1", so
+	// both have the combined labels "a11_origin" etc.
+	_, err = Cat("big", append(ps, a)...)
+	if want := `combined label "a11_origin" of module 11 collides with module 1`; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+	c, err := NewProgram(".program c\norigin:\n\tnop\n")
+	if err != nil {
+		t.Fatalf("failed to compile c: %v", err)
+	}
+	_, err = Cat("c", c)
+	if want := `combined label "c0_origin" of module 0 is generated twice`; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
+
+func TestWrapDirectives(t *testing.T) {
+	vs := []struct {
+		source, want string
+	}{
+		{".program a\n\tnop\n.wrap\n\tnop\n.wrap\n", `line 5:1: second .wrap (first at line 3): ".wrap"`},
+		{".program a\n.wrap_target\n\tnop\n.wrap_target\n\tnop\n", `line 4:1: second .wrap_target (first at line 2): ".wrap_target"`},
+		{".program a\n\tnop\n.wrap 1\n", `line 3:7: .wrap takes no arguments: ".wrap 1"`},
+		{".program a\n.wrap\n\tnop\n", `line 2:1: .wrap before any instruction: ".wrap"`},
+		{".program a\n\tnop\n.wrap_target\n", `line 3: .wrap_target at offset 1 has no instruction after it: ".wrap_target"`},
+		{".program a\n\tnop\n.wrap\n.wrap_target\n\tnop\n", `line 4: .wrap_target at offset 1 follows .wrap at offset 0 (line 3): ".wrap_target"`},
+	}
+	for i, v := range vs {
+		_, err := NewProgram(v.source)
+		if err == nil || err.Error() != v.want {
+			t.Errorf("[%d] got %v, want %s", i, err, v.want)
+		}
+	}
+}
+
+func TestParseCHeader(t *testing.T) {
+	p, err := NewProgram(`.program tx
+.side_set 1 opt
+.out 8 left auto 8
+.fifo tx
+.jmp_pin 4
+public start:
+	pull	side 1
+.wrap_target
+loop:
+	out	pins, 1	[1]
+	jmp	!osre, loop	side 0
+	jmp	pin, start
+.wrap
+`)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	q, err := ParseCHeader(strings.Join(p.MakeCHeader("test"), "\n"))
+	if err != nil {
+		t.Fatalf("failed to parse header: %v", err)
+	}
+	if fmt.Sprint(q.Code) != fmt.Sprint(p.Code) {
+		t.Errorf("code mismatch: got=%04x want=%04x", q.Code, p.Code)
+	}
+	// The header does not record private labels or the .out
+	// pin count.
+	want := p.Attr
+	want.Out = 1
+	if q.Attr.LangOpts, want.LangOpts = nil, nil; !reflect.DeepEqual(q.Attr, want) {
+		t.Errorf("settings mismatch:\n got=%+v\nwant=%+v", q.Attr, want)
+	}
+	if len(q.Labels) != 1 || q.Labels["start"] != 0 || !q.Public["start"] {
+		t.Errorf("got labels %v, public %v", q.Labels, q.Public)
+	}
+
+	// The pioasm output for the same program.
+	pioasm := `#define tx_wrap_target 1
+#define tx_wrap 3
+#define tx_pio_version 0
+
+#define tx_offset_start 0u
+
+static const uint16_t tx_program_instructions[] = {
+    0x98a0, //  0: pull   block           side 1
+            //     .wrap_target
+    0x6101, //  1: out    pins, 1         [1]
+    0x10e1, //  2: jmp    !osre, 1        side 0
+    0x00c0, //  3: jmp    pin, 0
+            //     .wrap
+};
+
+#if !PICO_NO_HARDWARE
+static inline pio_sm_config tx_program_get_default_config(uint offset) {
+    pio_sm_config c = pio_get_default_sm_config();
+    sm_config_set_wrap(&c, offset + tx_wrap_target, offset + tx_wrap);
+    sm_config_set_sideset(&c, 2, true, false);
+    return c;
+}
+#endif
+`
+	r, err := ParseCHeader(pioasm)
+	if err != nil {
+		t.Fatalf("failed to parse pioasm header: %v", err)
+	}
+	if fmt.Sprint(r.Code) != fmt.Sprint(p.Code) {
+		t.Errorf("pioasm code mismatch: got=%04x want=%04x", r.Code, p.Code)
+	}
+	if r.Attr.SideSet != 1 || !r.Attr.SideSetOpt || r.Attr.Wrap != 3 || r.Attr.WrapTarget != 1 || r.Labels["start"] != 0 || !r.Public["start"] {
+		t.Errorf("bad pioasm settings: %+v labels=%v", r.Attr, r.Labels)
+	}
+	if _, err := ParseCHeader("#define x 1\n"); err == nil {
+		t.Error("header without instructions accepted")
+	}
+}
+
+func TestSideSetNotes(t *testing.T) {
+	src := ".program a\n.side_set 2 opt\n\tnop\tside 1\n\tnop\n"
+	p, err := NewProgram(src)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	got := p.DisassembleWith(&DisassembleOptions{Indent: "\t", SideSetNotes: true})
+	want := []string{".program a", ".side_set 2 opt", ".wrap_target", "\tnop\t\tside 1", "\tnop\t\t; no side-set (opt bit clear)", ".wrap"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	q, err := NewProgram(strings.Join(got, "\n"))
+	if err != nil {
+		t.Fatalf("failed to recompile: %v", err)
+	}
+	if fmt.Sprint(q.Code) != fmt.Sprint(p.Code) {
+		t.Errorf("code mismatch: got=%04x want=%04x", q.Code, p.Code)
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	p, err := NewProgram(`.program expr
+.define BASE 3
+.define MASK (1 << 3)
+.define HALF (MASK / 2 - -1)
+	set	x, (BASE + 1)
+	set	y, (MASK * (2 + 1) >> 1)
+	jmp	(done - 1)
+	set	pins, HALF
+done:
+	out	x, (BASE*8)
+`)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if got := p.Defines["MASK"]; got != 8 {
+		t.Errorf("got MASK=%d, want 8", got)
+	}
+	want := []string{"set\tx, 4", "set\ty, 12", "jmp\t3", "set\tpins, 5", "out\tx, 24"}
+	for i, code := range p.Code {
+		text, err := Disassemble(code, nil)
+		if err != nil || text != want[i] {
+			t.Errorf("[%d] got %q (%v), want %q", i, text, err, want[i])
+		}
+	}
+	for _, bad := range []string{
+		"\tset\tx, (1 / 0)\n",
+		"\tset\tx, (4 * 9)\n",
+		"\tset\tx, (1 - 2)\n",
+		"\tset\tx, (1 + 2\n",
+		".define X (1 << 40)\n",
+		".define X (UNKNOWN + 1)\n",
+	} {
+		if _, err := NewProgram(".program bad\n" + bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestSideSetAllZero(t *testing.T) {
+	p := &Program{
+		Attr: Settings{Name: "hand", SideSet: 2, Wrap: 2},
+		Code: []uint16{0xa042, 0x0000},
+	}
+	errs := p.Validate()
+	if len(errs) != 1 || !errors.Is(errs[0], ErrSideSet) || errs[0].Error() != `"hand" side-set 2 bits are 0 in every instruction: side-set misconfigured` {
+		t.Errorf("got %v", errs)
+	}
+	q, err := NewProgram(".program used\n.side_set 1\n\tnop\tside 0\n\tnop\tside 1\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if errs := q.Validate(); len(errs) != 0 {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+}
+
+func TestIsComputedJump(t *testing.T) {
+	vs := []struct {
+		src  string
+		want bool
+	}{
+		{"mov\tpc, x", true},
+		{"mov\tpc, isr", true},
+		{"mov\tpc, !osr", true},
+		{"out\tpc, 5", true},
+		{"mov\tpins, x", false},
+		{"jmp\t3", false},
+		{"mov\texec, x", false},
+	}
+	for i, v := range vs {
+		code, err := Assemble(v.src, nil)
+		if err != nil {
+			t.Fatalf("[%d] failed to assemble %q: %v", i, v.src, err)
+		}
+		if text, _ := Disassemble(code, nil); text != v.src {
+			t.Errorf("[%d] round trip got %q, want %q", i, text, v.src)
+		}
+		if got := IsComputedJump(code); got != v.want {
+			t.Errorf("[%d] %q got %v, want %v", i, v.src, got, v.want)
+		}
+	}
+}
+
+func TestTarget(t *testing.T) {
+	rp2040 := &Program{Attr: Settings{Target: TargetRP2040}}
+	rp2350 := &Program{Attr: Settings{PioVersion: 1}}
+	for _, code := range []string{
+		"mov rxfifo[y], isr",
+		"wait 1 jmppin",
+		"irq next set 2",
+		"wait 0 irq prev 1",
+		"mov pindirs, x",
+	} {
+		if _, err := Assemble(code, rp2350); err != nil {
+			t.Errorf("%q rejected for the RP2350: %v", code, err)
+		}
+		if _, err := Assemble(code, rp2040); !errors.Is(err, ErrTarget) {
+			t.Errorf("%q got %v, want ErrTarget", code, err)
+		}
+	}
+	_, err := Assemble("wait 1 jmppin", rp2040)
+	if want := `column 1: unsupported by target: "wait 1 jmppin" uses the jmppin wait source, which the RP2040 lacks: "wait 1 jmppin"`; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+	if _, err := Assemble("irq set 2", rp2040); err != nil {
+		t.Errorf("RP2040 irq rejected: %v", err)
+	}
+	if _, err := NewProgramWith(".program a\n.pio_version 1\n\tnop\n", &NewProgramOptions{Target: TargetRP2040}); !errors.Is(err, ErrTarget) {
+		t.Errorf(".pio_version 1 got %v, want ErrTarget", err)
+	}
+	if err := (Settings{Target: TargetRP2040, PioVersion: 1}).Validate(); !errors.Is(err, ErrSettings) {
+		t.Errorf("got %v, want ErrSettings", err)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	p, err := NewProgram(".program a\n.side_set 1 opt\nloop:\n\tnop\n")
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	vs := []struct {
+		line, want string
+	}{
+		{"PULL", "\tpull\tblock"},
+		{"push iffull", "\tpush\tiffull block"},
+		{"  set x 1 side 1 ; one", "\tset\tx, 1\tside 1\t; one"},
+		{"loop: jmp !x loop", "loop:\tjmp\t!x loop"},
+		{"public start: mov x ! y [1]", "public start:\tmov\tx, !y [1]"},
+		{"out pins,8", "\tout\tpins, 8"},
+		{"nop", "\tnop"},
+		{".wrap_target", ".wrap_target"},
+		{"loop:", "loop:"},
+		{"", ""},
+	}
+	for i, v := range vs {
+		got, err := Normalize(v.line, p)
+		if err != nil || got != v.want {
+			t.Errorf("[%d] %q got %q (%v), want %q", i, v.line, got, err, v.want)
+		}
+	}
+	if _, err := Normalize("jmp", p); err == nil {
+		t.Error("incomplete jmp accepted")
+	}
+}
+
+func TestCodeBlocks(t *testing.T) {
+	src := `.program blink
+	set	pins, 1 [31]
+	set	pins, 0 [31]
+
+% c-sdk {
+// Helper function; note the semicolons.
+void blink_program_init(PIO pio, uint sm, uint offset, uint pin) {
+   pio_gpio_init(pio, pin);
+}
+%}
+`
+	for _, opts := range []*NewProgramOptions{nil, {Semicolons: true}} {
+		p, err := NewProgramWith(src, opts)
+		if err != nil {
+			t.Fatalf("failed to compile: %v", err)
+		}
+		if got := p.Attr.CodeBlocks["c-sdk"]; len(got) != 4 || got[3] != "}" {
+			t.Errorf("got c-sdk block %q", got)
+		}
+		header := strings.Join(p.MakeCHeader("test"), "\n")
+		if want := "\n   pio_gpio_init(pio, pin);\n}\n\n#endif\n"; !strings.Contains(header, want) {
+			t.Errorf("missing %q in:\n%s", want, header)
+		}
+		q, err := NewProgram(strings.Join(p.Disassemble(), "\n"))
+		if err != nil {
+			t.Fatalf("failed to recompile listing: %v", err)
+		}
+		if !reflect.DeepEqual(q.Attr.CodeBlocks, p.Attr.CodeBlocks) {
+			t.Errorf("listing lost code blocks: got %q, want %q", q.Attr.CodeBlocks, p.Attr.CodeBlocks)
+		}
+	}
+	p, err := NewProgram(".program a\n\tnop\n% go {\nfunc Extra() {}\n%}\n")
+	if err != nil {
+		t.Fatalf("failed to compile go block: %v", err)
+	}
+	if pkg := strings.Join(p.MakePackage("test", nil), "\n"); !strings.Contains(pkg, "\nfunc Extra() {}\n") {
+		t.Errorf("missing go block in:\n%s", pkg)
+	}
+	_, err = NewProgram(".program a\n\tnop\n% c-sdk {\nint x;\n")
+	if want := `line 3: unterminated % c-sdk block: "% c-sdk {"`; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+}
+
+func TestAppendProgram(t *testing.T) {
+	a, err := NewProgram(".program a\nloop:\n\tset\tx, 1\n\tjmp\tloop\n")
+	if err != nil {
+		t.Fatalf("failed to compile a: %v", err)
+	}
+	b, err := NewProgram(".program b\npublic top:\n\tnop\n\tjmp\ttop\n")
+	if err != nil {
+		t.Fatalf("failed to compile b: %v", err)
+	}
+	c, err := NewProgram(".program c\n\tjmp\t0\n")
+	if err != nil {
+		t.Fatalf("failed to compile c: %v", err)
+	}
+	want, err := Cat("a", a, b, c)
+	if err != nil {
+		t.Fatalf("failed to cat: %v", err)
+	}
+	p := *a
+	if err := p.AppendProgram(b); err != nil {
+		t.Fatalf("failed to append b: %v", err)
+	}
+	if err := p.AppendProgram(c); err != nil {
+		t.Fatalf("failed to append c: %v", err)
+	}
+	if fmt.Sprint(p.Code) != fmt.Sprint(want.Code) {
+		t.Errorf("code mismatch: got=%04x want=%04x", p.Code, want.Code)
+	}
+	if !reflect.DeepEqual(p.Labels, want.Labels) || !reflect.DeepEqual(p.Public, want.Public) {
+		t.Errorf("labels mismatch: got=%v want=%v", p.Labels, want.Labels)
+	}
+	if fmt.Sprint(p.Modules) != fmt.Sprint(want.Modules) {
+		t.Errorf("modules mismatch:\n got=%+v\nwant=%+v", p.Modules, want.Modules)
+	}
+	if p.Labels["b1_top"] != 2 || p.Code[3] != 0x0002 {
+		t.Errorf("b not relocated: labels=%v code=%04x", p.Labels, p.Code)
+	}
+
+	big, err := NewProgram(".program big\n" + strings.Repeat("\tnop\n", 31))
+	if err != nil {
+		t.Fatalf("failed to compile big: %v", err)
+	}
+	before := fmt.Sprint(p.Code)
+	if err := p.AppendProgram(big); err == nil {
+		t.Error("appending past 32 instructions succeeded")
+	}
+	if fmt.Sprint(p.Code) != before {
+		t.Error("failed append changed the program")
+	}
+}
+
+func TestIRQNames(t *testing.T) {
+	src := ".program a\n.pio_version 1\n.define DONE 3\n.define READY 1\n\tirq\tclear DONE\n\twait\t1 irq READY rel\n\twait\t0 irq next DONE\n\tirq\t2\n\tset\tx, 3\n"
+	p, err := NewProgram(src)
+	if err != nil {
+		t.Fatalf("failed to compile: %v", err)
+	}
+	if got := strings.Join(p.Disassemble(), "\n"); strings.Contains(got, "irq\tclear DONE") {
+		t.Errorf("irq names used by default:\n%s", got)
+	}
+	listing := p.DisassembleWith(&DisassembleOptions{Indent: "\t", IRQNames: []string{"DONE", "READY"}})
+	got := strings.Join(listing, "\n")
+	for _, want := range []string{"\tirq\tclear DONE\n", "\twait\t1 irq READY rel\n", "\twait\t0 irq next DONE\n", "\tirq\t2\n", "\tset\tx, 3\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("missing %q in:\n%s", want, got)
+		}
+	}
+	q, err := NewProgram(got)
+	if err != nil {
+		t.Fatalf("failed to recompile: %v", err)
+	}
+	if fmt.Sprint(q.Code) != fmt.Sprint(p.Code) {
+		t.Errorf("code mismatch: got=%04x want=%04x", q.Code, p.Code)
+	}
+}
+
+func TestMust(t *testing.T) {
+	p := MustProgram(".program a\nloop:\n\tjmp\tloop\n")
+	if got := MustAssemble("jmp loop", p); got != 0x0000 {
+		t.Errorf("got %04x, want 0000", got)
+	}
+	for i, f := range []func(){
+		func() { MustAssemble("jmp nowhere", p) },
+		func() { MustProgram(".program a\n\tbogus\n") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("[%d] no panic", i)
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestNullDiscard(t *testing.T) {
+	vs := []struct {
+		src  string
+		code uint16
+	}{
+		{"out\tnull, 32", 0x6060},
+		{"out\tnull, 1", 0x6061},
+		{"in\tnull, 32", 0x4060},
+		{"in\tnull, 5", 0x4065},
+	}
+	for i, v := range vs {
+		code, err := Assemble(v.src, nil)
+		if err != nil || code != v.code {
+			t.Errorf("[%d] %q got %04x (%v), want %04x", i, v.src, code, err, v.code)
+			continue
+		}
+		if text, err := Disassemble(code, nil); err != nil || text != v.src {
+			t.Errorf("[%d] %04x got %q (%v), want %q", i, code, text, err, v.src)
+		}
+	}
+	for _, bad := range []string{"out null, 0", "in null, 0", "out null, 33"} {
+		if _, err := Assemble(bad, nil); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestBitCountRange(t *testing.T) {
+	for n := 1; n <= 32; n++ {
+		for _, form := range []string{"out\tx, %d", "in\tx, %d"} {
+			src := fmt.Sprintf(form, n)
+			code, err := Assemble(src, nil)
+			if err != nil {
+				t.Errorf("%q rejected: %v", src, err)
+				continue
+			}
+			if got := code & 0b11111; got != uint16(n%32) {
+				t.Errorf("%q encoded count field %d", src, got)
+			}
+			if text, _ := Disassemble(code, nil); text != src {
+				t.Errorf("%04x got %q, want %q", code, text, src)
+			}
+		}
+	}
+	for n := 0; n <= 31; n++ {
+		src := fmt.Sprintf("set\ty, %d", n)
+		code, err := Assemble(src, nil)
+		if err != nil {
+			t.Errorf("%q rejected: %v", src, err)
+			continue
+		}
+		if text, _ := Disassemble(code, nil); text != src {
+			t.Errorf("%04x got %q, want %q", code, text, src)
+		}
+	}
+	for _, bad := range []string{"out x, 0", "in x, 0", "set y, 32", "out x, 33"} {
+		if _, err := Assemble(bad, nil); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestDuplicateSideDelay(t *testing.T) {
+	p := &Program{Attr: Settings{SideSet: 1, SideSetOpt: true}}
+	vs := []struct {
+		code, want string
+	}{
+		{"set x, 1 side 1 side 0", `column 17: duplicate side-set specifier: invalid instruction: "set x, 1 side 1 side 0"`},
+		{"set x, 1 side 1 [1] side 0", `column 21: duplicate side-set specifier: invalid instruction: "set x, 1 side 1 [1] side 0"`},
+		{"set x, 1 [1] [2]", `column 14: duplicate delay specifier: invalid instruction: "set x, 1 [1] [2]"`},
+		{"set x, 1 side 1 [1] [2]", `column 21: duplicate delay specifier: invalid instruction: "set x, 1 side 1 [1] [2]"`},
+	}
+	for i, v := range vs {
+		_, err := Assemble(v.code, p)
+		if err == nil || err.Error() != v.want {
+			t.Errorf("[%d] got %v, want %s", i, err, v.want)
+		}
+	}
+	if _, err := Assemble("set x, 1 [1] [2]", nil); err == nil || !strings.Contains(err.Error(), "duplicate delay") {
+		t.Errorf("got %v without settings", err)
+	}
+}
+
+func TestAssembleAll(t *testing.T) {
+	src := ".program a\n.side_set 9\nloop: bogus x\n\tjmp nowhere\n\tset x, 40\n\tjmp loop\n.wrap extra\n"
+	p, errs := AssembleAll(src)
+	var lines []int
+	for _, e := range errs {
+		lines = append(lines, e.Line)
+	}
+	if want := []int{2, 3, 4, 5, 7}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("got error lines %v, want %v: %v", lines, want, errs)
+	}
+	if p == nil {
+		t.Fatal("no best-effort program")
+	}
+	if want := []uint16{0, 0, 0, 0}; !reflect.DeepEqual(p.Code, want) {
+		t.Errorf("got code %04x, want %04x", p.Code, want)
+	}
+	if addr, ok := p.Labels["loop"]; !ok || addr != 0 {
+		t.Errorf("got loop=%d (%v), want 0", addr, ok)
+	}
+	p, errs = AssembleAll(".program b\n\tset x, 1\n\tjmp 0\n")
+	if len(errs) != 0 || p == nil || len(p.Code) != 2 {
+		t.Errorf("clean source: got %v, %v", p, errs)
+	}
+}
+
+func TestSideDelayOrder(t *testing.T) {
+	p := &Program{Attr: Settings{SideSet: 1}}
+	for _, code := range []string{"out pins, 1 side 1 [2]", "out pins, 1 [2] side 1"} {
+		instr, err := Assemble(code, p)
+		if err != nil {
+			t.Fatalf("%q failed: %v", code, err)
+		}
+		if instr != 0x7201 {
+			t.Errorf("%q got %04x, want 7201", code, instr)
+		}
+		if text, err := Disassemble(instr, p); err != nil || text != "out\tpins, 1\tside 1 [2]" {
+			t.Errorf("%q disassembled to %q (%v)", code, text, err)
+		}
+	}
+	for _, code := range []string{"out pins, 1 [2] side 1 [3]", "out pins, 1 [2] side 1 side 0"} {
+		if _, err := Assemble(code, p); !errors.Is(err, ErrBad) {
+			t.Errorf("%q got %v, want ErrBad", code, err)
+		}
+	}
+	if _, err := Assemble("out pins, 1 [31] side 1", p); !errors.Is(err, ErrDelay) {
+		t.Errorf("got %v, want ErrDelay", err)
+	}
+}
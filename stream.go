@@ -0,0 +1,128 @@
+package pious
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// DisassembleStream reads little-endian uint16 instruction words from
+// r until EOF and writes the disassembly of each, one per line, to
+// w. Unknown or invalid instructions are written in their "unknown
+// <hex>" form and do not abort the stream. The optional p supplies
+// the settings (side-set width) and labels used to decode the words.
+func DisassembleStream(r io.Reader, w io.Writer, p *Program) error {
+	return disassembleStream(r, w, p, false)
+}
+
+// DisassembleStreamPC is like DisassembleStream, but each line is
+// prefixed with the (hex) word offset of the instruction within the
+// stream.
+func DisassembleStreamPC(r io.Reader, w io.Writer, p *Program) error {
+	return disassembleStream(r, w, p, true)
+}
+
+// disassembleStream implements DisassembleStream and
+// DisassembleStreamPC.
+func disassembleStream(r io.Reader, w io.Writer, p *Program, pc bool) error {
+	in := bufio.NewReader(r)
+	out := bufio.NewWriter(w)
+	var word [2]byte
+	for offset := 0; ; offset++ {
+		if _, err := io.ReadFull(in, word[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			out.Flush()
+			return fmt.Errorf("reading word %d: %w", offset, err)
+		}
+		instr := binary.LittleEndian.Uint16(word[:])
+		text, err := Disassemble(instr, p)
+		if err != nil {
+			text = fmt.Sprintf("unknown <%04x>", instr)
+		}
+		if pc {
+			_, err = fmt.Fprintf(out, "%04x: %s\n", offset, text)
+		} else {
+			_, err = fmt.Fprintln(out, text)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// Bytes serializes the Code of p as a sequence of little-endian
+// uint16 words. That is, the low byte of each instruction precedes
+// its high byte. This is the byte order of the RP2040 and RP2350
+// processors, and the byte order read by DisassembleStream.
+func (p *Program) Bytes() []byte {
+	data := make([]byte, 2*len(p.Code))
+	for i, code := range p.Code {
+		binary.LittleEndian.PutUint16(data[2*i:], code)
+	}
+	return data
+}
+
+// FromBytes reconstructs a minimal Program from a sequence of
+// little-endian uint16 words, as generated by (*Program).Bytes. Only
+// the Code is recovered, so the Settings needed to disassemble any
+// side-set values must be supplied separately.
+func FromBytes(data []byte) (*Program, error) {
+	if len(data)%2 != 0 {
+		return nil, fmt.Errorf("odd byte count %d for uint16 words", len(data))
+	}
+	p := &Program{
+		Labels: make(map[string]uint16),
+		Code:   make([]uint16, len(data)/2),
+	}
+	for i := range p.Code {
+		p.Code[i] = binary.LittleEndian.Uint16(data[2*i:])
+	}
+	p.Attr.Wrap = uint16(len(p.Code))
+	p.buildTargets()
+	return p, nil
+}
+
+// Image returns the program image, the instruction words suitable
+// for loading into a PIO block at the LoadOffset of p. This is the
+// Code of p, and is not a copy, unless the program was moved with
+// Relocate: the image then has its jmp targets shifted to the new
+// offset.
+func (p *Program) Image() []uint16 {
+	if p.base == 0 {
+		return p.Code
+	}
+	image := make([]uint16, len(p.Code))
+	for i, c := range p.Code {
+		image[i] = jumpCodeAdjust(c, p.base)
+	}
+	return image
+}
+
+// WriteImage writes the program image of p to w, with each
+// instruction word serialized in the specified byte order.
+func (p *Program) WriteImage(w io.Writer, order binary.ByteOrder) error {
+	return binary.Write(w, order, p.Image())
+}
+
+// LoadImage reads a program image of n instruction words, serialized
+// in the specified byte order, from r. The returned Program holds
+// only the Code, as for FromBytes.
+func LoadImage(r io.Reader, order binary.ByteOrder, n int) (*Program, error) {
+	if n < 0 || n > 32 {
+		return nil, fmt.Errorf("image of %d words does not fit 32 instructions", n)
+	}
+	code := make([]uint16, n)
+	if err := binary.Read(r, order, code); err != nil {
+		return nil, fmt.Errorf("reading %d word image: %w", n, err)
+	}
+	p := &Program{
+		Labels: make(map[string]uint16),
+		Code:   code,
+	}
+	p.Attr.Wrap = uint16(n)
+	p.buildTargets()
+	return p, nil
+}
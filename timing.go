@@ -0,0 +1,73 @@
+package pious
+
+import "fmt"
+
+// Cycles describes the execution time of an instruction, or sequence
+// of instructions.
+type Cycles struct {
+	// Count is the number of cycles taken when nothing stalls:
+	// one per instruction plus any delay cycles.
+	Count uint16
+
+	// Variable indicates that some instruction can stall for an
+	// indeterminate number of cycles. Examples are wait
+	// instructions, and blocking pull and push instructions.
+	Variable bool
+}
+
+// stalls determines if instr may stall when executed with settings s.
+func stalls(instr uint16, s Settings) bool {
+	switch decode(instr) {
+	case idxWAIT:
+		return true
+	case idxIN:
+		return s.InAuto
+	case idxOUT:
+		return s.OutAuto
+	case idxPUSH, idxPULL:
+		return instr&0b100000 != 0
+	case idxIRQ:
+		return instr&0b1100000 == 0b0100000
+	}
+	return false
+}
+
+// CycleCount returns the cycles taken by each instruction of the
+// program. The delay is extracted taking into account the side-set
+// bits that share its field in the instruction encoding.
+func (p *Program) CycleCount() []Cycles {
+	cycles := make([]Cycles, len(p.Code))
+	for i, code := range p.Code {
+		attr := p.moduleAt(uint16(i)).Attr
+		_, _, delay := sideDelay(code, attr)
+		cycles[i] = Cycles{
+			Count:    1 + delay,
+			Variable: stalls(code, attr),
+		}
+	}
+	return cycles
+}
+
+// CyclesBetween sums the cycles of the straight-line sequence of
+// instructions starting at label from and ending before label to.
+// To compute the period of a loop, place the to label after the
+// instruction that jumps back to the from label.
+func (p *Program) CyclesBetween(from, to string) (Cycles, error) {
+	var sum Cycles
+	start, ok := p.Labels[from]
+	if !ok {
+		return sum, fmt.Errorf("unknown label %q", from)
+	}
+	end, ok := p.Labels[to]
+	if !ok {
+		return sum, fmt.Errorf("unknown label %q", to)
+	}
+	if end < start || int(end) > len(p.Code) {
+		return sum, fmt.Errorf("invalid range %q=%d to %q=%d", from, start, to, end)
+	}
+	for _, c := range p.CycleCount()[start:end] {
+		sum.Count += c.Count
+		sum.Variable = sum.Variable || c.Variable
+	}
+	return sum, nil
+}
@@ -0,0 +1,362 @@
+package pious
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrOutOfRange indicates a jmp target beyond the end of the
+	// code.
+	ErrOutOfRange = errors.New("jmp target out of range")
+
+	// ErrSideSet indicates side-set bits that are inconsistent
+	// with the side-set settings, or an optional side-set that is
+	// never used.
+	ErrSideSet = errors.New("side-set misconfigured")
+
+	// ErrDelayOverlap indicates an instruction delay that extends
+	// into the bits reserved for side-set values.
+	ErrDelayOverlap = errors.New("delay overlaps side-set bits")
+
+	// ErrAutoFIFO indicates an explicit pull (push) instruction,
+	// or mov to the OSR (ISR), in a program configured to
+	// autopull (autopush).
+	ErrAutoFIFO = errors.New("explicit fifo access with auto threshold")
+
+	// ErrExec indicates an instruction that executes a data
+	// value as an instruction. The control flow of such a
+	// program cannot be statically determined.
+	ErrExec = errors.New("exec of data as instruction")
+
+	// ErrSettings indicates a Settings value that no directive
+	// could have produced.
+	ErrSettings = errors.New("invalid settings")
+)
+
+// Validate checks a compiled program for problems that are not
+// syntax errors, but that would cause the program to misbehave on
+// hardware. It returns one error per problem found. Note,
+// references to undefined labels are reported as errors by
+// NewProgram.
+func (p *Program) Validate() []error {
+	var errs []error
+	ins := instructions[idxJMP]
+	for i, code := range p.Code {
+		if code&ins.mask != ins.bits {
+			continue
+		}
+		target := code & 0b11111
+		if int(target) < len(p.Code) {
+			continue
+		}
+		name := ""
+		if sym, ok := p.Targets[target]; ok {
+			name = fmt.Sprintf(" (%s)", sym[0])
+		}
+		errs = append(errs, fmt.Errorf("offset %d: target %d%s of %d instructions: %w", i, target, name, len(p.Code), ErrOutOfRange))
+	}
+	errs = append(errs, p.validateSideSet()...)
+	errs = append(errs, p.validateAutoFIFO()...)
+	return append(errs, p.validateExec()...)
+}
+
+// where describes the location of the instruction at offset i,
+// including its source line number when known.
+func (p *Program) where(i int) string {
+	if i < len(p.lines) && p.lines[i] != 0 {
+		return fmt.Sprintf("line %d: offset %d", p.lines[i], i)
+	}
+	return fmt.Sprint("offset ", i)
+}
+
+// validateSideSet checks the optional side-set bits of each
+// instruction. An instruction without a side-set value must have
+// its side-set bits clear, since these are not available for delay.
+// An optional side-set that no instruction uses only costs delay
+// bits, so it is also reported. So is a non-optional side-set whose
+// value is 0 in every instruction, which likely indicates settings
+// that do not match the program.
+func (p *Program) validateSideSet() []error {
+	var errs []error
+	var start uint16
+	for _, m := range p.modules() {
+		if m.SideSet == 0 || m.Length == 0 {
+			start += m.Length
+			continue
+		}
+		used := false
+		for i := start; i < start+m.Length; i++ {
+			value, present, err := DecodeSideSet(p.Code[i], m)
+			if present && (m.SideSetOpt || value != 0) {
+				used = true
+			} else if err != nil {
+				errs = append(errs, fmt.Errorf("%s: side-set bits %04x without the opt bit: %w", p.where(int(i)), value<<(12-m.SideSet), ErrSideSet))
+			}
+		}
+		if !used {
+			at := ""
+			if p.sideSetLine != 0 && p.Modules == nil {
+				at = fmt.Sprintf("line %d: ", p.sideSetLine)
+			}
+			if m.SideSetOpt {
+				errs = append(errs, fmt.Errorf("%s%q optional side-set %d bits never used: %w", at, m.Name, m.SideSet, ErrSideSet))
+			} else {
+				errs = append(errs, fmt.Errorf("%s%q side-set %d bits are 0 in every instruction: %w", at, m.Name, m.SideSet, ErrSideSet))
+			}
+		}
+		start += m.Length
+	}
+	return errs
+}
+
+// IsComputedJump reports whether instr is a jump to a target that
+// is only known at run time: a "mov pc, <source>" or an "out pc, <n>"
+// instruction, as used to implement jump tables.
+func IsComputedJump(instr uint16) bool {
+	dest := (instr >> 5) & 0b111
+	switch decode(instr) {
+	case idxOUT:
+		return dest == 5
+	case idxMOV2:
+		return dest == 5
+	}
+	return false
+}
+
+// successors returns the offsets of the instructions that can follow
+// the one at offset i. The all value is true for a computed branch,
+// such as a "mov pc" instruction, that can reach any instruction.
+func (p *Program) successors(i uint16) (next []uint16, all bool) {
+	code := p.Code[i]
+	if IsComputedJump(code) {
+		return nil, true
+	}
+	dest := (code >> 5) & 0b111
+	switch decode(code) {
+	case idxJMP:
+		next = append(next, code&0b11111)
+		if dest == 0 {
+			return
+		}
+	case idxOUT:
+		// out exec can execute any jmp.
+		if dest == 7 {
+			return nil, true
+		}
+	case idxMOV2:
+		// mov exec can execute any jmp.
+		if dest == 4 {
+			return nil, true
+		}
+	}
+	if wrap, target := p.wrapAt(i); i == wrap {
+		next = append(next, target)
+	} else if int(i)+1 < len(p.Code) {
+		next = append(next, i+1)
+	}
+	return
+}
+
+// Unreachable returns the offsets of the instructions that cannot be
+// executed when starting from the Origin of the program, or of any
+// of its Modules. Control flow follows jmp targets, fall-through and
+// wrapping. Instructions that write to pc, or exec another
+// instruction, are conservatively treated as able to reach every
+// instruction.
+func (p *Program) Unreachable() []uint16 {
+	seen := make([]bool, len(p.Code))
+	var todo []uint16
+	if p.Modules == nil {
+		todo = append(todo, p.Attr.Origin)
+	}
+	for _, m := range p.Modules {
+		todo = append(todo, m.Origin)
+	}
+	for len(todo) != 0 {
+		i := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+		if int(i) >= len(p.Code) || seen[i] {
+			continue
+		}
+		seen[i] = true
+		next, all := p.successors(i)
+		if all {
+			return nil
+		}
+		todo = append(todo, next...)
+	}
+	var dead []uint16
+	for i, ok := range seen {
+		if !ok {
+			dead = append(dead, uint16(i))
+		}
+	}
+	return dead
+}
+
+// validateAutoFIFO reports explicit pull instructions in modules
+// configured by .out to autopull, and explicit push instructions in
+// modules configured by .in to autopush. These double up on the FIFO
+// handling, which is rarely intended. Likewise, a mov to the OSR
+// (ISR) resets the shift count that autopull (autopush) relies on.
+func (p *Program) validateAutoFIFO() []error {
+	var errs []error
+	var start uint16
+	for _, m := range p.modules() {
+		for i := start; i < start+m.Length; i++ {
+			code := p.Code[i]
+			switch decode(code) {
+			case idxMOV2:
+				switch dest := disMDestinations[(code>>5)&0b111]; {
+				case dest == "osr" && m.OutAuto:
+					errs = append(errs, fmt.Errorf("%s: mov osr with .out autopull threshold %d: %w", p.where(int(i)), threshold(m.OutThreshold), ErrAutoFIFO))
+				case dest == "isr" && m.InAuto:
+					errs = append(errs, fmt.Errorf("%s: mov isr with .in autopush threshold %d: %w", p.where(int(i)), threshold(m.InThreshold), ErrAutoFIFO))
+				}
+			case idxPULL:
+				if m.OutAuto {
+					errs = append(errs, fmt.Errorf("%s: pull with .out autopull threshold %d: %w", p.where(int(i)), threshold(m.OutThreshold), ErrAutoFIFO))
+				}
+			case idxPUSH:
+				if m.InAuto {
+					errs = append(errs, fmt.Errorf("%s: push with .in autopush threshold %d: %w", p.where(int(i)), threshold(m.InThreshold), ErrAutoFIFO))
+				}
+			}
+		}
+		start += m.Length
+	}
+	return errs
+}
+
+// validateExec reports each out exec and mov exec instruction. When
+// a mov exec source register is loaded by the immediately preceding
+// set instruction, the executed instruction is known and is
+// disassembled in the report.
+func (p *Program) validateExec() []error {
+	var errs []error
+	var start uint16
+	for _, m := range p.modules() {
+		for i := start; i < start+m.Length; i++ {
+			code := p.Code[i]
+			dest := (code >> 5) & 0b111
+			switch decode(code) {
+			case idxOUT:
+				if dest == 7 {
+					errs = append(errs, fmt.Errorf("%s: out exec of osr data: %w", p.where(int(i)), ErrExec))
+				}
+			case idxMOV2:
+				if dest != 4 {
+					continue
+				}
+				src := code & 0b111
+				op := MovOp((code >> 3) & 0b11)
+				detail := ""
+				if (src == 1 || src == 2) && i > start && decode(p.Code[i-1]) == idxSET && (p.Code[i-1]>>5)&0b111 == src {
+					instr := uint16(op.Apply(uint32(p.Code[i-1] & 0b11111)))
+					if text, err := Disassemble(instr, p.moduleAt(i)); err == nil {
+						detail = fmt.Sprint(" (executes ", strings.Join(strings.Fields(text), " "), ")")
+					}
+				}
+				errs = append(errs, fmt.Errorf("%s: mov exec of %s%s data%s: %w", p.where(int(i)), op, disMSources[src], detail, ErrExec))
+			}
+		}
+		start += m.Length
+	}
+	return errs
+}
+
+// Usage summarizes the use of the 32 instruction slots of a PIO
+// block.
+type Usage struct {
+	Instructions int
+	Free         int
+}
+
+// String formats a Usage, as in "28/32 slots used".
+func (u Usage) String() string {
+	return fmt.Sprintf("%d/32 slots used", 32-u.Free)
+}
+
+// MemoryUsage returns the number of instruction slots used by the
+// program, and the number left free. The Origin of a program is an
+// entry point within its Code, so it does not change these counts,
+// but the slots before the offset a program is moved to with
+// Relocate are not free for it to use.
+func (p *Program) MemoryUsage() Usage {
+	used := int(p.base) + len(p.Code)
+	return Usage{Instructions: len(p.Code), Free: 32 - used}
+}
+
+// DelayOverlaps reports the instructions of p whose delay, as
+// assembled with the p.Attr settings, has bits that s reserves for
+// side-set values. Such an encoding is valid, but under s it means a
+// different delay and side-set. This can happen when a .side_set
+// directive is added to, or widened in, an existing program.
+func (p *Program) DelayOverlaps(s Settings) []error {
+	var errs []error
+	for i, code := range p.Code {
+		side, hasSide, delay := sideDelay(code, p.moduleAt(uint16(i)).Attr)
+		nSide, nHasSide, nDelay := sideDelay(code, s)
+		if delay == nDelay {
+			continue
+		}
+		intended := fmt.Sprintf("[%d]", delay)
+		if hasSide {
+			intended = fmt.Sprintf("side %d [%d]", side, delay)
+		}
+		interpreted := fmt.Sprintf("[%d]", nDelay)
+		if nHasSide {
+			interpreted = fmt.Sprintf("side %d [%d]", nSide, nDelay)
+		}
+		errs = append(errs, fmt.Errorf("%s: intended %s interpreted as %s: %w", p.where(i), intended, interpreted, ErrDelayOverlap))
+	}
+	return errs
+}
+
+// Validate checks that s holds values within the limits NewProgram
+// enforces for the corresponding directives. This is useful for
+// checking a Settings value constructed by hand. The first problem
+// found is returned.
+func (s Settings) Validate() error {
+	switch {
+	case s.PioVersion > 1:
+		return fmt.Errorf("unsupported pio version %d (0 or 1): %w", s.PioVersion, ErrSettings)
+	case s.Target > TargetRP2040:
+		return fmt.Errorf("unknown target %d: %w", s.Target, ErrSettings)
+	case s.Target == TargetRP2040 && s.PioVersion != 0:
+		return fmt.Errorf("pio version %d is for the RP2350: %w", s.PioVersion, ErrSettings)
+	case s.SideSetOpt && s.SideSet > 4:
+		return fmt.Errorf("max optional side_set value is 4, got %d: %w", s.SideSet, ErrSettings)
+	case s.SideSet > 5:
+		return fmt.Errorf("max side_set value is 5, got %d: %w", s.SideSet, ErrSettings)
+	case s.Set > 5:
+		return fmt.Errorf("max set value is 5, got %d: %w", s.Set, ErrSettings)
+	case s.Out > 32:
+		return fmt.Errorf("max out value is 32, got %d: %w", s.Out, ErrSettings)
+	case s.In > 32:
+		return fmt.Errorf("max in value is 32, got %d: %w", s.In, ErrSettings)
+	case s.OutThreshold > 32:
+		return fmt.Errorf("max out threshold is 32, got %d: %w", s.OutThreshold, ErrSettings)
+	case s.InThreshold > 32:
+		return fmt.Errorf("max in threshold is 32, got %d: %w", s.InThreshold, ErrSettings)
+	case s.FifoMode > FifoPutGet:
+		return fmt.Errorf("unknown fifo mode %d: %w", s.FifoMode, ErrSettings)
+	case s.FifoMode >= FifoTxPut && s.PioVersion < 1:
+		return fmt.Errorf("fifo %s requires pio version 1: %w", disFifoModes[s.FifoMode], ErrSettings)
+	case s.MovStatusSel > StatusIRQ:
+		return fmt.Errorf("unknown mov status selector %d: %w", s.MovStatusSel, ErrSettings)
+	case s.MovStatusSel == StatusIRQ && s.PioVersion < 1:
+		return fmt.Errorf("mov status irq requires pio version 1: %w", ErrSettings)
+	case s.MovStatusSel == StatusIRQ && s.MovStatusN > 7:
+		return fmt.Errorf("max mov status irq value is 7, got %d: %w", s.MovStatusN, ErrSettings)
+	case s.MovStatusN > 31:
+		return fmt.Errorf("max mov status value is 31, got %d: %w", s.MovStatusN, ErrSettings)
+	case s.JmpPin > 31:
+		return fmt.Errorf("max jmp pin is 31, got %d: %w", s.JmpPin, ErrSettings)
+	case s.ClockDiv != 0 && (s.ClockDiv < 1 || s.ClockDiv > 65536):
+		return fmt.Errorf("bad clock divider %g (1 to 65536): %w", s.ClockDiv, ErrSettings)
+	}
+	return nil
+}